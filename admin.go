@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ===== 管理接口 =====
+//
+// 供运维处理卡住的上传，只接受 auth.admin_keys 中的 key；未配置 admin_keys 时一律返回 403。
+// 这些操作会绕过正常流程的校验，每次调用都记录调用者（key 指纹）与操作前后的元数据。
+
+// adminKeyID 返回 key 的短指纹，用于日志中标识调用者而不泄露 key 本身。
+func adminKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// requireAdmin 校验请求携带的是 admin key，通过时返回其指纹。
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token := bearerToken(r)
+	if !validAPIKey(s.config().Auth.AdminKeys, token) {
+		writeError(w, http.StatusForbidden, "admin_key_required", "admin key required")
+		return "", false
+	}
+	return adminKeyID(token), true
+}
+
+// POST /api/v1/admin/uploads/{upload_id}/force-complete
+// 按已连续接收的字节数（uploaded_size）截断并完成上传，之后的缺口与乱序到达的数据都会被丢弃；
+// 不再校验 init 时声明的 sha256 与重叠冲突。
+func (s *Server) handleForceComplete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	admin, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	uploadID := r.PathValue("upload_id")
+	if !checkUploadID(w, uploadID) {
+		return
+	}
+
+	mu := s.lock(uploadID)
+	mu.part.Lock()
+	defer mu.part.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	before, err := s.loadMeta(uploadID)
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+	if before.Completed {
+		writeError(w, http.StatusConflict, "upload_completed", "already completed")
+		return
+	}
+	size := before.UploadedSize
+	if size == 0 {
+		writeError(w, http.StatusConflict, "nothing_received", "nothing received")
+		return
+	}
+	meta := before
+	meta.TotalSize = size
+	meta.Streaming = false
+	meta.ReceivedRanges = [][2]int64{{0, size}}
+	meta.ConflictRanges = nil
+	meta.ExpectedSHA256 = ""
+	if size != before.TotalSize {
+		// S3 的 part 无法截断，只能按完整的 part 合并
+		if !s.localOnly(w) {
+			return
+		}
+		// 先保存截断后的元数据再截断 .part：之后 finalize 失败（目标已存在、路径越出根目录等）时，
+		// 磁盘上的元数据与 .part 仍然一致，排除原因后可再次 complete 或 force-complete
+		if err := s.saveMeta(meta); err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "save failed")
+			return
+		}
+		if err := s.store.Resize(meta, size); err != nil {
+			// 截断失败时 .part 未变，恢复原来的元数据
+			if err := s.saveMeta(before); err != nil {
+				log.Printf("restore meta %s failed: %v", uploadID, err)
+			}
+			writeError(w, http.StatusInternalServerError, "internal_error", "truncate failed")
+			return
+		}
+	}
+	meta, location, err := s.finalizeUpload(meta)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	reqLogger(r).Warn("admin force-complete", "admin", admin, "upload_id", uploadID, "before", before, "after", meta)
+	writeJSON(w, http.StatusOK, map[string]any{"completed": true, "path": location, "sha256": meta.SHA256, "total_size": meta.TotalSize})
+}
+
+// POST /api/v1/admin/uploads/{upload_id}/force-cancel[?delete_file=true]
+// 与 cancel 不同，已完成的上传也可以清理：删除其元数据，delete_file=true 时连同完成的文件一起删除。
+func (s *Server) handleForceCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	admin, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	uploadID := r.PathValue("upload_id")
+	if !checkUploadID(w, uploadID) {
+		return
+	}
+	deleteFile := false
+	if v := strings.TrimSpace(r.URL.Query().Get("delete_file")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_delete_file", "invalid delete_file")
+			return
+		}
+		deleteFile = b
+	}
+
+	mu := s.lock(uploadID)
+	mu.part.Lock()
+	defer mu.part.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	meta, err := s.loadMeta(uploadID)
+	if err != nil && !errors.Is(err, errCorruptMeta) {
+		writeLoadError(w, err)
+		return
+	}
+	// 元数据损坏时按未完成处理，清理残留的临时文件
+	if !meta.Completed {
+		s.removeUpload(uploadID)
+		reqLogger(r).Warn("admin force-cancel", "admin", admin, "upload_id", uploadID, "before", meta)
+		writeJSON(w, http.StatusOK, map[string]any{"cancelled": true})
+		return
+	}
+
+	fileDeleted := false
+	if deleteFile {
+		err := s.store.Remove(meta.RelPath)
+		var he *httpError
+		switch {
+		case err == nil:
+			fileDeleted = true
+			s.invalidateQuota(meta.RelPath)
+			s.fileIndex.Delete(meta.RelPath)
+			s.pruneEmptyDirs(meta.RelPath)
+		case errors.As(err, &he) && he.status == http.StatusNotFound:
+			// 文件已被移走或删除，只清理元数据
+		default:
+			writeHTTPError(w, err)
+			return
+		}
+	}
+	s.forgetMeta(uploadID)
+	s.events.publish(uploadID, cancelledEvent(uploadID))
+	reqLogger(r).Warn("admin force-cancel", "admin", admin, "upload_id", uploadID, "before", meta, "file_deleted", fileDeleted)
+	writeJSON(w, http.StatusOK, map[string]any{"cancelled": true, "file_deleted": fileDeleted})
+}
+
+// forgetMeta 删除上传的元数据及其内存状态，不涉及数据本身与并发名额。调用方需持有该上传的锁。
+func (s *Server) forgetMeta(uploadID string) {
+	_ = os.Remove(s.metaPath(uploadID))
+	s.lastSaved.Delete(uploadID)
+	s.metaCache.Delete(uploadID)
+	s.pending.remove(uploadID)
+	s.limiters.Delete(uploadID)
+	s.speeds.forget(uploadID)
+}
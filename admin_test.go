@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// forceComplete 以 admin key 调用 force-complete。
+func forceComplete(s *Server, uploadID string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/admin/uploads/"+uploadID+"/force-complete", nil)
+	r.SetPathValue("upload_id", uploadID)
+	r.Header.Set("Authorization", "Bearer admin-key")
+	w := httptest.NewRecorder()
+	s.handleForceComplete(w, r)
+	return w
+}
+
+// overwrite: reject 下目标已存在时 force-complete 返回 409，截断后的元数据已落盘：
+// 与 .part 一致，移走目标文件后再次 force-complete（或普通 complete）即可完成。
+func TestForceCompleteDestinationExists(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	s := newTestServerAt(t, root, func(cfg *Config) {
+		cfg.Auth.AdminKeys = []string{"admin-key"}
+		cfg.Storage.Overwrite = overwriteReject
+	})
+	meta := newTestUpload(t, s, "fc/a.bin", 8, 4)
+	if w := putChunk(s, meta.UploadID, 0, []byte("abcd")); w.Code != http.StatusOK {
+		t.Fatalf("chunk: %d %s", w.Code, w.Body)
+	}
+	dest := filepath.Join(root, "fc", "a.bin")
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dest, []byte("existing"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := forceComplete(s, meta.UploadID)
+	if w.Code != http.StatusConflict || errorCode(t, w) != "destination_exists" {
+		t.Fatalf("force-complete: %d %s", w.Code, w.Body)
+	}
+	s.metaCache.Delete(meta.UploadID)
+	m, err := s.loadMeta(meta.UploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(s.partPath(meta.UploadID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TotalSize != 4 || fi.Size() != 4 || len(m.ReceivedRanges) != 1 || m.ReceivedRanges[0] != [2]int64{0, 4} {
+		t.Fatalf("after failed force-complete: total_size %d ranges %v .part %d bytes", m.TotalSize, m.ReceivedRanges, fi.Size())
+	}
+	if got, _ := os.ReadFile(dest); string(got) != "existing" {
+		t.Fatalf("existing destination changed: %q", got)
+	}
+
+	if err := os.Remove(dest); err != nil {
+		t.Fatal(err)
+	}
+	if w := forceComplete(s, meta.UploadID); w.Code != http.StatusOK {
+		t.Fatalf("retry: %d %s", w.Code, w.Body)
+	}
+	if got, err := os.ReadFile(dest); err != nil || string(got) != "abcd" {
+		t.Fatalf("final file %q, err %v", got, err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// withAuth 校验 Authorization: Bearer <key>。仅保护 /api/ 下的接口，
+// /healthz、静态资源与能力发现接口保持公开；未配置任何 key 时直接放行。admin key 同样可以访问普通接口，
+// 管理接口另由 requireAdmin 校验。
+func withAuth(keys, adminKeys []string, next http.Handler) http.Handler {
+	if len(keys) == 0 {
+		return next
+	}
+	keys = append(append([]string(nil), keys...), adminKeys...)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == discoveryPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validAPIKey(keys, bearerToken(r)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-upload"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bearerToken(r *http.Request) string {
+	v := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(v) < len("Bearer ") || !strings.EqualFold(v[:len("Bearer ")], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(v[len("Bearer "):])
+}
+
+// validAPIKey 使用常量时间比较，并且总是比较完所有 key，避免通过耗时推断 key 内容。
+func validAPIKey(keys []string, token string) bool {
+	if token == "" {
+		return false
+	}
+	ok := 0
+	for _, k := range keys {
+		ok |= subtle.ConstantTimeCompare([]byte(k), []byte(token))
+	}
+	return ok == 1
+}
+
+// trimKeys 去掉 key 两端的空白并丢弃空 key。
+func trimKeys(keys []string) []string {
+	out := keys[:0]
+	for _, k := range keys {
+		if k = strings.TrimSpace(k); k != "" {
+			out = append(out, k)
+		}
+	}
+	return out
+}
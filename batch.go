@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ===== 批量上传（目录清单） =====
+//
+// 上传整个目录时，客户端用一次 batch init 提交文件清单，服务端为每个文件建立普通的上传会话并返回 batch_id；
+// 之后的分片、complete、cancel 仍按单个 upload_id 进行，batch status 汇总所有文件的进度。
+// 批次记录在状态目录的 batches/<batch_id>.json 中，只保存文件列表，进度始终从各文件的元数据读取。
+// 任一文件创建失败时已创建的会话全部撤销，整个请求按该文件的错误返回。
+
+const (
+	batchDirName  = "batches"
+	maxBatchFiles = 1000
+)
+
+type batchFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`             // 0 表示流式上传
+	SHA256 string `json:"sha256,omitempty"` // 可选，complete 时校验
+}
+
+type batchInitReq struct {
+	ChunkSize int64             `json:"chunk_size"`
+	Files     []batchFile       `json:"files"`
+	Metadata  map[string]string `json:"metadata"` // 可选，应用到每个文件
+}
+
+type batchMeta struct {
+	BatchID   string         `json:"batch_id"`
+	CreatedAt time.Time      `json:"created_at"`
+	Files     []batchFileRef `json:"files"`
+}
+
+type batchFileRef struct {
+	UploadID string `json:"upload_id"`
+	Path     string `json:"path"` // 相对 root_dir 的目标路径
+}
+
+func (s *Server) batchPath(batchID string) string {
+	return filepath.Join(s.stateAbs, batchDirName, batchID+".json")
+}
+
+// POST /api/v1/uploads/batch/init
+func (s *Server) handleBatchInit(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	// 一个批次按一次 init 计入 init_per_minute；并发上限与配额按文件逐个计算
+	if !s.writable(w) || !s.allowInit(w, r) {
+		return
+	}
+	var req batchInitReq
+	if err := s.readJSON(r, &req); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	if len(req.Files) == 0 {
+		writeError(w, http.StatusBadRequest, "empty_batch", "files is empty")
+		return
+	}
+	if len(req.Files) > maxBatchFiles {
+		writeError(w, http.StatusBadRequest, "too_many_files", fmt.Sprintf("too many files: max %d", maxBatchFiles))
+		return
+	}
+	batchID, err := s.newBatchID()
+	if err != nil {
+		log.Printf("allocate batch_id failed: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "allocate batch_id failed")
+		return
+	}
+
+	batch := batchMeta{BatchID: batchID, CreatedAt: time.Now().UTC()}
+	resp := make([]map[string]any, 0, len(req.Files))
+	seen := make(map[string]bool, len(req.Files))
+	for i, f := range req.Files {
+		meta, _, err := s.newUpload(initReq{
+			Path:      f.Path,
+			TotalSize: f.Size,
+			ChunkSize: req.ChunkSize,
+			SHA256:    f.SHA256,
+			Metadata:  req.Metadata,
+			batchID:   batchID,
+		})
+		if err == nil && seen[meta.RelPath] {
+			s.removeUpload(meta.UploadID)
+			err = errStatus(http.StatusBadRequest, "duplicate_path", "duplicate path")
+		}
+		if err != nil {
+			s.discardBatch(batch)
+			writeBatchError(w, i, f.Path, err)
+			return
+		}
+		seen[meta.RelPath] = true
+		batch.Files = append(batch.Files, batchFileRef{UploadID: meta.UploadID, Path: meta.RelPath})
+		item := map[string]any{"path": meta.RelPath, "upload_id": meta.UploadID}
+		if meta.ExpiresAt != nil {
+			item["expires_at"] = meta.ExpiresAt
+		}
+		resp = append(resp, item)
+	}
+	if err := s.saveBatch(batch); err != nil {
+		s.discardBatch(batch)
+		log.Printf("save batch %s failed: %v", batchID, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "save failed")
+		return
+	}
+
+	reqLogger(r).Info("batch initialized", "batch_id", batchID, "files", len(batch.Files),
+		"duration_ms", time.Since(start).Milliseconds())
+	writeJSON(w, http.StatusOK, map[string]any{"batch_id": batchID, "files": resp})
+}
+
+// writeBatchError 按原状态码返回某个文件创建失败的原因，并指出是第几个文件。
+func writeBatchError(w http.ResponseWriter, index int, path string, err error) {
+	var he *httpError
+	if !errors.As(err, &he) {
+		he = errStatus(http.StatusInternalServerError, "internal_error", "init failed")
+	}
+	for k, v := range he.header {
+		w.Header().Set(k, v)
+	}
+	body := map[string]any{"index": index, "path": path}
+	for k, v := range he.body {
+		body[k] = v
+	}
+	writeErrorBody(w, he.status, he.code, he.msg, body)
+}
+
+// discardBatch 撤销批次中已创建的上传会话。
+func (s *Server) discardBatch(batch batchMeta) {
+	for _, f := range batch.Files {
+		mu := s.lock(f.UploadID)
+		mu.part.Lock()
+		mu.Lock()
+		s.removeUpload(f.UploadID)
+		mu.Unlock()
+		mu.part.Unlock()
+	}
+}
+
+// GET /api/v1/uploads/batch/status?batch_id=...
+func (s *Server) handleBatchStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	batchID := strings.TrimSpace(r.URL.Query().Get("batch_id"))
+	if !validUploadID(batchID) {
+		writeError(w, http.StatusNotFound, "batch_not_found", "not found")
+		return
+	}
+	batch, err := s.loadBatch(batchID)
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+
+	type fileStatus struct {
+		UploadID     string `json:"upload_id"`
+		Path         string `json:"path"`
+		TotalSize    int64  `json:"total_size"`
+		UploadedSize int64  `json:"uploaded_size"`
+		Status       string `json:"status"` // uploading | completed | missing（已取消或被回收）
+	}
+	var (
+		files                      = make([]fileStatus, 0, len(batch.Files))
+		totalSize, uploadedSize    int64
+		completedFiles, missingCnt int
+	)
+	for _, f := range batch.Files {
+		st := fileStatus{UploadID: f.UploadID, Path: f.Path, Status: "missing"}
+		meta, err := s.loadMeta(f.UploadID)
+		if err == nil {
+			st.Path = meta.RelPath
+			st.TotalSize = meta.TotalSize
+			st.UploadedSize = meta.UploadedSize
+			st.Status = "uploading"
+			if meta.Completed {
+				st.UploadedSize = meta.TotalSize
+				st.Status = "completed"
+				completedFiles++
+			}
+		} else {
+			missingCnt++
+		}
+		totalSize += st.TotalSize
+		uploadedSize += st.UploadedSize
+		files = append(files, st)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"batch_id":        batch.BatchID,
+		"created_at":      batch.CreatedAt,
+		"total_files":     len(batch.Files),
+		"completed_files": completedFiles,
+		"missing_files":   missingCnt,
+		"total_size":      totalSize,
+		"uploaded_size":   uploadedSize,
+		"completed":       completedFiles == len(batch.Files),
+		"files":           files,
+	})
+}
+
+func (s *Server) newBatchID() (string, error) {
+	for i := 0; i < uploadIDAttempts; i++ {
+		id := generateUploadID(s.config().Storage.UploadIDFormat)
+		exists, err := pathExists(s.batchPath(id))
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return id, nil
+		}
+	}
+	return "", errors.New("could not allocate a unique batch_id")
+}
+
+func (s *Server) saveBatch(batch batchMeta) error {
+	path := s.batchPath(batch.BatchID)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(batch, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, b, 0o644, *s.config().Storage.DurableMeta); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Server) loadBatch(batchID string) (batchMeta, error) {
+	var batch batchMeta
+	b, err := os.ReadFile(s.batchPath(batchID))
+	if err != nil {
+		return batch, err
+	}
+	err = json.Unmarshal(b, &batch)
+	return batch, err
+}
+
+// collectBatches 删除创建时间超过 maxAge、且其中已没有未完成上传的批次记录，返回删除数量。
+func (s *Server) collectBatches(maxAge time.Duration) int {
+	entries, err := os.ReadDir(filepath.Join(s.stateAbs, batchDirName))
+	if err != nil {
+		return 0
+	}
+	now := time.Now()
+	removed := 0
+	for _, de := range entries {
+		batchID, ok := strings.CutSuffix(de.Name(), ".json")
+		if !ok || !validUploadID(batchID) {
+			continue
+		}
+		batch, err := s.loadBatch(batchID)
+		if err != nil || now.Sub(batch.CreatedAt) <= maxAge {
+			continue
+		}
+		active := false
+		for _, f := range batch.Files {
+			if meta, err := s.loadMeta(f.UploadID); err == nil && !meta.Completed {
+				active = true
+				break
+			}
+		}
+		if !active && os.Remove(s.batchPath(batchID)) == nil {
+			removed++
+		}
+	}
+	return removed
+}
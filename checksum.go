@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== 文件校验和 =====
+//
+// POST /api/v1/files/checksum?path=... 重新读取已完成的文件并计算 SHA-256，用于巡检位腐烂，
+// 或为校验和功能上线前上传的文件补算摘要。结果与已记录的摘要比对：优先使用完成上传时记录的摘要
+// （文件之后未被替换），其次使用旁路文件 <路径>.sha256（sha256sum 格式）。
+// update=true 时把结果写入旁路文件。计算按明文进行（加密文件解密、压缩存储的文件解压），
+// 与 complete 时的摘要一致；客户端断开时停止读取。
+
+const checksumSuffix = ".sha256"
+
+// POST /api/v1/files/checksum?path=subdir/a.bin[&update=true]
+func (s *Server) handleFileChecksum(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	update := false
+	if v := q.Get("update"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_update", "invalid update")
+			return
+		}
+		update = b
+	}
+	if update && (!s.localOnly(w) || !s.writable(w)) {
+		return
+	}
+	abs, err := s.resolveFilePath(strings.TrimSpace(q.Get("path")))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_path", "invalid path")
+		return
+	}
+	rel, _ := filepath.Rel(s.rootAbs, abs)
+	obj, err := s.store.Open(r.Context(), rel)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	defer obj.Close()
+
+	sum, n, err := hashObject(r.Context(), obj)
+	if err != nil {
+		if r.Context().Err() != nil {
+			reqLogger(r).Info("checksum canceled", "path", rel, "duration_ms", time.Since(start).Milliseconds())
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		reqLogger(r).Error("checksum failed", "path", rel, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "read failed")
+		return
+	}
+	if n != obj.Size {
+		reqLogger(r).Warn("checksum size mismatch", "path", rel, "size", obj.Size, "read", n)
+	}
+
+	resp := map[string]any{"path": filepath.ToSlash(rel), "size": n, "sha256": sum}
+	expected, source := s.storedChecksum(rel, abs, obj)
+	if expected != "" {
+		resp["expected"], resp["source"], resp["match"] = expected, source, expected == sum
+		if expected != sum {
+			reqLogger(r).Warn("checksum mismatch", "path", rel, "expected", expected, "got", sum, "source", source)
+		}
+	}
+	if update {
+		if err := s.writeChecksumFile(abs, sum); err != nil {
+			reqLogger(r).Error("write checksum file failed", "path", rel, "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "write checksum failed")
+			return
+		}
+		s.invalidateQuota(rel)
+		resp["updated"] = true
+	}
+	reqLogger(r).Info("checksum computed", "path", rel, "size", n, "updated", update,
+		"duration_ms", time.Since(start).Milliseconds())
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// hashObject 计算 obj 明文的 SHA-256（hex）与字节数，ctx 取消时中止。与 complete 时对 .part 的摘要
+// 走同一个 sumSHA256，加密文件由 store.Open 解密、压缩存储的文件解压后计算，结果可以直接比较。
+func hashObject(ctx context.Context, obj *storedObject) (string, int64, error) {
+	src, err := obj.plaintext()
+	if err != nil {
+		return "", 0, err
+	}
+	return sumSHA256(sha256.New(), &ctxReader{ctx: ctx, r: src})
+}
+
+// ctxReader 在每次读取前检查 ctx，让长时间的读取能随请求取消。
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// storedChecksum 返回 rel 已记录的摘要及其来源（upload | sidecar），都没有时返回空串。
+func (s *Server) storedChecksum(rel, abs string, obj *storedObject) (string, string) {
+	if e, ok := s.lookupFile(rel, obj.Size, obj.ModTime); ok {
+		if sum := strings.Trim(e.etag, `"`); isHexSHA256(sum) {
+			return sum, "upload"
+		}
+	}
+	b, err := os.ReadFile(abs + checksumSuffix)
+	if err != nil {
+		return "", ""
+	}
+	if fields := strings.Fields(string(b)); len(fields) > 0 && isHexSHA256(strings.ToLower(fields[0])) {
+		return strings.ToLower(fields[0]), "sidecar"
+	}
+	return "", ""
+}
+
+// writeChecksumFile 以 sha256sum 的格式写入旁路文件（先写临时文件再 rename），可直接用 sha256sum -c 校验。
+func (s *Server) writeChecksumFile(abs, sum string) error {
+	dst := abs + checksumSuffix
+	tmp, err := os.CreateTemp(filepath.Dir(abs), ".checksum-*")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(tmp, "%s  %s\n", sum, filepath.Base(abs))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), s.fileMode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fileChecksum 调用校验和接口，query 为附加的查询参数（如 "&update=true"）。
+func fileChecksum(s *Server, ctx context.Context, rel, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/files/checksum?path="+rel+query, nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	s.handleFileChecksum(w, r)
+	return w
+}
+
+func TestFileChecksum(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	raw := sha256.Sum256(data)
+	want := hex.EncodeToString(raw[:])
+
+	upload := func(t *testing.T, s *Server, rel string) string {
+		t.Helper()
+		id := newTestUpload(t, s, rel, 16, 16).UploadID
+		if w := putChunk(s, id, 0, data); w.Code != http.StatusOK {
+			t.Fatalf("chunk: %d %s", w.Code, w.Body)
+		}
+		if w := completeUpload(s, id, ""); w.Code != http.StatusOK {
+			t.Fatalf("complete: %d %s", w.Code, w.Body)
+		}
+		return filepath.Join(s.rootAbs, filepath.FromSlash(rel))
+	}
+	result := func(t *testing.T, w *httptest.ResponseRecorder) map[string]any {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("checksum: %d %s", w.Code, w.Body)
+		}
+		var resp map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp["sha256"] != want {
+			t.Fatalf("sha256 = %v, want %s", resp["sha256"], want)
+		}
+		return resp
+	}
+
+	t.Run("match", func(t *testing.T) {
+		s := newTestServer(t)
+		upload(t, s, "c/a.bin")
+		resp := result(t, fileChecksum(s, context.Background(), "c/a.bin", ""))
+		if resp["match"] != true || resp["source"] != "upload" || resp["expected"] != want {
+			t.Fatalf("resp = %v", resp)
+		}
+	})
+
+	t.Run("compressed matches complete-time digest", func(t *testing.T) {
+		s := newTestServer(t, func(cfg *Config) { cfg.Storage.CompressExtensions = []string{".txt"} })
+		upload(t, s, "c/a.txt")
+		resp := result(t, fileChecksum(s, context.Background(), "c/a.txt", ""))
+		if resp["match"] != true || resp["size"] != float64(len(data)) {
+			t.Fatalf("resp = %v", resp)
+		}
+	})
+
+	t.Run("sidecar mismatch", func(t *testing.T) {
+		s := newTestServer(t)
+		abs := filepath.Join(s.rootAbs, "c", "b.bin")
+		if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(abs, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		bad := hex.EncodeToString(make([]byte, 32))
+		if err := os.WriteFile(abs+checksumSuffix, []byte(bad+"  b.bin\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		resp := result(t, fileChecksum(s, context.Background(), "c/b.bin", ""))
+		if resp["match"] != false || resp["source"] != "sidecar" || resp["expected"] != bad {
+			t.Fatalf("resp = %v", resp)
+		}
+	})
+
+	t.Run("update writes sidecar", func(t *testing.T) {
+		s := newTestServer(t)
+		abs := upload(t, s, "c/u.bin")
+		resp := result(t, fileChecksum(s, context.Background(), "c/u.bin", "&update=true"))
+		if resp["updated"] != true {
+			t.Fatalf("resp = %v", resp)
+		}
+		got, err := os.ReadFile(abs + checksumSuffix)
+		if err != nil || string(got) != want+"  u.bin\n" {
+			t.Fatalf("sidecar %q, err %v", got, err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		s := newTestServer(t)
+		abs := upload(t, s, "c/x.bin")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		w := fileChecksum(s, ctx, "c/x.bin", "&update=true")
+		if w.Code != statusClientClosedRequest {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		if _, err := os.Stat(abs + checksumSuffix); !os.IsNotExist(err) {
+			t.Fatalf("sidecar written after cancel: %v", err)
+		}
+	})
+}
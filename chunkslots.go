@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ===== 分片写盘并发上限 =====
+//
+// 配置 limits.max_concurrent_chunks 后，全局同时写盘的分片（含 tus PATCH）不超过该数量，
+// 其余分片排队等待，避免大量并发上传时磁盘随机 IO 互相争抢、延迟抖动。
+// 与上传锁无关：上传锁只串行化同一上传的元数据，这里限制的是所有上传合计的写盘数。
+// 名额在取上传锁之前获取，排队中的请求不持有任何上传锁，不会挡住同一上传的状态查询、complete 与 cancel。
+// 排队超过 limits.chunk_queue_timeout（默认 30s）返回 503（server_busy，带 Retry-After），客户端稍后重试即可。
+// 写盘与读取请求体同时进行，占用的时长包括接收该分片数据的时间。
+// 上限可通过 SIGHUP 调整，进行中的写入仍归还到调整前的计数。
+
+const defaultChunkQueueTimeout = 30 * time.Second
+
+// chunkSlotRetryAfter 是排队超时后建议客户端等待的秒数。
+const chunkSlotRetryAfter = 1
+
+// chunkSlots 为写盘名额，容量即并发上限。
+type chunkSlots chan struct{}
+
+func newChunkSlots(n int) *chunkSlots {
+	if n <= 0 {
+		return nil
+	}
+	slots := make(chunkSlots, n)
+	return &slots
+}
+
+// acquireChunkSlot 获取一个写盘名额，返回的 release 可重复调用。未配置上限时立即返回。
+// 客户端断开时返回 ctx 的错误，排队超时返回 503。
+func (s *Server) acquireChunkSlot(ctx context.Context) (func(), error) {
+	slots := s.chunkSlots.Load()
+	if slots == nil {
+		return func() {}, nil
+	}
+	ch := *slots
+	select {
+	case ch <- struct{}{}:
+	default:
+		timer := time.NewTimer(s.config().Limits.ChunkQueueTimeout)
+		defer timer.Stop()
+		select {
+		case ch <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, &httpError{
+				status: http.StatusServiceUnavailable,
+				code:   "server_busy",
+				msg:    "too many concurrent chunk writes",
+				header: map[string]string{"Retry-After": strconv.Itoa(chunkSlotRetryAfter)},
+				body:   map[string]any{"retry_after": chunkSlotRetryAfter},
+			}
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-ch }) }, nil
+}
+
+// resizeChunkSlots 在配置热更新后按新的上限替换名额。
+func (s *Server) resizeChunkSlots(n int) {
+	s.chunkSlots.Store(newChunkSlots(n))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 排队等待写盘名额的分片不应占着上传锁：complete 与 tus HEAD 在排队期间照常返回。
+func TestChunkQueueDoesNotHoldUploadLock(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Limits.MaxConcurrentChunks = 1
+		cfg.Limits.ChunkQueueTimeout = 5 * time.Second
+	})
+	meta := newTestUpload(t, s, "q/a.bin", 8, 8)
+	hold, err := s.acquireChunkSlot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := make(chan int, 2)
+	go func() { queued <- putChunk(s, meta.UploadID, 0, []byte("abcd")).Code }()
+	go func() {
+		r := httptest.NewRequest(http.MethodPatch, tusBasePath+meta.UploadID, bytes.NewReader([]byte("abcd")))
+		r.Header.Set("Content-Type", "application/offset+octet-stream")
+		r.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		s.tusPatch(w, r, meta.UploadID)
+		queued <- w.Code
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if w := completeUpload(s, meta.UploadID, ""); w.Code != http.StatusConflict {
+			t.Errorf("complete while chunk queued: status %d, want 409", w.Code)
+		}
+		w := httptest.NewRecorder()
+		s.tusHead(w, httptest.NewRequest(http.MethodHead, tusBasePath+meta.UploadID, nil), meta.UploadID)
+		if w.Code != http.StatusOK {
+			t.Errorf("tus HEAD while chunk queued: status %d", w.Code)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("complete/HEAD blocked by a chunk waiting for a write slot")
+	}
+
+	hold()
+	for i := 0; i < 2; i++ {
+		select {
+		case code := <-queued:
+			if code != http.StatusOK && code != http.StatusNoContent && code != http.StatusConflict {
+				t.Errorf("queued write: status %d", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("queued write did not finish")
+		}
+	}
+}
+
+// BenchmarkConcurrentChunks 以 64 个上传并发写 256KB 分片，比较不限制与 max_concurrent_chunks=4 时
+// 单个分片请求的延迟分布（p50/p99，毫秒）。限制后排队时间计入延迟，但写盘不再互相争抢，尾部延迟更稳定。
+func BenchmarkConcurrentChunks(b *testing.B) {
+	for _, limit := range []int{0, 4} {
+		b.Run(fmt.Sprintf("max_concurrent_chunks=%d", limit), func(b *testing.B) {
+			benchmarkConcurrentChunks(b, limit)
+		})
+	}
+}
+
+func benchmarkConcurrentChunks(b *testing.B, limit int) {
+	const (
+		uploads   = 64
+		chunkSize = 256 << 10
+	)
+	s := newTestServer(b, func(cfg *Config) {
+		cfg.Limits.MaxConcurrentChunks = limit
+		cfg.Limits.ChunkQueueTimeout = time.Minute
+	})
+	perUpload := (b.N + uploads - 1) / uploads
+	ids := make([]string, uploads)
+	for i := range ids {
+		ids[i] = newTestUpload(b, s, fmt.Sprintf("bench/%d.bin", i), int64(perUpload)*chunkSize, chunkSize).UploadID
+	}
+	data := make([]byte, chunkSize)
+
+	var mu sync.Mutex
+	latencies := make([]time.Duration, 0, b.N)
+	var wg sync.WaitGroup
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	for i, id := range ids {
+		n := perUpload
+		if rest := b.N - i*perUpload; rest < n {
+			n = max(rest, 0)
+		}
+		wg.Add(1)
+		go func(id string, n int) {
+			defer wg.Done()
+			local := make([]time.Duration, 0, n)
+			for j := 0; j < n; j++ {
+				start := time.Now()
+				w := putChunk(s, id, int64(j)*chunkSize, data)
+				local = append(local, time.Since(start))
+				if w.Code != http.StatusOK {
+					b.Errorf("chunk %d: status %d: %s", j, w.Code, w.Body)
+					return
+				}
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			mu.Unlock()
+		}(id, n)
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	if len(latencies) == 0 {
+		return
+	}
+	slices.Sort(latencies)
+	pct := func(p float64) float64 {
+		return float64(latencies[int(p*float64(len(latencies)-1))].Microseconds()) / 1000
+	}
+	b.ReportMetric(pct(0.50), "p50-ms")
+	b.ReportMetric(pct(0.99), "p99-ms")
+}
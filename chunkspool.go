@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// ===== 无 Content-Length 的分片 =====
+//
+// 使用 Transfer-Encoding: chunked 的 HTTP/1.1 客户端，以及未声明长度的 HTTP/2 请求不带 Content-Length。
+// 这类分片先完整读入状态目录 spool/ 下的临时文件，最多读 limits.max_chunk_bytes，超出返回 413；
+// 读完后以实际字节数作为请求体长度，之后与普通分片走同一流程，越界（416）、Content-Range、对齐与校验和等检查照常生效。
+// 读完之前不写 .part，客户端中途断开时不记录部分进度。落盘加密的上传以仅存在于内存中的一次性密钥（AES-CTR）
+// 加密临时文件，明文不落盘；之后照常经加密写入 .part。
+// 携带 Content-Length 的分片不经过这里，仍严格按声明的长度读取。
+
+const spoolDirName = "spool"
+
+// spooledChunk 是暂存到临时文件的请求体，Read 从头读出明文。
+type spooledChunk struct {
+	f *os.File
+	r io.Reader
+}
+
+func (c *spooledChunk) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *spooledChunk) remove() {
+	c.f.Close()
+	_ = os.Remove(c.f.Name())
+}
+
+// spoolChunkBody 把请求体读入临时文件，返回暂存的请求体与字节数；调用方用完后以 remove 删除。
+// encrypt 为 true 时临时文件以一次性密钥加密。读取同样受 chunk_read_timeout 与限速约束，
+// 开始读取前按 max_chunk_bytes 检查剩余空间。读请求体失败时原样返回读取错误，由调用方区分超时与断开；
+// 其余错误为 *httpError。
+func (s *Server) spoolChunkBody(w http.ResponseWriter, r *http.Request, uploadID string, encrypt bool) (*spooledChunk, int64, error) {
+	limit := s.config().Limits.MaxChunkBytes
+	if err := s.checkFreeSpace(limit); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.CreateTemp(filepath.Join(s.stateAbs, spoolDirName), uploadID+"-*")
+	if err != nil {
+		log.Printf("create spool for %s failed: %v", uploadID, err)
+		return nil, 0, errStatus(http.StatusInternalServerError, "internal_error", "spool failed")
+	}
+	c := &spooledChunk{f: f, r: f}
+	var dst io.Writer = f
+	var newStream func() cipher.Stream
+	if encrypt {
+		if newStream, err = newSpoolCipher(); err != nil {
+			c.remove()
+			log.Printf("create spool key for %s failed: %v", uploadID, err)
+			return nil, 0, errStatus(http.StatusInternalServerError, "internal_error", "spool failed")
+		}
+		dst = cipher.StreamWriter{S: newStream(), W: f}
+	}
+	// 多读一个字节来区分“正好读到上限”与超出上限
+	src := &readErrRecorder{r: s.throttle(uploadID, io.LimitReader(s.chunkBody(w, r), limit+1))}
+	n, err := io.Copy(dst, src)
+	switch {
+	case src.err != nil:
+		err = src.err
+	case err != nil:
+		log.Printf("write spool for %s failed: %v", uploadID, err)
+		err = errStatus(http.StatusInternalServerError, "internal_error", "spool failed")
+	case n > limit:
+		err = errStatus(http.StatusRequestEntityTooLarge, "chunk_too_large", "chunk too large")
+	default:
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			err = errStatus(http.StatusInternalServerError, "internal_error", "spool failed")
+		}
+	}
+	if err != nil {
+		c.remove()
+		return nil, 0, err
+	}
+	if newStream != nil {
+		c.r = cipher.StreamReader{S: newStream(), R: f}
+	}
+	return c, n, nil
+}
+
+// newSpoolCipher 生成随机的 AES-256 密钥与 IV，返回创建 CTR 流的函数（写入与读回各用一个）。
+// 密钥只在本次请求的内存中，临时文件遗留下来也无法解密。
+func newSpoolCipher() (func() cipher.Stream, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return func() cipher.Stream { return cipher.NewCTR(block, iv) }, nil
+}
+
+// resetSpoolDir 清空上次运行遗留的临时文件（进程退出时仍在读取的分片）。
+func (s *Server) resetSpoolDir() error {
+	dir := filepath.Join(s.stateAbs, spoolDirName)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0o755)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// putChunkedBody 以 Transfer-Encoding: chunked（无 Content-Length）上传分片，contentRange 非空时附带 Content-Range。
+func putChunkedBody(s *Server, uploadID string, offset int64, data []byte, contentRange string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, "/api/v1/uploads/chunk?upload_id="+uploadID, bytes.NewReader(data))
+	r.ContentLength = -1
+	r.TransferEncoding = []string{"chunked"}
+	if contentRange != "" {
+		r.Header.Set("Content-Range", contentRange)
+	} else {
+		r.Header.Set("X-Chunk-Offset", strconv.FormatInt(offset, 10))
+	}
+	w := httptest.NewRecorder()
+	s.handleChunk(w, r)
+	return w
+}
+
+// 不带 Content-Length 的分片以实际读到的字节数作为长度，越界、超长与空请求体分别返回 416/413/400，
+// 处理完后暂存的临时文件都被删除。
+func TestChunkedTransferEncoding(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Limits.MaxChunkBytes = 8 })
+	meta := newTestUpload(t, s, "te/a.bin", 12, 8)
+
+	cases := []struct {
+		name         string
+		offset       int64
+		data         string
+		contentRange string
+		status       int
+		code         string
+	}{
+		{name: "first chunk", offset: 0, data: "abcdefgh", status: http.StatusOK},
+		{name: "tail shorter than chunk", offset: 8, data: "ijk", status: http.StatusOK},
+		{name: "past end", offset: 10, data: "xyz", status: http.StatusRequestedRangeNotSatisfiable, code: "chunk_out_of_range"},
+		{name: "over max_chunk_bytes", offset: 0, data: "123456789", status: http.StatusRequestEntityTooLarge, code: "chunk_too_large"},
+		{name: "empty", offset: 0, data: "", status: http.StatusBadRequest, code: "empty_chunk"},
+		{name: "content-range length mismatch", data: "ab", contentRange: "bytes 0-3/12", status: http.StatusBadRequest, code: "content_range_mismatch"},
+		{name: "content-range", data: "l", contentRange: "bytes 11-11/12", status: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := putChunkedBody(s, meta.UploadID, tc.offset, []byte(tc.data), tc.contentRange)
+			if w.Code != tc.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.code != "" && errorCode(t, w) != tc.code {
+				t.Fatalf("code %q, want %q", errorCode(t, w), tc.code)
+			}
+			spooled, err := os.ReadDir(filepath.Join(s.stateAbs, spoolDirName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(spooled) != 0 {
+				t.Fatalf("%d spool files left", len(spooled))
+			}
+		})
+	}
+
+	got, err := os.ReadFile(s.partPath(meta.UploadID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "abcdefghijkl" {
+		t.Fatalf(".part = %q", got)
+	}
+	if w := completeUpload(s, meta.UploadID, ""); w.Code != http.StatusOK {
+		t.Fatalf("complete: %d %s", w.Code, w.Body)
+	}
+}
+
+// 携带 Content-Length 时仍严格按声明的长度读取，请求体不足视为读取失败，不记录进度。
+func TestChunkContentLengthStrict(t *testing.T) {
+	s := newTestServer(t)
+	meta := newTestUpload(t, s, "te/b.bin", 8, 8)
+	r := httptest.NewRequest(http.MethodPut, "/api/v1/uploads/chunk?upload_id="+meta.UploadID, strings.NewReader("abc"))
+	r.ContentLength = 8
+	r.Header.Set("X-Chunk-Offset", "0")
+	w := httptest.NewRecorder()
+	s.handleChunk(w, r)
+	if w.Code == http.StatusOK {
+		t.Fatalf("short body accepted: %s", w.Body)
+	}
+	m, err := s.loadMeta(meta.UploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.ReceivedRanges) != 0 {
+		t.Fatalf("received_ranges %v after short body", m.ReceivedRanges)
+	}
+}
+
+// 落盘加密的上传也可以省略 Content-Length：暂存的临时文件是密文，写入 .part 后照常完成并解密下载。
+func TestChunkedTransferEncodingEncrypted(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Encryption.Key = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	})
+	meta := newTestUpload(t, s, "te/enc.bin", 12, encBlockSize)
+	if !meta.Encrypted {
+		t.Fatal("upload not encrypted")
+	}
+	// 读取请求体时检查临时文件里没有明文
+	data := []byte("secretsecret")
+	body := &hookReader{r: bytes.NewReader(data), eof: func() {
+		spooled, _ := os.ReadDir(filepath.Join(s.stateAbs, spoolDirName))
+		for _, de := range spooled {
+			if b, _ := os.ReadFile(filepath.Join(s.stateAbs, spoolDirName, de.Name())); bytes.Contains(b, []byte("secret")) {
+				t.Errorf("plaintext in spool file %s", de.Name())
+			}
+		}
+	}}
+	r := httptest.NewRequest(http.MethodPut, "/api/v1/uploads/chunk?upload_id="+meta.UploadID, body)
+	r.ContentLength = -1
+	r.Header.Set("X-Chunk-Offset", "0")
+	w := httptest.NewRecorder()
+	s.handleChunk(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("chunk: %d %s", w.Code, w.Body)
+	}
+	if w := completeUpload(s, meta.UploadID, ""); w.Code != http.StatusOK {
+		t.Fatalf("complete: %d %s", w.Code, w.Body)
+	}
+	if got := download(s, "te/enc.bin"); got.Code != http.StatusOK || got.Body.String() != string(data) {
+		t.Fatalf("download: %d %q", got.Code, got.Body)
+	}
+}
+
+// 剩余空间不足以暂存一个 max_chunk_bytes 的分片时返回 507，不读取请求体。
+func TestChunkedTransferEncodingInsufficientStorage(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Limits.MaxChunkBytes = 1 << 20 })
+	meta := newTestUpload(t, s, "te/full.bin", 8, 8)
+	fakeDiskStat(t, diskUsage{Total: 1 << 30, Available: 1 << 10})
+	w := putChunkedBody(s, meta.UploadID, 0, []byte("abcdefgh"), "")
+	if w.Code != http.StatusInsufficientStorage || errorCode(t, w) != "insufficient_storage" {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+}
+
+// hookReader 在读到 EOF 时调用 eof 一次。
+type hookReader struct {
+	r   io.Reader
+	eof func()
+}
+
+func (h *hookReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	if err == io.EOF && h.eof != nil {
+		h.eof()
+		h.eof = nil
+	}
+	return n, err
+}
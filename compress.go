@@ -0,0 +1,186 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== 落盘压缩 =====
+//
+// 完成的文件扩展名在 storage.compress_extensions 中时，以 gzip 压缩后存为 <路径>.gz，元数据记 compressed: true。
+// 对外仍使用原路径：下载、删除、移动、If-Match 等接口按原路径访问时自动找到压缩存储的文件；
+// 下载时客户端接受 gzip 则原样发送压缩数据（Content-Encoding: gzip），否则边解压边发送。
+// gzip 头的 Extra 字段记录原始大小，据此识别由本服务压缩的文件，用户自己上传的 .gz 不受影响。
+// 目录树、列表与统计按磁盘上的实际文件（.gz 及其压缩后的大小）计算。加密存储时不可用。
+
+const compressedSuffix = ".gz"
+
+// gzipSizeID 是 gzip Extra 字段中记录原始大小的子字段标识（RFC 1952 2.3.1.1）。
+var gzipSizeID = [2]byte{'G', 'U'}
+
+// shouldCompress 判断完成的文件是否需要压缩存储。
+func (s *Server) shouldCompress(meta UploadMeta) bool {
+	exts := s.config().Storage.CompressExtensions
+	return len(exts) > 0 && !meta.Encrypted && hasExtension(filepath.Base(meta.RelPath), exts)
+}
+
+// compressTo 把 src 以 gzip 压缩写入 w，name 记入 gzip 头。size 为 src 应有的大小，实际读到的字节数不符时放弃。
+func (s *Server) compressTo(w io.Writer, src, name string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	zw := gzip.NewWriter(w)
+	zw.Name = name
+	zw.ModTime = time.Now()
+	zw.Extra = gzipSizeExtra(size)
+	bufp := s.bufPool.Get().(*[]byte)
+	n, err := io.CopyBuffer(zw, in, *bufp)
+	s.bufPool.Put(bufp)
+	if err == nil && n != size {
+		err = fmt.Errorf("read %d bytes from %s, want %d", n, src, size)
+	}
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func gzipSizeExtra(size int64) []byte {
+	b := make([]byte, 4+8)
+	copy(b, gzipSizeID[:])
+	binary.LittleEndian.PutUint16(b[2:], 8)
+	binary.BigEndian.PutUint64(b[4:], uint64(size))
+	return b
+}
+
+// compressedSize 读取由 compressFile 写入的原始大小，不是本服务压缩的文件返回 false。
+func compressedSize(r io.Reader) (int64, bool) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, false
+	}
+	extra := zr.Extra
+	for len(extra) >= 4 {
+		n := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+n {
+			break
+		}
+		if extra[0] == gzipSizeID[0] && extra[1] == gzipSizeID[1] && n == 8 {
+			return int64(binary.BigEndian.Uint64(extra[4:])), true
+		}
+		extra = extra[4+n:]
+	}
+	return 0, false
+}
+
+// isCompressedFile 判断 path 是否为本服务压缩存储的文件。
+func isCompressedFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, ok := compressedSize(f)
+	return ok
+}
+
+// storedPath 返回 abs 在磁盘上的实际位置：abs 本身不存在、但有压缩存储的版本时返回 abs+".gz" 与 true。
+func storedPath(abs string) (string, bool) {
+	if _, err := os.Lstat(abs); !errors.Is(err, os.ErrNotExist) {
+		return abs, false
+	}
+	if gz := abs + compressedSuffix; isCompressedFile(gz) {
+		return gz, true
+	}
+	return abs, false
+}
+
+// storedExists 判断 abs 上是否已有文件（含压缩存储的版本），用于 overwrite 策略。
+func storedExists(abs string) (bool, error) {
+	exists, err := pathExists(abs)
+	if err != nil || exists {
+		return exists, err
+	}
+	return isCompressedFile(abs + compressedSuffix), nil
+}
+
+// removeOtherVariant 在覆盖写入后删除同一路径的另一种存储形式（压缩与未压缩），避免两者并存。
+// 调用方需持有 finalizeMu。
+func removeOtherVariant(abs string, compressed bool) {
+	other := abs + compressedSuffix
+	if compressed {
+		other = abs
+	} else if !isCompressedFile(other) {
+		return
+	}
+	if err := os.Remove(other); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("remove stale %s failed: %v", other, err)
+	}
+}
+
+// acceptsGzip 判断客户端的 Accept-Encoding 是否接受 gzip。
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serveCompressed 输出压缩存储的文件。客户端接受 gzip 时原样发送压缩数据，Range 按压缩后的字节计算；
+// 否则边解压边发送，不支持 Range（总是返回完整内容）。
+func serveCompressed(w http.ResponseWriter, r *http.Request, obj *storedObject, etag string) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	if acceptsGzip(r) {
+		// 压缩与解压后是不同的表示，ETag 需要区分
+		w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+`-gzip"`)
+		w.Header().Set("Content-Encoding", "gzip")
+		http.ServeContent(w, r, obj.Name, obj.ModTime, obj)
+		return
+	}
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	zr, err := obj.plaintext()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "decompress failed")
+		return
+	}
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Last-Modified", obj.ModTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, zr); err != nil {
+		log.Printf("decompress %s failed: %v", obj.Name, err)
+	}
+}
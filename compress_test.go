@@ -0,0 +1,76 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 压缩存储：完成后只留下 <路径>.gz，内容与上传一致，.part 与暂存的临时文件都被删除。
+func TestCompleteCompressed(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	s := newTestServerAt(t, root, func(cfg *Config) { cfg.Storage.CompressExtensions = []string{".txt"} })
+	data := strings.Repeat("hello gzip ", 100)
+	meta := newTestUpload(t, s, "gz/a.txt", int64(len(data)), int64(len(data)))
+	if w := putChunk(s, meta.UploadID, 0, []byte(data)); w.Code != http.StatusOK {
+		t.Fatalf("chunk: %d %s", w.Code, w.Body)
+	}
+	if w := completeUpload(s, meta.UploadID, ""); w.Code != http.StatusOK {
+		t.Fatalf("complete: %d %s", w.Code, w.Body)
+	}
+
+	f, err := os.Open(filepath.Join(root, "gz", "a.txt"+compressedSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil || string(got) != data {
+		t.Fatalf("decompressed %d bytes, err %v", len(got), err)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("leftover files: %v", entries)
+	}
+	if _, err := os.Stat(s.partPath(meta.UploadID)); !os.IsNotExist(err) {
+		t.Fatalf(".part still exists: %v", err)
+	}
+}
+
+// 暂存文件的写入（压缩、跨文件系统复制）不持有 finalizeMu，其它上传的落盘、删除与 GC 照常进行。
+func TestStageFileDoesNotHoldFinalizeMu(t *testing.T) {
+	s := newTestServer(t)
+	filling := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.stageFile(filepath.Join(s.rootAbs, "st", "a.bin"), ".moving", func(f *os.File) error {
+			close(filling)
+			<-release
+			_, err := f.WriteString("data")
+			return err
+		})
+		done <- err
+	}()
+	<-filling
+	if !s.finalizeMu.TryLock() {
+		close(release)
+		t.Fatal("finalizeMu held while filling the staged file")
+	}
+	s.finalizeMu.Unlock()
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
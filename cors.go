@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ===== 跨域（CORS） =====
+//
+// server.cors.allow_origins 为允许的来源列表：请求的 Origin 命中时回显该来源并允许携带凭据，
+// 未命中时不输出任何 CORS 头，由浏览器拦截。列表包含 "*" 时对所有来源返回通配符（不允许凭据）。
+// 预检响应只声明请求路径上实际注册的方法，并回显白名单内的 Access-Control-Request-Headers。
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "PATCH", "HEAD", "DELETE", "OPTIONS"}
+	defaultCORSHeaders = []string{
+		"Authorization", "Content-Type", "Content-Encoding", "Content-Range", "Range",
+		"If-Match", "If-None-Match", "If-Modified-Since",
+		"X-Chunk-Offset", "X-Chunk-Checksum", "X-Chunk-Raw-Length", "X-Request-Id",
+		"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Defer-Length",
+	}
+)
+
+const corsExposeHeaders = "ETag,Location,Content-Disposition,Upload-Offset,X-Uploaded-Size,Upload-Length,Upload-Expires,Tus-Resumable,Tus-Version,Tus-Extension,Tus-Max-Size,X-Request-Id"
+
+type CORSConfig struct {
+	AllowOrigins []string `yaml:"allow_origins"` // 允许的来源，如 https://app.example.com；"*" 表示任意来源（默认）
+	AllowMethods []string `yaml:"allow_methods"` // 允许跨域使用的方法，预检时与路由实际支持的方法取交集
+	AllowHeaders []string `yaml:"allow_headers"` // 允许的请求头白名单，预检时回显请求中位于白名单内的头
+}
+
+// normalize 填充默认值并规范化来源：去掉末尾的 "/"，统一小写比较。
+func (c *CORSConfig) normalize() error {
+	if c.AllowOrigins == nil {
+		c.AllowOrigins = []string{"*"}
+	}
+	origins := make([]string, 0, len(c.AllowOrigins))
+	for _, o := range c.AllowOrigins {
+		o = strings.ToLower(strings.TrimRight(strings.TrimSpace(o), "/"))
+		if o == "" {
+			continue
+		}
+		if o != "*" && !strings.Contains(o, "://") {
+			return fmt.Errorf("invalid server.cors.allow_origins entry %q: must be scheme://host[:port] or *", o)
+		}
+		origins = append(origins, o)
+	}
+	c.AllowOrigins = origins
+	if len(c.AllowMethods) == 0 {
+		c.AllowMethods = defaultCORSMethods
+	}
+	for i, m := range c.AllowMethods {
+		c.AllowMethods[i] = strings.ToUpper(strings.TrimSpace(m))
+	}
+	if len(c.AllowHeaders) == 0 {
+		c.AllowHeaders = defaultCORSHeaders
+	}
+	return nil
+}
+
+// allowOrigin 返回应写入 Access-Control-Allow-Origin 的值；为空表示不允许该来源。
+func (c CORSConfig) allowOrigin(origin string) (value string, credentials bool) {
+	want := strings.ToLower(origin)
+	wildcard := false
+	for _, o := range c.AllowOrigins {
+		if o == "*" {
+			wildcard = true
+			continue
+		}
+		if origin != "" && o == want {
+			return origin, true
+		}
+	}
+	if wildcard {
+		return "*", false
+	}
+	return "", false
+}
+
+// routeTable 包装 ServeMux，并记录每个路由模式接受的方法，
+// 预检响应据此只声明请求路径上实际可用的方法。
+type routeTable struct {
+	mux     *http.ServeMux
+	methods map[string][]string
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{mux: http.NewServeMux(), methods: map[string][]string{}}
+}
+
+func (t *routeTable) handle(pattern string, h http.Handler, methods ...string) {
+	t.mux.Handle(pattern, h)
+	t.methods[pattern] = methods
+}
+
+func (t *routeTable) handleFunc(pattern string, h http.HandlerFunc, methods ...string) {
+	t.handle(pattern, h, methods...)
+}
+
+// methodsFor 返回请求路径所匹配路由接受的方法；未匹配任何路由时返回 nil。
+func (t *routeTable) methodsFor(r *http.Request) []string {
+	_, pattern := t.mux.Handler(r)
+	return t.methods[pattern]
+}
+
+// preflightMethods 取路由方法与 allow_methods 的交集，并总是包含 OPTIONS。
+func (c CORSConfig) preflightMethods(route []string) string {
+	out := []string{}
+	for _, m := range route {
+		for _, a := range c.AllowMethods {
+			if m == a && m != http.MethodOptions {
+				out = append(out, m)
+				break
+			}
+		}
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return strings.Join(append(out, http.MethodOptions), ",")
+}
+
+// preflightHeaders 回显 Access-Control-Request-Headers 中位于 allow_headers 的部分，
+// 不在白名单中的请求头被剔除，浏览器会因此拒绝实际请求。
+func (c CORSConfig) preflightHeaders(requested string) string {
+	var out []string
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		for _, a := range c.AllowHeaders {
+			if strings.EqualFold(h, a) {
+				out = append(out, h)
+				break
+			}
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+func withCORS(cfg CORSConfig, routes *routeTable, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed, credentials := cfg.allowOrigin(origin)
+		h := w.Header()
+		// 响应随 Origin 变化（包括不输出 CORS 头的情况），提示缓存按 Origin 区分
+		if allowed != "*" {
+			h.Add("Vary", "Origin")
+		}
+		reqMethod := r.Header.Get("Access-Control-Request-Method")
+		preflight := r.Method == http.MethodOptions && reqMethod != ""
+		if allowed != "" {
+			h.Set("Access-Control-Allow-Origin", allowed)
+			if credentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			if preflight {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+				if v := cfg.preflightMethods(routes.methodsFor(r)); v != "" {
+					h.Set("Access-Control-Allow-Methods", v)
+				}
+				if v := cfg.preflightHeaders(r.Header.Get("Access-Control-Request-Headers")); v != "" {
+					h.Set("Access-Control-Allow-Headers", v)
+				}
+			}
+		}
+		// tus 客户端的 OPTIONS 探测（非浏览器预检）需要交给 handler 返回能力信息
+		tusProbe := strings.HasPrefix(r.URL.Path, tusBasePath) && !preflight
+		if r.Method == http.MethodOptions && !tusProbe {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
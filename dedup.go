@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ===== 内容寻址去重 =====
+//
+// storage.dedup 开启后，完成的文件先按 SHA-256 存入状态目录下的 blobs/<前两位>/<摘要>，
+// 最终路径再以硬链接（不支持时退化为符号链接）指向它；内容相同的文件只占一份空间。
+// blobs/refs.json 记录每个摘要被哪些路径引用，删除文件时减少引用，归零后删除 blob，
+// 因此删除其中一个路径不会影响其它指向同一内容的文件。文件系统连符号链接都不支持时按普通 rename 落盘。
+// 加密上传的密文各不相同，不参与去重。
+
+const dedupDirName = "blobs"
+
+type dedupStore struct {
+	mu   sync.Mutex
+	dir  string
+	refs map[string][]string // 摘要 -> 引用它的 rel_path（相对 root_dir）
+}
+
+// openDedupStore 加载引用表，并剔除已在存储之外被删掉的路径。
+func (s *Server) openDedupStore() (*dedupStore, error) {
+	d := &dedupStore{dir: filepath.Join(s.stateAbs, dedupDirName), refs: map[string][]string{}}
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(d.indexPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &d.refs); err != nil {
+			return nil, err
+		}
+	}
+	changed := false
+	for sum, rels := range d.refs {
+		kept := rels[:0]
+		for _, rel := range rels {
+			if _, err := os.Lstat(filepath.Join(s.rootAbs, rel)); err == nil {
+				kept = append(kept, rel)
+			}
+		}
+		if len(kept) != len(rels) {
+			changed = true
+			d.setRefs(sum, kept)
+		}
+	}
+	if changed {
+		if err := d.save(*s.config().Storage.DurableMeta); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *dedupStore) indexPath() string {
+	return filepath.Join(d.dir, "refs.json")
+}
+
+func (d *dedupStore) blobPath(sum string) string {
+	return filepath.Join(d.dir, sum[:2], sum)
+}
+
+// setRefs 更新引用列表，列表为空时删除 blob。调用方需持有 d.mu。
+func (d *dedupStore) setRefs(sum string, rels []string) {
+	if len(rels) > 0 {
+		d.refs[sum] = rels
+		return
+	}
+	delete(d.refs, sum)
+	if err := os.Remove(d.blobPath(sum)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("dedup: remove blob %s failed: %v", sum, err)
+	}
+}
+
+// lookup 返回 rel 引用的摘要。调用方需持有 d.mu。
+func (d *dedupStore) lookup(rel string) string {
+	for sum, rels := range d.refs {
+		for _, r := range rels {
+			if r == rel {
+				return sum
+			}
+		}
+	}
+	return ""
+}
+
+// unref 移除 rel 的引用。调用方需持有 d.mu。
+func (d *dedupStore) unref(rel string) bool {
+	sum := d.lookup(rel)
+	if sum == "" {
+		return false
+	}
+	var kept []string
+	for _, r := range d.refs[sum] {
+		if r != rel {
+			kept = append(kept, r)
+		}
+	}
+	d.setRefs(sum, kept)
+	return true
+}
+
+// save 原子写回引用表。调用方需持有 d.mu。
+func (d *dedupStore) save(durable bool) error {
+	for _, rels := range d.refs {
+		sort.Strings(rels)
+	}
+	b, err := json.MarshalIndent(d.refs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := d.indexPath() + ".tmp"
+	if err := writeFileSync(tmp, b, 0o644, durable); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.indexPath()); err != nil {
+		return err
+	}
+	if durable {
+		return syncDir(d.dir)
+	}
+	return nil
+}
+
+// isRef 判断 rel 是否为去重产生的链接。
+func (d *dedupStore) isRef(rel string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lookup(rel) != ""
+}
+
+// releaseDedup 在 rel 被删除后减少引用。
+func (s *Server) releaseDedup(rel string) {
+	if s.dedup == nil {
+		return
+	}
+	d := s.dedup
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.unref(rel) {
+		if err := d.save(*s.config().Storage.DurableMeta); err != nil {
+			log.Printf("dedup: save refs failed: %v", err)
+		}
+	}
+}
+
+// renameDedup 在文件被移动后把引用从 from 转到 to；to 原先的引用（被覆盖的文件）一并释放。
+func (s *Server) renameDedup(from, to string) {
+	if s.dedup == nil {
+		return
+	}
+	d := s.dedup
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := d.unref(to)
+	if sum := d.lookup(from); sum != "" {
+		rels := d.refs[sum]
+		for i, r := range rels {
+			if r == from {
+				rels[i] = to
+			}
+		}
+		changed = true
+	}
+	if changed {
+		if err := d.save(*s.config().Storage.DurableMeta); err != nil {
+			log.Printf("dedup: save refs failed: %v", err)
+		}
+	}
+}
+
+// placeDeduped 代替 moveFile 将 .part 落到 finalAbs：内容已存在时直接链接到已有 blob 并删除 .part，
+// 否则先把 .part 移入 blob 再链接。链接失败时退回普通 rename。调用方需持有 finalizeMu。
+func (s *Server) placeDeduped(partPath, finalAbs, sum string) error {
+	rel, err := filepath.Rel(s.rootAbs, finalAbs)
+	if err != nil {
+		return err
+	}
+	d := s.dedup
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	blob := d.blobPath(sum)
+	exists, err := pathExists(blob)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := os.MkdirAll(filepath.Dir(blob), 0o755); err != nil {
+			return err
+		}
+		if err := s.moveFile(partPath, blob); err != nil {
+			return err
+		}
+	}
+	if err := linkBlob(blob, finalAbs); err != nil {
+		log.Printf("dedup: link %s failed, storing without dedup: %v", rel, err)
+		if exists {
+			err = s.moveFile(partPath, finalAbs)
+		} else {
+			err = s.moveFile(blob, finalAbs)
+		}
+		if err != nil {
+			return err
+		}
+		// 覆盖了此前去重的文件时释放旧引用
+		d.unref(rel)
+	} else {
+		if exists {
+			_ = os.Remove(partPath)
+			log.Printf("dedup: %s reuses stored content %s", rel, sum)
+		}
+		// 同一路径以相同内容重新上传时引用不变
+		if d.lookup(rel) != sum {
+			d.unref(rel)
+			d.refs[sum] = append(d.refs[sum], rel)
+		}
+	}
+	if err := d.save(*s.config().Storage.DurableMeta); err != nil {
+		log.Printf("dedup: save refs failed: %v", err)
+	}
+	return nil
+}
+
+// linkBlob 在 dst 处创建指向 blob 的硬链接，跨设备等无法硬链接时改用符号链接。
+// 先链接到临时名再 rename，覆盖已有文件时不会出现目标缺失的窗口。
+func linkBlob(blob, dst string) error {
+	// 目标已是指向同一 blob 的硬链接时 rename 不会生效，无需处理
+	if bst, err := os.Stat(blob); err == nil {
+		if dstSt, err := os.Lstat(dst); err == nil && os.SameFile(bst, dstSt) {
+			return nil
+		}
+	}
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".linking")
+	_ = os.Remove(tmp)
+	if err := os.Link(blob, tmp); err != nil {
+		if serr := os.Symlink(blob, tmp); serr != nil {
+			return errors.Join(err, serr)
+		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
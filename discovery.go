@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+)
+
+// ===== 能力发现 =====
+//
+// GET /api/v1/config 返回客户端需要遵守的限制与服务端支持的功能，前端据此选择分片大小、决定是否走 tus 等，
+// 不必硬编码。该接口不需要鉴权（客户端要先知道是否需要 key），只包含对外行为相关的配置，不含 key、路径等敏感信息。
+
+const discoveryPath = "/api/v1/config"
+
+// recommendedChunkBytes 是不知道文件大小时建议的分片大小；实际限制在 chunkSizeBounds 的范围内。
+const recommendedChunkBytes = 8 << 20
+
+const (
+	// targetChunkCount 是按文件大小推荐分片大小时的目标分片数：分片太小往返次数多，太大则重传代价高。
+	targetChunkCount = 1000
+	// minRecommendedChunkBytes 是推荐分片大小的下限，推荐值也按它取整。
+	minRecommendedChunkBytes = 1 << 20
+)
+
+type discoveryResp struct {
+	Version      string `json:"version"`
+	AuthRequired bool   `json:"auth_required"`
+	ReadOnly     bool   `json:"read_only"` // 只读模式下所有写入接口返回 503
+	Backend      string `json:"backend"`
+
+	MaxChunkBytes         int64 `json:"max_chunk_bytes"`
+	MaxFileBytes          int64 `json:"max_file_bytes"` // 0 表示不限
+	MaxJSONBytes          int64 `json:"max_json_bytes"`
+	RecommendedChunkBytes int64 `json:"recommended_chunk_bytes"`
+	MinChunkBytes         int64 `json:"min_chunk_bytes,omitempty"` // 多于一片时 chunk_size 的下限（S3 后端）
+	ChunkAlignment        int64 `json:"chunk_alignment"`           // chunk_size 与分片偏移需为其整数倍
+	StrictChunks          bool  `json:"strict_chunks"`
+	ConsistentChunks      bool  `json:"consistent_chunks"` // 分片长度需与首个分片一致（末片除外）
+
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
+	BlockedExtensions []string `json:"blocked_extensions,omitempty"`
+
+	Features discoveryFeatures `json:"features"`
+}
+
+type discoveryFeatures struct {
+	ContentRange        bool     `json:"content_range"`   // 分片可用 Content-Range 指定偏移
+	ChunkChecksum       bool     `json:"chunk_checksum"`  // X-Chunk-Checksum
+	ChunkEncodings      []string `json:"chunk_encodings"` // 分片请求体支持的 Content-Encoding
+	ParallelChunks      bool     `json:"parallel_chunks"` // 同一上传的分片可以并发发送
+	Streaming           bool     `json:"streaming"`       // total_size 为 0 的流式上传
+	Resume              bool     `json:"resume"`          // init 的 resume 参数
+	SHA256              bool     `json:"sha256"`          // init 时声明整文件 sha256，complete 时校验
+	Tus                 bool     `json:"tus"`             // tus 1.0.0（见 tus_endpoint）
+	TusEndpoint         string   `json:"tus_endpoint,omitempty"`
+	Events              bool     `json:"events"`     // SSE 进度订阅
+	Metadata            bool     `json:"metadata"`   // init 的自定义 metadata
+	Encryption          bool     `json:"encryption"` // 落盘加密
+	Dedup               bool     `json:"dedup"`      // 内容去重
+	SkipDuplicateChunks bool     `json:"skip_duplicate_chunks"`
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	cfg := s.config()
+	_, local := s.store.(*localStorage)
+	resp := discoveryResp{
+		Version:           version,
+		AuthRequired:      len(cfg.Auth.Keys) > 0,
+		ReadOnly:          s.readOnly.Load(),
+		Backend:           cfg.Storage.Backend,
+		MaxChunkBytes:     cfg.Limits.MaxChunkBytes,
+		MaxFileBytes:      cfg.Limits.MaxFileBytes,
+		MaxJSONBytes:      cfg.Limits.MaxJSONBytes,
+		ChunkAlignment:    1,
+		StrictChunks:      cfg.Limits.StrictChunks,
+		ConsistentChunks:  cfg.Limits.ConsistentChunks,
+		AllowedExtensions: cfg.Limits.AllowedExtensions,
+		BlockedExtensions: cfg.Limits.BlockedExtensions,
+		Features: discoveryFeatures{
+			ContentRange:        true,
+			ChunkChecksum:       true,
+			ChunkEncodings:      []string{"gzip", "deflate"},
+			ParallelChunks:      true,
+			Streaming:           local,
+			Resume:              true,
+			SHA256:              local,
+			Tus:                 local,
+			Events:              true,
+			Metadata:            true,
+			Encryption:          s.encKey != nil,
+			Dedup:               s.dedup != nil,
+			SkipDuplicateChunks: cfg.Limits.SkipDuplicateChunks,
+		},
+	}
+	if local {
+		resp.Features.TusEndpoint = tusBasePath
+	}
+	if s.encKey != nil {
+		resp.ChunkAlignment = encBlockSize
+	}
+	if !local {
+		resp.MinChunkBytes = s3MinPartSize
+	}
+	lo, hi := s.chunkSizeBounds(cfg)
+	resp.RecommendedChunkBytes = min(max(recommendedChunkBytes, lo), hi)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// chunkSizeBounds 返回推荐分片大小的取值范围：上限为按加密块对齐后的 max_chunk_bytes，
+// 下限为 minRecommendedChunkBytes（S3 后端为最小 part 大小），两者都不超过上限。
+func (s *Server) chunkSizeBounds(cfg Config) (lo, hi int64) {
+	hi = cfg.Limits.MaxChunkBytes
+	if s.encKey != nil && hi >= encBlockSize {
+		hi -= hi % encBlockSize
+	}
+	lo = minRecommendedChunkBytes
+	if _, local := s.store.(*localStorage); !local {
+		lo = s3MinPartSize
+	}
+	return min(lo, hi), hi
+}
+
+// recommendChunkSize 按文件大小推荐分片大小：约 targetChunkCount 片，向上取整到 minRecommendedChunkBytes 的整数倍，
+// 再限制在 [lo, hi] 内。lo、hi 来自 chunkSizeBounds，已满足加密对齐；取整单位是加密块大小的整数倍，结果同样对齐。
+func recommendChunkSize(total, lo, hi int64) int64 {
+	size := (total + targetChunkCount - 1) / targetChunkCount
+	size = (size + minRecommendedChunkBytes - 1) / minRecommendedChunkBytes * minRecommendedChunkBytes
+	return min(max(size, lo), hi)
+}
+
+// recommendedChunkSize 返回 init 响应中的 recommended_chunk_size。严格分片（含 S3 后端）要求分片长度等于 chunk_size，
+// 此时只能按 init 时的 chunk_size 上传；流式上传不知道大小，取默认的建议值。
+func (s *Server) recommendedChunkSize(meta UploadMeta) int64 {
+	cfg := s.config()
+	if cfg.Limits.StrictChunks {
+		return meta.ChunkSize
+	}
+	lo, hi := s.chunkSizeBounds(cfg)
+	if meta.Streaming {
+		return min(max(recommendedChunkBytes, lo), hi)
+	}
+	return recommendChunkSize(meta.TotalSize, lo, hi)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 推荐分片大小约为 total/1000，按 1MB 向上取整并限制在 [lo, hi] 内。
+func TestRecommendChunkSize(t *testing.T) {
+	const (
+		mb = int64(1 << 20)
+		gb = 1 << 10 * mb
+	)
+	cases := []struct {
+		total, lo, hi, want int64
+	}{
+		{0, mb, 128 * mb, mb},
+		{1, mb, 128 * mb, mb},
+		{10 * mb, mb, 128 * mb, mb},
+		{1000 * mb, mb, 128 * mb, mb},
+		{1000*mb + 1, mb, 128 * mb, 2 * mb},
+		{5 * gb, mb, 128 * mb, 6 * mb}, // 5.12MB 向上取整
+		{100 * gb, mb, 128 * mb, 103 * mb},
+		{1 << 40, mb, 128 * mb, 128 * mb},   // 1TB 受 max_chunk_bytes 限制
+		{10 * mb, 5 * mb, 128 * mb, 5 * mb}, // S3 最小 part
+		{10 * gb, mb, 4 * mb, 4 * mb},
+		{10 * mb, 512 << 10, 512 << 10, 512 << 10}, // max_chunk_bytes 小于 1MB
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%d_%d", tc.total, tc.lo, tc.hi), func(t *testing.T) {
+			if got := recommendChunkSize(tc.total, tc.lo, tc.hi); got != tc.want {
+				t.Fatalf("recommendChunkSize(%d, %d, %d) = %d, want %d", tc.total, tc.lo, tc.hi, got, tc.want)
+			}
+		})
+	}
+}
+
+// strict_chunks 下只能按 init 的 chunk_size 上传；流式上传大小未知，取默认建议值。
+func TestRecommendedChunkSize(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Limits.MaxChunkBytes = 64 << 20 })
+	if got := s.recommendedChunkSize(UploadMeta{TotalSize: 10 << 30}); got != 11<<20 {
+		t.Errorf("10GB: got %d", got)
+	}
+	if got := s.recommendedChunkSize(UploadMeta{Streaming: true}); got != recommendedChunkBytes {
+		t.Errorf("streaming: got %d, want %d", got, recommendedChunkBytes)
+	}
+
+	strict := newTestServer(t, func(cfg *Config) { cfg.Limits.StrictChunks = true })
+	if got := strict.recommendedChunkSize(UploadMeta{TotalSize: 10 << 30, ChunkSize: 3 << 20}); got != 3<<20 {
+		t.Errorf("strict: got %d, want chunk_size", got)
+	}
+}
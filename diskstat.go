@@ -0,0 +1,20 @@
+package main
+
+import "errors"
+
+// diskUsage 描述某个路径所在文件系统的容量（字节）。
+type diskUsage struct {
+	Total     uint64 `json:"total"`
+	Free      uint64 `json:"free"`      // 剩余空间（含仅 root 可用的保留块）
+	Available uint64 `json:"available"` // 普通用户可用空间
+	Used      uint64 `json:"used"`
+
+	// inode 数量；平台或文件系统不提供时（如 Windows、btrfs）为 0
+	Inodes     uint64 `json:"inodes"`
+	InodesFree uint64 `json:"inodes_free"`
+}
+
+var errDiskStatUnsupported = errors.New("disk stat not supported on this platform")
+
+// diskStat 查询路径所在文件系统的容量，默认为平台的 statDisk，测试中替换以模拟空间不足。
+var diskStat = statDisk
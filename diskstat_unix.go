@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+func statDisk(path string) (diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskUsage{}, err
+	}
+	bsize := uint64(st.Bsize)
+	du := diskUsage{
+		Total:     uint64(st.Blocks) * bsize,
+		Free:      uint64(st.Bfree) * bsize,
+		Available: uint64(st.Bavail) * bsize,
+	}
+	if st.Files > 0 {
+		du.Inodes = uint64(st.Files)
+		du.InodesFree = uint64(max(st.Ffree, 0)) // FreeBSD 上为有符号数
+	}
+	du.Used = du.Total - du.Free
+	return du, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ===== 落盘加密 =====
+//
+// 配置 encryption.key 后，新建的上传以 AES-256-GCM 加密写入 .part，完成后的文件保持加密，
+// 下载接口透明解密。GCM 不能随机改写，因此明文按 encBlockSize 切块，每块独立加密：
+//
+//	文件头（encHeaderSize 字节）: "GUENC001" | upload_id（16 字节，hex 解码）
+//	第 i 块（位于 encHeaderSize + i*encFrameSize）: nonce（12 字节随机） | 密文 | tag（16 字节）
+//
+// 除最后一块外每块明文都是 encBlockSize 字节，所以任意明文偏移都能直接定位到所在块，
+// 分片只要按块对齐就能乱序、并发写入，也天然适配流式追加。
+// 每个上传的数据密钥为 HMAC-SHA256(encryption.key, upload_id)，块序号作为附加数据，
+// 防止块被调换位置。更换 encryption.key 后旧文件将无法解密。
+
+const (
+	encMagic      = "GUENC001"
+	encHeaderSize = len(encMagic) + 16
+	encBlockSize  = 64 << 10
+	encNonceSize  = 12
+	encTagSize    = 16
+	encOverhead   = encNonceSize + encTagSize
+	encFrameSize  = encBlockSize + encOverhead
+)
+
+var errNotEncrypted = errors.New("not an encrypted file")
+
+// parseEncryptionKey 解析 base64 编码的 32 字节密钥；空串表示不启用。
+func parseEncryptionKey(v string) ([]byte, error) {
+	if v == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("encryption.key must be 32 bytes encoded in base64")
+	}
+	return key, nil
+}
+
+// encryptedSize 返回明文长度为 n 时加密文件的长度。
+func encryptedSize(n int64) int64 {
+	size := int64(encHeaderSize) + n/encBlockSize*encFrameSize
+	if rest := n % encBlockSize; rest > 0 {
+		size += rest + encOverhead
+	}
+	return size
+}
+
+// plainSize 由加密文件长度反推明文长度。
+func plainSize(size int64) (int64, error) {
+	body := size - int64(encHeaderSize)
+	if body < 0 {
+		return 0, errNotEncrypted
+	}
+	n := body / encFrameSize * encBlockSize
+	if rest := body % encFrameSize; rest > 0 {
+		if rest <= encOverhead {
+			return 0, fmt.Errorf("truncated encrypted block")
+		}
+		n += rest - encOverhead
+	}
+	return n, nil
+}
+
+// uploadAEAD 为单个上传派生数据密钥。
+func (s *Server) uploadAEAD(uploadID string) (cipher.AEAD, error) {
+	if s.encKey == nil {
+		return nil, errors.New("encryption key not configured")
+	}
+	mac := hmac.New(sha256.New, s.encKey)
+	mac.Write([]byte(uploadID))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encHeader(uploadID string) ([]byte, error) {
+	id, err := hex.DecodeString(uploadID)
+	if err != nil || len(id) != 16 {
+		return nil, fmt.Errorf("invalid upload id %q", uploadID)
+	}
+	return append([]byte(encMagic), id...), nil
+}
+
+// readEncHeader 读取文件头中的 upload_id；不是加密文件时返回 errNotEncrypted。
+func readEncHeader(f io.ReaderAt) (string, error) {
+	hdr := make([]byte, encHeaderSize)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", errNotEncrypted
+		}
+		return "", err
+	}
+	if !bytes.Equal(hdr[:len(encMagic)], []byte(encMagic)) {
+		return "", errNotEncrypted
+	}
+	return hex.EncodeToString(hdr[len(encMagic):]), nil
+}
+
+func blockAAD(index int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(index))
+	return b[:]
+}
+
+// encWriter 将明文按块加密后写入 f。起始偏移必须按块对齐；
+// 不足一块的尾部只能出现在文件末尾，由 Close 写出。
+type encWriter struct {
+	f     *os.File
+	aead  cipher.AEAD
+	block int64
+	buf   []byte
+	frame []byte
+}
+
+func newEncWriter(f *os.File, aead cipher.AEAD, offset int64) *encWriter {
+	return &encWriter{
+		f:     f,
+		aead:  aead,
+		block: offset / encBlockSize,
+		buf:   make([]byte, 0, encBlockSize),
+		frame: make([]byte, encFrameSize),
+	}
+}
+
+func (w *encWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		k := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+		n += k
+		if len(w.buf) == encBlockSize {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *encWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	nonce := w.frame[:encNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	frame := w.aead.Seal(w.frame[:encNonceSize], nonce, w.buf, blockAAD(w.block))
+	if _, err := w.f.WriteAt(frame, int64(encHeaderSize)+w.block*encFrameSize); err != nil {
+		return err
+	}
+	w.block++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close 写出最后不足一块的数据。
+func (w *encWriter) Close() error {
+	return w.flush()
+}
+
+// encReaderAt 按块解密，提供明文视图；缓存最近解密的一块以适配顺序读取。不可并发使用。
+type encReaderAt struct {
+	f      io.ReaderAt
+	aead   cipher.AEAD
+	size   int64
+	cached int64
+	plain  []byte
+	frame  []byte
+}
+
+func newEncReaderAt(f io.ReaderAt, aead cipher.AEAD, size int64) *encReaderAt {
+	return &encReaderAt{f: f, aead: aead, size: size, cached: -1, frame: make([]byte, encFrameSize)}
+}
+
+func (r *encReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		index := off / encBlockSize
+		if err := r.load(index); err != nil {
+			return n, err
+		}
+		k := copy(p, r.plain[off-index*encBlockSize:])
+		p = p[k:]
+		n += k
+		off += int64(k)
+	}
+	return n, nil
+}
+
+func (r *encReaderAt) load(index int64) error {
+	if r.cached == index {
+		return nil
+	}
+	plainLen := minInt64(encBlockSize, r.size-index*encBlockSize)
+	frame := r.frame[:plainLen+encOverhead]
+	if _, err := r.f.ReadAt(frame, int64(encHeaderSize)+index*encFrameSize); err != nil {
+		return err
+	}
+	plain, err := r.aead.Open(r.plain[:0], frame[:encNonceSize], frame[encNonceSize:], blockAAD(index))
+	if err != nil {
+		r.cached = -1
+		return fmt.Errorf("decrypt block %d: %w", index, err)
+	}
+	r.plain = plain
+	r.cached = index
+	return nil
+}
+
+// openDecrypted 检查 f 是否为加密文件；是则返回明文视图与明文长度。
+func (s *Server) openDecrypted(f *os.File, size int64) (io.ReaderAt, int64, error) {
+	uploadID, err := readEncHeader(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := plainSize(size)
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := s.uploadAEAD(uploadID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return newEncReaderAt(f, aead, n), n, nil
+}
+
+// checkEncryptedAlignment 加密上传的分片必须按块对齐，不足一块只允许出现在文件末尾。
+func checkEncryptedAlignment(meta UploadMeta, offset, length int64) error {
+	if offset%encBlockSize != 0 {
+		return fmt.Errorf("encrypted upload: offset %d is not aligned to %d", offset, encBlockSize)
+	}
+	if length%encBlockSize == 0 || meta.Streaming || offset+length == meta.TotalSize {
+		return nil
+	}
+	return fmt.Errorf("encrypted upload: chunk length must be a multiple of %d except the last chunk", encBlockSize)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== 上传进度事件（SSE） =====
+//
+// GET /api/v1/uploads/events?upload_id=... 以 Server-Sent Events 推送单个上传的进度，替代轮询 status：
+// 连接建立时先发送一次当前进度，之后每写入一个分片发送 progress，完成时发送 completed、
+// 取消或被回收时发送 cancelled，随后服务端关闭连接。
+//
+// 订阅者的通道只缓存最新一条事件：客户端读得慢时中间的进度会被合并，不会拖慢分片写入。
+
+const sseKeepAlive = 15 * time.Second
+
+type uploadEvent struct {
+	name string
+	data map[string]any
+}
+
+// eventHub 是按 upload_id 分组的发布/订阅表。
+type eventHub struct {
+	mu      sync.Mutex
+	subs    map[string]map[chan uploadEvent]struct{}
+	closing chan struct{} // 服务关闭时关闭，让长连接尽快退出
+	once    sync.Once
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: map[string]map[chan uploadEvent]struct{}{}, closing: make(chan struct{})}
+}
+
+func (h *eventHub) subscribe(uploadID string) chan uploadEvent {
+	ch := make(chan uploadEvent, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[uploadID] == nil {
+		h.subs[uploadID] = map[chan uploadEvent]struct{}{}
+	}
+	h.subs[uploadID][ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(uploadID string, ch chan uploadEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[uploadID], ch)
+	if len(h.subs[uploadID]) == 0 {
+		delete(h.subs, uploadID)
+	}
+}
+
+// publish 向该上传的所有订阅者投递事件；订阅者尚未取走的旧事件直接被替换。
+func (h *eventHub) publish(uploadID string, ev uploadEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[uploadID] {
+		select {
+		case ch <- ev:
+			continue
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- ev
+	}
+}
+
+// shutdown 通知所有事件流结束，供 http.Server.RegisterOnShutdown 调用。
+func (h *eventHub) shutdown() {
+	h.once.Do(func() { close(h.closing) })
+}
+
+func progressEvent(meta UploadMeta) uploadEvent {
+	return uploadEvent{name: "progress", data: map[string]any{
+		"upload_id":     meta.UploadID,
+		"uploaded_size": meta.UploadedSize,
+		"total_size":    meta.TotalSize,
+	}}
+}
+
+func completedEvent(meta UploadMeta) uploadEvent {
+	return uploadEvent{name: "completed", data: map[string]any{
+		"upload_id":     meta.UploadID,
+		"uploaded_size": meta.TotalSize,
+		"total_size":    meta.TotalSize,
+		"path":          meta.RelPath,
+		"sha256":        meta.SHA256,
+	}}
+}
+
+func cancelledEvent(uploadID string) uploadEvent {
+	return uploadEvent{name: "cancelled", data: map[string]any{"upload_id": uploadID}}
+}
+
+// GET /api/v1/uploads/events?upload_id=...
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	uploadID := strings.TrimSpace(r.URL.Query().Get("upload_id"))
+	if !checkUploadID(w, uploadID) {
+		return
+	}
+
+	// 先订阅再读取当前状态，避免两者之间的进度丢失
+	ch := s.events.subscribe(uploadID)
+	defer s.events.unsubscribe(uploadID, ch)
+	mu := s.lock(uploadID)
+	mu.Lock()
+	meta, err := s.loadMeta(uploadID)
+	mu.Unlock()
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // 关闭 nginx 的响应缓冲
+	w.WriteHeader(http.StatusOK)
+
+	ev := progressEvent(meta)
+	if meta.Completed {
+		ev = completedEvent(meta)
+	}
+	if err := writeSSE(w, rc, ev); err != nil || meta.Completed {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.events.closing:
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case ev := <-ch:
+			if err := writeSSE(w, rc, ev); err != nil || ev.name != "progress" {
+				return
+			}
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, rc *http.ResponseController, ev uploadEvent) error {
+	b, err := json.Marshal(ev.data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, b); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ===== 从 URL 拉取 =====
+//
+// POST /api/v1/uploads/from-url 由服务端下载指定 URL 的内容并落到 root_dir 下，适合文件已在别处、
+// 不必先下到客户端再上传的场景。内部建立一个普通的上传会话：路径、配额、overwrite 策略、类型限制、
+// 加密与压缩等与 init + complete 完全相同，下载写入 .part，完成后同样经 rename 落盘并触发完成通知。
+// 为防止 SSRF，只允许 fetch.allowed_hosts 中的主机与 fetch.allowed_schemes 中的协议（默认仅 https），
+// 重定向的每一跳都重新检查；默认拒绝连接回环、内网与链路本地地址（在建立连接时按解析出的 IP 检查，
+// DNS 重绑定也无法绕过），不使用环境变量中的代理。
+// 下载受 fetch.max_bytes 与 fetch.timeout 限制，请求在下载完成后才返回。目前只支持本地存储。
+
+type FetchConfig struct {
+	AllowedHosts   []string      `yaml:"allowed_hosts"`   // 允许拉取的主机，"*.example.com" 匹配子域名，"*" 匹配任意主机；为空时关闭该接口
+	AllowedSchemes []string      `yaml:"allowed_schemes"` // 允许的协议（默认 ["https"]）
+	MaxBytes       int64         `yaml:"max_bytes"`       // 单个文件的大小上限（默认 1GB），另受 limits.max_file_bytes 约束
+	Timeout        time.Duration `yaml:"timeout"`         // 整个下载的超时（默认 10m）
+
+	AllowPrivateNetworks bool `yaml:"allow_private_networks"` // 允许连接回环、内网与链路本地地址
+}
+
+const (
+	defaultFetchMaxBytes = 1 << 30
+	maxFetchRedirects    = 5
+)
+
+func (c *FetchConfig) normalize() error {
+	hosts := c.AllowedHosts[:0]
+	for _, h := range c.AllowedHosts {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	c.AllowedHosts = hosts
+	if len(c.AllowedSchemes) == 0 {
+		c.AllowedSchemes = []string{"https"}
+	}
+	for i, s := range c.AllowedSchemes {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s != "http" && s != "https" {
+			return fmt.Errorf("invalid fetch.allowed_schemes entry %q: must be http or https", s)
+		}
+		c.AllowedSchemes[i] = s
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaultFetchMaxBytes
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Minute
+	}
+	return nil
+}
+
+// allowURL 检查 URL 的协议与主机是否在允许列表中。
+func (c *FetchConfig) allowURL(u *url.URL) bool {
+	scheme := strings.ToLower(u.Scheme)
+	schemeOK := false
+	for _, s := range c.AllowedSchemes {
+		if s == scheme {
+			schemeOK = true
+			break
+		}
+	}
+	host := strings.ToLower(u.Hostname())
+	if !schemeOK || host == "" {
+		return false
+	}
+	for _, h := range c.AllowedHosts {
+		switch {
+		case h == "*" || h == host:
+			return true
+		case strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// errFetchBlocked 表示目标地址属于被禁止的网络（回环、内网等）。
+var errFetchBlocked = errors.New("destination address not allowed")
+
+// newFetchClient 创建拉取用的 HTTP 客户端，未配置 allowed_hosts 时返回 nil。
+func newFetchClient(cfg FetchConfig) *http.Client {
+	if len(cfg.AllowedHosts) == 0 {
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if !cfg.AllowPrivateNetworks {
+		// 在连接实际的 IP 之前检查，域名解析到哪里都绕不过去
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil || !publicAddr(ip) {
+				return errFetchBlocked
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   30 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+			MaxIdleConnsPerHost:   2,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return errors.New("too many redirects")
+			}
+			if !cfg.allowURL(req.URL) {
+				return errFetchBlocked
+			}
+			return nil
+		},
+	}
+}
+
+// blockedPrefixes 是默认禁止连接的地址段：除回环、内网、链路本地外，还包括 CGNAT（含云厂商的元数据地址
+// 100.100.100.200）、基准测试与协议保留段，以及会映射回 IPv4 内部地址的 NAT64 / 6to4 等转换前缀。
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // 本网络
+	netip.MustParsePrefix("10.0.0.0/8"),      // 私有网络
+	netip.MustParsePrefix("100.64.0.0/10"),   // CGNAT 共享地址
+	netip.MustParsePrefix("127.0.0.0/8"),     // 回环
+	netip.MustParsePrefix("169.254.0.0/16"),  // 链路本地（含 169.254.169.254 元数据地址）
+	netip.MustParsePrefix("172.16.0.0/12"),   // 私有网络
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF 协议分配
+	netip.MustParsePrefix("192.0.2.0/24"),    // TEST-NET-1
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 中继任播
+	netip.MustParsePrefix("192.168.0.0/16"),  // 私有网络
+	netip.MustParsePrefix("198.18.0.0/15"),   // 基准测试
+	netip.MustParsePrefix("198.51.100.0/24"), // TEST-NET-2
+	netip.MustParsePrefix("203.0.113.0/24"),  // TEST-NET-3
+	netip.MustParsePrefix("224.0.0.0/4"),     // 组播
+	netip.MustParsePrefix("240.0.0.0/4"),     // 保留（含广播地址）
+	netip.MustParsePrefix("::/128"),          // 未指定
+	netip.MustParsePrefix("::1/128"),         // 回环
+	netip.MustParsePrefix("::ffff:0:0/96"),   // IPv4 映射（Unmap 后按 IPv4 检查，这里兜底）
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // 本地 NAT64
+	netip.MustParsePrefix("100::/64"),        // 丢弃
+	netip.MustParsePrefix("2001::/23"),       // IETF 协议分配（含 Teredo）
+	netip.MustParsePrefix("2001:db8::/32"),   // 文档
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("fc00::/7"),        // 唯一本地
+	netip.MustParsePrefix("fe80::/10"),       // 链路本地
+	netip.MustParsePrefix("ff00::/8"),        // 组播
+}
+
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range blockedPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+type fromURLReq struct {
+	URL      string            `json:"url"`
+	Path     string            `json:"path"`     // 目标路径，为空时取 URL 路径的最后一段
+	SHA256   string            `json:"sha256"`   // 可选，下载完成后校验
+	Metadata map[string]string `json:"metadata"` // 可选，同 init
+}
+
+// POST /api/v1/uploads/from-url {"url":"https://example.com/a.zip","path":"dl/a.zip"}
+func (s *Server) handleFromURL(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if s.fetchClient == nil {
+		writeError(w, http.StatusForbidden, "fetch_disabled", "fetching from URLs is disabled")
+		return
+	}
+	if !s.localOnly(w) || !s.writable(w) || !s.allowInit(w, r) {
+		return
+	}
+	var req fromURLReq
+	if err := s.readJSON(r, &req); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	cfg := s.config()
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || !u.IsAbs() {
+		writeError(w, http.StatusBadRequest, "invalid_url", "invalid url")
+		return
+	}
+	if !cfg.Fetch.allowURL(u) {
+		writeError(w, http.StatusForbidden, "url_not_allowed", "url not allowed")
+		return
+	}
+	maxBytes := cfg.Fetch.MaxBytes
+	if cfg.Limits.MaxFileBytes > 0 {
+		maxBytes = min(maxBytes, cfg.Limits.MaxFileBytes)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.Fetch.Timeout)
+	defer cancel()
+	greq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_url", "invalid url")
+		return
+	}
+	greq.Header.Set("User-Agent", "go-upload/"+version)
+	resp, err := s.fetchClient.Do(greq)
+	if err != nil {
+		s.writeFetchError(w, r, u, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		reqLogger(r).Warn("fetch failed", "url", u.Redacted(), "upstream_status", resp.StatusCode)
+		writeErrorBody(w, http.StatusBadGateway, "fetch_failed", "upstream returned "+resp.Status, map[string]any{
+			"upstream_status": resp.StatusCode,
+		})
+		return
+	}
+	if resp.ContentLength > maxBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "file_too_large", "file too large")
+		return
+	}
+
+	// 大小已知时按固定大小建立会话，否则按流式上传，读完后以实际字节数为准
+	chunkSize := cfg.Limits.MaxChunkBytes
+	if s.encKey != nil {
+		chunkSize -= chunkSize % encBlockSize
+	}
+	p := strings.TrimSpace(req.Path)
+	if p == "" {
+		p = path.Base(u.Path)
+	}
+	meta, _, err := s.newUpload(initReq{
+		Path:      p,
+		TotalSize: max(resp.ContentLength, 0),
+		ChunkSize: chunkSize,
+		SHA256:    req.SHA256,
+		Metadata:  req.Metadata,
+	})
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	uploadID := meta.UploadID
+	mu := s.lock(uploadID)
+	mu.part.Lock()
+	defer mu.part.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	fail := func() { s.removeUpload(uploadID) }
+
+	limit := maxBytes + 1
+	if !meta.Streaming {
+		limit = meta.TotalSize
+	}
+	// 读上游出错（断开、超时）与写盘出错分开处理
+	body := &readErrRecorder{r: resp.Body}
+	var src io.Reader = body
+	ph := newPrefixHasher(meta, 0)
+	if ph != nil {
+		src = io.TeeReader(src, ph)
+	}
+	head := &headBuffer{}
+	src = io.TeeReader(src, head)
+	wrote, err := s.store.WriteChunk(r.Context(), meta, 0, limit, src)
+	if err != nil {
+		fail()
+		if body.err != nil {
+			s.writeFetchError(w, r, u, body.err)
+			return
+		}
+		reqLogger(r).Error("write fetched data failed", "upload_id", uploadID, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "write failed")
+		return
+	}
+	switch {
+	case wrote > maxBytes:
+		fail()
+		writeError(w, http.StatusRequestEntityTooLarge, "file_too_large", "file too large")
+		return
+	case !meta.Streaming && wrote != meta.TotalSize:
+		fail()
+		reqLogger(r).Warn("fetch truncated", "url", u.Redacted(), "bytes", wrote, "content_length", meta.TotalSize)
+		writeError(w, http.StatusBadGateway, "fetch_failed", "upstream body shorter than Content-Length")
+		return
+	}
+	if meta.Streaming {
+		meta.TotalSize = wrote
+	}
+	meta.SniffedType = head.contentType()
+	if s.rejectSniffed(r, meta) {
+		fail()
+		writeError(w, http.StatusUnsupportedMediaType, "file_type_not_allowed", "file type not allowed: "+meta.SniffedType)
+		return
+	}
+	if meta, err = s.commitChunk(meta, 0, wrote, ph); err != nil {
+		fail()
+		writeError(w, http.StatusInternalServerError, "internal_error", "save failed")
+		return
+	}
+	meta, finalAbs, err := s.finalizeUpload(meta)
+	if err != nil {
+		fail()
+		writeHTTPError(w, err)
+		return
+	}
+	reqLogger(r).Info("upload fetched", "upload_id", uploadID, "url", u.Redacted(), "rel_path", meta.RelPath,
+		"bytes", meta.TotalSize, "duration_ms", time.Since(start).Milliseconds())
+	writeJSON(w, http.StatusOK, map[string]any{
+		"completed": true,
+		"upload_id": uploadID,
+		"path":      finalAbs,
+		"size":      meta.TotalSize,
+		"sha256":    meta.SHA256,
+	})
+}
+
+// writeFetchError 把请求上游或读取响应体的错误转换为响应：被禁止的地址 403，超时 504，其余 502。
+func (s *Server) writeFetchError(w http.ResponseWriter, r *http.Request, u *url.URL, err error) {
+	switch {
+	case r.Context().Err() != nil:
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	case errors.Is(err, errFetchBlocked):
+		writeError(w, http.StatusForbidden, "url_not_allowed", "url not allowed")
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, "fetch_timeout", "fetch timed out")
+		return
+	}
+	reqLogger(r).Warn("fetch failed", "url", u.Redacted(), "error", err)
+	writeError(w, http.StatusBadGateway, "fetch_failed", "fetch failed")
+}
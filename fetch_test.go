@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 默认配置下，连接任何被禁止的地址段都在建立连接前失败，包括标准库的 IsPrivate 等判断覆盖不到的段。
+func TestFetchClientBlocksRanges(t *testing.T) {
+	client := newFetchClient(FetchConfig{
+		AllowedHosts:   []string{"*"},
+		AllowedSchemes: []string{"http"},
+		Timeout:        time.Second,
+	})
+	addrs := []string{
+		"100.100.100.200", // CGNAT 内的云元数据地址
+		"100.64.0.1",
+		"198.18.0.1",
+		"192.0.0.1",
+		"240.0.0.1",
+		"255.255.255.255",
+		"169.254.169.254",
+		"127.0.0.1",
+		"10.1.2.3",
+		"0.0.0.0",
+		"::1",
+		"64:ff9b::a9fe:a9fe", // NAT64 映射的 169.254.169.254
+		"64:ff9b::7f00:1",    // NAT64 映射的 127.0.0.1
+		"::ffff:127.0.0.1",
+		"fd00::1",
+		"fe80::1",
+	}
+	for _, p := range blockedPrefixes {
+		addrs = append(addrs, p.Addr().String())
+	}
+	for _, a := range addrs {
+		_, err := client.Get("http://" + net.JoinHostPort(a, "80") + "/")
+		if !errors.Is(err, errFetchBlocked) {
+			t.Errorf("dial %s: got %v, want errFetchBlocked", a, err)
+		}
+	}
+
+	for _, a := range []string{"8.8.8.8", "1.1.1.1", "2606:4700::1111", "100.128.0.1"} {
+		if !publicAddr(netip.MustParseAddr(a)) {
+			t.Errorf("%s should be allowed", a)
+		}
+	}
+}
+
+// 拉取的内容类型被拒绝时会话要一并清理，不留下 .part 与元数据，也不占着并发名额。
+func TestFromURLRejectedTypeCleansUp(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<!DOCTYPE html><html><body>hi</body></html>"))
+	}))
+	defer upstream.Close()
+
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Limits.BlockedContentTypes = []string{"text/html"}
+		cfg.Fetch.AllowedHosts = []string{"127.0.0.1"}
+		cfg.Fetch.AllowedSchemes = []string{"http"}
+		cfg.Fetch.AllowPrivateNetworks = true
+	})
+	body := `{"url":"` + upstream.URL + `/page.bin","path":"f/page.bin"}`
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/uploads/from-url", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.handleFromURL(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	entries, err := os.ReadDir(s.stateAbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, de := range entries {
+		if !de.IsDir() && de.Name() != stateLayoutFile {
+			t.Errorf("leftover state file %s", de.Name())
+		}
+	}
+	if n := s.activeUploads.Load(); n != 0 {
+		t.Errorf("activeUploads = %d, want 0", n)
+	}
+}
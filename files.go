@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ===== 已完成文件的管理接口 =====
+
+// resolveFilePath 将用户传入的相对路径解析为 root_dir 下的绝对路径，
+// 并拒绝指向状态目录的路径，避免通过文件接口读写 .part/元数据。
+func (s *Server) resolveFilePath(rel string) (string, error) {
+	abs, err := s.finalAbsPath(rel)
+	if err != nil {
+		return "", err
+	}
+	if isSubpath(abs, s.stateAbs) {
+		return "", errors.New("path inside state dir")
+	}
+	return abs, nil
+}
+
+// GET/HEAD /api/v1/files/download?path=subdir/a.bin
+// 通过 http.ServeContent 输出文件，支持 Range 与条件请求。HEAD 时 ServeContent 只输出
+// Content-Length、Content-Type 等响应头，不读取文件内容（扩展名无法判断类型时除外，需读取开头嗅探）。
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	abs, err := s.resolveFilePath(strings.TrimSpace(r.URL.Query().Get("path")))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_path", "invalid path")
+		return
+	}
+	rel, _ := filepath.Rel(s.rootAbs, abs)
+	obj, err := s.store.Open(r.Context(), rel)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	defer obj.Close()
+	if ct := mime.TypeByExtension(filepath.Ext(abs)); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	// 设置 ETag 后 ServeContent 会处理 If-None-Match / If-Range
+	etag := obj.ETag
+	if etag == "" {
+		etag = s.fileETag(rel, obj.Size, obj.ModTime)
+	}
+	w.Header().Set("ETag", etag)
+	// 上传时给出了原始文件名时按该名称下载，存储路径可以与之无关
+	if e, ok := s.lookupFile(rel, obj.Size, obj.ModTime); ok && e.originalName != "" {
+		w.Header().Set("Content-Disposition", contentDisposition(e.originalName))
+	}
+	if obj.Compressed {
+		serveCompressed(w, r, obj, etag)
+		return
+	}
+	http.ServeContent(w, r, obj.Name, obj.ModTime, obj)
+}
+
+// DELETE /api/v1/files?path=subdir/a.bin
+// 删除 root_dir 下的单个普通文件；目录不允许通过该接口删除。
+func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+	abs, err := s.resolveFilePath(strings.TrimSpace(r.URL.Query().Get("path")))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_path", "invalid path")
+		return
+	}
+	rel, _ := filepath.Rel(s.rootAbs, abs)
+	if err := s.store.Remove(rel); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	s.invalidateQuota(rel)
+	s.fileIndex.Delete(rel)
+	writeJSON(w, http.StatusOK, map[string]any{"deleted": true})
+}
+
+type moveReq struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// POST /api/v1/files/move {"from":"a/x.bin","to":"b/x.bin"}
+// 在 root_dir 内移动或重命名已完成的文件，目标已存在时按 storage.overwrite 处理。
+func (s *Server) handleMoveFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if !s.localOnly(w) || !s.writable(w) {
+		return
+	}
+	var req moveReq
+	if err := s.readJSON(r, &req); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	fromAbs, err := s.resolveFilePath(strings.TrimSpace(req.From))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_from", "invalid from")
+		return
+	}
+	toAbs, err := s.resolveFilePath(strings.TrimSpace(req.To))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_to", "invalid to")
+		return
+	}
+	toRel, _ := filepath.Rel(s.rootAbs, toAbs)
+	if err := s.checkPathNames(toRel); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	if err := s.checkExtension(toRel); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	if fromAbs == toAbs {
+		writeError(w, http.StatusBadRequest, "same_path", "from and to are the same")
+		return
+	}
+	fromRel, _ := filepath.Rel(s.rootAbs, fromAbs)
+	// 压缩存储的文件按原路径移动，磁盘上带着 .gz 一起走
+	fromStored, compressed := storedPath(fromAbs)
+	st, err := os.Lstat(fromStored)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "file_not_found", "not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal_error", "stat failed")
+		return
+	}
+	isDedupLink := st.Mode()&os.ModeSymlink != 0 && s.dedup != nil && s.dedup.isRef(fromRel)
+	if !st.Mode().IsRegular() && !isDedupLink {
+		writeError(w, http.StatusConflict, "not_a_file", "not a regular file")
+		return
+	}
+
+	toAbs, err = s.moveCompletedFile(fromStored, toAbs, compressed)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	toRel, _ = filepath.Rel(s.rootAbs, toAbs)
+	s.pruneEmptyDirs(fromRel)
+	s.invalidateQuota(fromRel)
+	s.invalidateQuota(toRel)
+	// ETag 随文件走；目标被覆盖时其旧 ETag 一并失效
+	s.fileIndex.Delete(toRel)
+	if v, ok := s.fileIndex.LoadAndDelete(fromRel); ok {
+		s.fileIndex.Store(toRel, v)
+	}
+	s.renameDedup(fromRel, toRel)
+
+	reqLogger(r).Info("file moved", "from", fromRel, "to", toRel)
+	writeJSON(w, http.StatusOK, map[string]any{"moved": true, "path": toRel})
+}
+
+// moveCompletedFile 在 finalizeMu 内完成目标检查与移动，返回实际的目标路径（rename 策略下可能改名）。
+// compressed 表示 fromAbs 是压缩存储的 .gz 文件，此时 toAbs 与返回值都是不带 .gz 的原路径。
+// 跨文件系统时由 moveStaged 在锁外复制。
+func (s *Server) moveCompletedFile(fromAbs, toAbs string, compressed bool) (string, error) {
+	stageDst := toAbs
+	if compressed {
+		stageDst += compressedSuffix
+	}
+	var placed string
+	err := s.moveStaged(fromAbs, stageDst, func(src string, rename func(string, string) error) error {
+		var err error
+		placed, err = s.placeMovedFile(src, toAbs, compressed, rename)
+		return err
+	})
+	if err != nil {
+		var he *httpError
+		switch {
+		case errors.As(err, &he):
+			return "", err
+		case errors.Is(err, os.ErrNotExist):
+			return "", errStatus(http.StatusNotFound, "file_not_found", "not found")
+		}
+		log.Printf("move %s -> %s failed: %v", fromAbs, toAbs, err)
+		return "", errStatus(http.StatusInternalServerError, "internal_error", "move failed")
+	}
+	return placed, nil
+}
+
+// placeMovedFile 是 moveCompletedFile 在 finalizeMu 内的部分：检查目标并以 rename 把 src 移到位。
+func (s *Server) placeMovedFile(src, toAbs string, compressed bool, rename func(string, string) error) (string, error) {
+	s.finalizeMu.Lock()
+	defer s.finalizeMu.Unlock()
+	if st, err := os.Stat(toAbs); err == nil && st.IsDir() {
+		return "", errStatus(http.StatusConflict, "destination_is_directory", "destination is a directory")
+	}
+	if err := s.ensureParentDir(toAbs); err != nil {
+		return "", errStatus(http.StatusInternalServerError, "internal_error", "mkdir failed")
+	}
+	toAbs, err := s.applyOverwritePolicy(toAbs)
+	if err != nil {
+		if errors.Is(err, errDestExists) {
+			return "", errStatus(http.StatusConflict, "destination_exists", "destination exists")
+		}
+		return "", errStatus(http.StatusInternalServerError, "internal_error", "move failed")
+	}
+	dst := toAbs
+	if compressed {
+		dst += compressedSuffix
+	}
+	if err := rename(src, dst); err != nil {
+		return "", err
+	}
+	removeOtherVariant(toAbs, compressed)
+	return toAbs, nil
+}
+
+// fileEntry 记录完成上传时的 ETag 与原始文件名；文件之后被替换（大小不同或修改时间晚于完成时间）则不再使用。
+type fileEntry struct {
+	etag         string
+	originalName string
+	size         int64
+	completedAt  time.Time
+}
+
+// indexCompleted 记录已完成上传的下载信息，同一路径保留最近完成的一次。
+func (s *Server) indexCompleted(meta UploadMeta) {
+	if (meta.ETag == "" && meta.OriginalName == "") || meta.CompletedAt == nil {
+		return
+	}
+	e := fileEntry{etag: meta.ETag, originalName: meta.OriginalName, size: meta.TotalSize, completedAt: *meta.CompletedAt}
+	if old, ok := s.fileIndex.Load(meta.RelPath); ok && old.(fileEntry).completedAt.After(e.completedAt) {
+		return
+	}
+	s.fileIndex.Store(meta.RelPath, e)
+}
+
+// lookupFile 返回 rel 对应的完成记录，文件已被替换时返回 false。
+func (s *Server) lookupFile(rel string, size int64, modTime time.Time) (fileEntry, bool) {
+	v, ok := s.fileIndex.Load(rel)
+	if !ok {
+		return fileEntry{}, false
+	}
+	e := v.(fileEntry)
+	if size != e.size || modTime.After(e.completedAt) {
+		return fileEntry{}, false
+	}
+	return e, true
+}
+
+// fileETag 优先使用完成上传时记录的摘要 ETag，否则按大小与修改时间生成。
+// size 为明文大小（加密文件解密后的长度）。
+func (s *Server) fileETag(rel string, size int64, modTime time.Time) string {
+	if e, ok := s.lookupFile(rel, size, modTime); ok && e.etag != "" {
+		return e.etag
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%d", size, modTime.UnixNano())
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// currentETag 返回 rel 上现有文件的 ETag（与下载接口一致），文件不存在时返回空串。
+func (s *Server) currentETag(rel string) (string, error) {
+	obj, err := s.store.Open(context.Background(), rel)
+	if err != nil {
+		var he *httpError
+		if errors.As(err, &he) && he.status == http.StatusNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	defer obj.Close()
+	if obj.ETag != "" {
+		return obj.ETag, nil
+	}
+	return s.fileETag(rel, obj.Size, obj.ModTime), nil
+}
+
+// checkIfMatch 按 RFC 9110 校验 If-Match：值为 "*" 时要求目标存在，否则要求现有文件的 ETag
+// 与列表中某一项强匹配（弱 ETag 一律不匹配）。目标不存在时同样视为失败。
+func (s *Server) checkIfMatch(rel, ifMatch string) error {
+	current, err := s.currentETag(rel)
+	if err != nil {
+		return errStatus(http.StatusInternalServerError, "internal_error", "stat destination failed")
+	}
+	if current != "" {
+		for _, tag := range strings.Split(ifMatch, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" || tag == current {
+				return nil
+			}
+		}
+	}
+	he := errStatus(http.StatusPreconditionFailed, "precondition_failed", "precondition failed")
+	if current != "" {
+		he.body = map[string]any{"current_etag": current}
+	}
+	return he
+}
+
+// validateOriginalFilename 检查 original_filename：只是展示用的名称，不参与路径计算，
+// 但会写入响应头，拒绝非法 UTF-8、控制字符与路径分隔符。
+func validateOriginalFilename(name string) error {
+	if len(name) > 255 {
+		return errors.New("original_filename too long")
+	}
+	if !utf8.ValidString(name) {
+		return errors.New("invalid original_filename")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == '/' || r == '\\' {
+			return errors.New("invalid original_filename")
+		}
+	}
+	return nil
+}
+
+// contentDisposition 生成 attachment 的 Content-Disposition：filename 为 ASCII 兜底
+// （非 ASCII 字符替换为 "_"），filename* 按 RFC 5987 以 UTF-8 百分号编码给出完整名称。
+func contentDisposition(name string) string {
+	var fallback, ext strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '"' || r == '\\':
+			fallback.WriteByte('_')
+		case r < utf8.RuneSelf:
+			fallback.WriteRune(r)
+		default:
+			fallback.WriteByte('_')
+		}
+	}
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			ext.WriteByte(b)
+		} else {
+			fmt.Fprintf(&ext, "%%%02X", b)
+		}
+	}
+	v := `attachment; filename="` + fallback.String() + `"`
+	if ext.String() != fallback.String() {
+		v += "; filename*=UTF-8''" + ext.String()
+	}
+	return v
+}
+
+// isAttrChar 判断是否为 RFC 5987 attr-char，可在 filename* 中原样出现。
+func isAttrChar(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
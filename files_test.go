@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func download(s *Server, rel string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.handleDownload(w, httptest.NewRequest(http.MethodGet, "/api/v1/files/download?path="+rel, nil))
+	return w
+}
+
+// 下载不跟随根目录内指向外部的链接（文件链接或目录链接），指向根目录内的链接照常下载。
+func TestDownloadSymlinks(t *testing.T) {
+	s := newTestServer(t)
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.rootAbs, "plain.txt"), []byte("plain"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"file-out.txt": filepath.Join(outside, "secret.txt"),
+		"dir-out":      outside,
+		"file-in.txt":  filepath.Join(s.rootAbs, "plain.txt"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(s.rootAbs, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, rel := range []string{"file-out.txt", "dir-out/secret.txt"} {
+		w := download(s, rel)
+		if w.Code != http.StatusBadRequest || errorCode(t, w) != "invalid_path" {
+			t.Errorf("download %s: status %d: %s", rel, w.Code, w.Body)
+		}
+	}
+	if w := download(s, "file-in.txt"); w.Code != http.StatusOK || w.Body.String() != "plain" {
+		t.Errorf("download in-root link: status %d: %q", w.Code, w.Body)
+	}
+}
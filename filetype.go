@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// ===== 文件类型限制 =====
+//
+// limits.allowed_extensions 不为空时只接受以其中某个扩展名结尾的路径，limits.blocked_extensions 中的扩展名一律拒绝，
+// 两者都按小写比较，可写多段扩展名（如 .tar.gz）。init、tus 创建与移动文件都会检查目标路径，不符合时返回 415。
+// limits.blocked_content_types 按首个分片的内容嗅探结果再检查一次，命中时取消上传，防止改了扩展名的文件混进来。
+// 三项默认都为空，即不限制。
+
+// normalizeExtensions 统一为带前导点的小写形式，去掉空项。
+func normalizeExtensions(exts []string) []string {
+	out := make([]string, 0, len(exts))
+	for _, e := range exts {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" || e == "." {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// normalizeContentTypes 只保留媒体类型本身（去掉参数），统一为小写。
+func normalizeContentTypes(types []string) []string {
+	out := make([]string, 0, len(types))
+	for _, t := range types {
+		if t = mediaType(t); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func mediaType(v string) string {
+	if mt, _, err := mime.ParseMediaType(v); err == nil {
+		return mt
+	}
+	return strings.ToLower(strings.TrimSpace(v))
+}
+
+func hasExtension(name string, exts []string) bool {
+	name = strings.ToLower(name)
+	for _, e := range exts {
+		if strings.HasSuffix(name, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExtension 按 allowed_extensions / blocked_extensions 检查目标路径的文件名。
+func (s *Server) checkExtension(rel string) error {
+	limits := s.config().Limits
+	name := filepath.Base(rel)
+	if len(limits.AllowedExtensions) > 0 && !hasExtension(name, limits.AllowedExtensions) {
+		return errStatus(http.StatusUnsupportedMediaType, "file_type_not_allowed", fmt.Sprintf("file type not allowed: %s", name))
+	}
+	if hasExtension(name, limits.BlockedExtensions) {
+		return errStatus(http.StatusUnsupportedMediaType, "file_type_not_allowed", fmt.Sprintf("file type not allowed: %s", name))
+	}
+	return nil
+}
+
+// rejectSniffed 在首个分片嗅探出的类型被禁止时取消上传，返回是否已取消。调用方需持有该上传的锁。
+func (s *Server) rejectSniffed(r *http.Request, meta UploadMeta) bool {
+	if !s.blockedContentType(meta.SniffedType) {
+		return false
+	}
+	s.removeUpload(meta.UploadID)
+	reqLogger(r).Warn("upload cancelled: content type not allowed", "upload_id", meta.UploadID, "rel_path", meta.RelPath,
+		"sniffed_type", meta.SniffedType)
+	return true
+}
+
+// blockedContentType 判断嗅探出的类型是否在 blocked_content_types 中。
+func (s *Server) blockedContentType(sniffed string) bool {
+	if sniffed == "" {
+		return false
+	}
+	mt := mediaType(sniffed)
+	for _, t := range s.config().Limits.BlockedContentTypes {
+		if t == mt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// ===== 过期上传回收 =====
+//
+// 未完成且已过期的上传会被定期清理（.part + 元数据），避免被放弃的会话长期占用磁盘。
+// 带 expires_at 的上传以其为准，否则按创建时间超过 gc_max_age 判断。gc_interval 为 0 时不启动。
+
+func (s *Server) runGC(interval, maxAge time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			n := s.collectStale(maxAge)
+			log.Printf("gc: reclaimed %d stale uploads", n)
+			if n := s.collectBatches(maxAge); n > 0 {
+				log.Printf("gc: removed %d finished batches", n)
+			}
+		}
+	}
+}
+
+// collectStale 清理一轮过期上传，返回回收数量。
+func (s *Server) collectStale(maxAge time.Duration) int {
+	ids, err := s.listUploadIDs()
+	if err != nil {
+		log.Printf("gc: scan state dir failed: %v", err)
+		return 0
+	}
+	now := time.Now()
+	reclaimed := 0
+	for _, id := range ids {
+		// 先不加锁判断，只为可能回收的上传创建锁：s.lock 会在 muByUpload 中留下条目，
+		// 对每个上传都加锁会让长期存在的会话在每轮 GC 后都多占一份锁对象
+		if !s.collectable(id, now, maxAge) {
+			continue
+		}
+		// 有分片正在写入的上传显然仍在使用，跳过，下一轮再看
+		mu := s.lock(id)
+		if !mu.part.TryLock() {
+			continue
+		}
+		mu.Lock()
+		// 加锁期间可能有分片刚提交（滑动过期时间）或已被取消，重新判断
+		if s.collectable(id, now, maxAge) {
+			s.removeUpload(id)
+			reclaimed++
+		}
+		mu.Unlock()
+		mu.part.Unlock()
+	}
+	return reclaimed
+}
+
+// collectable 判断上传是否应当回收：未完成且已过期，或元数据损坏且元数据文件的修改时间超过 gc_max_age
+// （这类上传无法续传）。
+func (s *Server) collectable(uploadID string, now time.Time, maxAge time.Duration) bool {
+	meta, err := s.loadMeta(uploadID)
+	switch {
+	case err == nil:
+		return !meta.Completed && isExpired(meta, now, maxAge)
+	case errors.Is(err, errCorruptMeta):
+		return s.metaOlderThan(uploadID, now, maxAge)
+	}
+	return false
+}
+
+func (s *Server) metaOlderThan(uploadID string, now time.Time, maxAge time.Duration) bool {
+	fi, err := os.Stat(s.metaPath(uploadID))
+	return err == nil && now.Sub(fi.ModTime()) > maxAge
+}
+
+func isExpired(meta UploadMeta, now time.Time, maxAge time.Duration) bool {
+	if meta.ExpiresAt != nil {
+		return now.After(*meta.ExpiresAt)
+	}
+	return now.Sub(meta.CreatedAt) > maxAge
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== 单层目录列表 =====
+//
+// storage/tree 只返回目录；storage/ls 列出单个目录下的文件与子目录，供文件浏览器使用。
+// 按名称排序、以上一页最后一个名称作为游标分页。目录项按批读取，只保留游标之后最小的 limit 个名称，
+// 大目录下内存占用与 limit 成正比，耗时与目录大小成正比。
+
+const (
+	lsBatchSize    = 256
+	lsDefaultLimit = 100
+	lsMaxLimit     = 1000
+)
+
+type lsEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	IsDir   bool      `json:"is_dir"`
+	MIME    string    `json:"mime,omitempty"`
+}
+
+type lsResp struct {
+	Path       string    `json:"path"`
+	Entries    []lsEntry `json:"entries"`
+	NextCursor string    `json:"next_cursor,omitempty"` // 为空表示没有下一页
+}
+
+// nameHeap 是名称的大顶堆，用于保留最小的 limit 个名称。
+type nameHeap []string
+
+func (h nameHeap) Len() int           { return len(h) }
+func (h nameHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h nameHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *nameHeap) Push(x any)        { *h = append(*h, x.(string)) }
+func (h *nameHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// GET /api/v1/storage/ls?path=subdir&limit=100&cursor=...
+func (s *Server) handleStorageLs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if !s.localOnly(w) {
+		return
+	}
+	q := r.URL.Query()
+	limit := lsDefaultLimit
+	if v := strings.TrimSpace(q.Get("limit")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > lsMaxLimit {
+			writeError(w, http.StatusBadRequest, "invalid_limit", "invalid limit")
+			return
+		}
+		limit = n
+	}
+	cursor := q.Get("cursor")
+
+	dirAbs, relDir := s.rootAbs, ""
+	if p := strings.TrimSpace(q.Get("path")); p != "" && p != "/" && p != "." {
+		abs, err := s.resolveFilePath(p)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_path", "invalid path")
+			return
+		}
+		dirAbs = abs
+		relDir, _ = filepath.Rel(s.rootAbs, abs)
+	}
+	st, err := os.Stat(dirAbs)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "directory_not_found", "not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal_error", "stat failed")
+		return
+	}
+	if !st.IsDir() {
+		writeError(w, http.StatusBadRequest, "not_a_directory", "not a directory")
+		return
+	}
+
+	names, more, err := s.smallestNames(dirAbs, cursor, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "read dir failed")
+		return
+	}
+	resp := lsResp{Path: filepath.ToSlash(relDir), Entries: make([]lsEntry, 0, len(names))}
+	for _, name := range names {
+		// 去重产生的符号链接按其指向的文件展示；读取失败（刚被删除等）的条目跳过
+		abs := filepath.Join(dirAbs, name)
+		fi, err := os.Stat(abs)
+		if err != nil {
+			continue
+		}
+		e := lsEntry{Name: name, ModTime: fi.ModTime().UTC(), IsDir: fi.IsDir()}
+		if !e.IsDir {
+			e.Size = s.displaySize(abs, fi.Size())
+			e.MIME = mime.TypeByExtension(filepath.Ext(name))
+		}
+		resp.Entries = append(resp.Entries, e)
+	}
+	if more && len(names) > 0 {
+		resp.NextCursor = names[len(names)-1]
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// smallestNames 分批读取目录，返回名称大于 cursor 的最小 limit 个名称（升序），
+// more 表示之后还有条目。状态目录不会出现在结果中。
+func (s *Server) smallestNames(dirAbs, cursor string, limit int) ([]string, bool, error) {
+	d, err := os.Open(dirAbs)
+	if err != nil {
+		return nil, false, err
+	}
+	defer d.Close()
+
+	h := make(nameHeap, 0, limit+1)
+	more := false
+	for {
+		batch, err := d.ReadDir(lsBatchSize)
+		for _, de := range batch {
+			name := de.Name()
+			if name <= cursor || filepath.Join(dirAbs, name) == s.stateAbs {
+				continue
+			}
+			heap.Push(&h, name)
+			if h.Len() > limit {
+				heap.Pop(&h)
+				more = true
+			}
+		}
+		if errors.Is(err, io.EOF) || (err == nil && len(batch) == 0) {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	names := []string(h)
+	sort.Strings(names)
+	return names, more, nil
+}
+
+// displaySize 返回文件的明文大小：加密存储的文件按解密后的长度计。
+func (s *Server) displaySize(abs string, size int64) int64 {
+	if s.encKey == nil {
+		return size
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return size
+	}
+	defer f.Close()
+	if _, err := readEncHeader(f); err != nil {
+		return size
+	}
+	if n, err := plainSize(size); err == nil {
+		return n
+	}
+	return size
+}
@@ -1,24 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"embed"
+	"encoding/base32"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"log"
 	"mime"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"gopkg.in/yaml.v3"
 )
@@ -28,20 +44,102 @@ var staticFS embed.FS
 
 type Config struct {
 	Server struct {
-		Addr string `yaml:"addr"`
+		Addr            string        `yaml:"addr"`
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // 优雅退出时等待进行中请求的最长时间
+		TLS             struct {
+			CertFile string `yaml:"cert_file"`
+			KeyFile  string `yaml:"key_file"`
+		} `yaml:"tls"` // 同时配置证书与私钥时启用 HTTPS
+		TrustedProxies []string   `yaml:"trusted_proxies"` // 可信反向代理的 CIDR，来自这些地址的请求才采信 X-Forwarded-For
+		CORS           CORSConfig `yaml:"cors"`
+		ReadOnly       bool       `yaml:"read_only"`      // 只读模式，拒绝所有写入，见 readonly.go
+		PprofEnable    bool       `yaml:"pprof_enable"`   // 在单独的监听地址上提供 /debug/pprof/，见 pprof.go
+		PprofAddr      string     `yaml:"pprof_addr"`     // pprof 的监听地址（默认 127.0.0.1:6060）
+		GzipResponses  bool       `yaml:"gzip_responses"` // 客户端接受时以 gzip 压缩较大的 JSON 响应，见 respgzip.go
+		GzipMinBytes   int        `yaml:"gzip_min_bytes"` // 压缩的最小响应体大小（默认 1024）
 	} `yaml:"server"`
 	Static struct {
 		Enable bool   `yaml:"enable"`
-		Dir    string `yaml:"dir"`
+		Dir    string `yaml:"dir"` // 前端文件目录，存在时代替嵌入的 web/dist（便于调试前端）
 	} `yaml:"static"`
 	Storage struct {
-		RootDir  string `yaml:"root_dir"`
-		StateDir string `yaml:"state_dir"`
+		RootDir    string        `yaml:"root_dir"`
+		StateDir   string        `yaml:"state_dir"`
+		GCInterval time.Duration `yaml:"gc_interval"` // 过期上传回收周期，0 表示不启用
+		GCMaxAge   time.Duration `yaml:"gc_max_age"`  // 未完成上传的最长保留时间
+		Overwrite  string        `yaml:"overwrite"`   // 目标文件已存在时的策略：overwrite | reject | rename
+
+		DurableMeta       *bool         `yaml:"durable_meta"`        // 元数据写入后 fsync（默认开启），关闭可换取更少的磁盘同步
+		MetaFlushInterval time.Duration `yaml:"meta_flush_interval"` // 定期把内存中领先于磁盘的进度落盘，0 表示只按字节增量落盘
+		MetaFormat        string        `yaml:"meta_format"`         // 元数据文件格式：json（默认）| binary，见 metacodec.go
+		PartSuffix        string        `yaml:"part_suffix"`         // 状态目录中数据文件的后缀（默认 ".part"）
+		MetaSuffix        string        `yaml:"meta_suffix"`         // 状态目录中元数据文件的后缀（默认随 meta_format：".json" 或 ".meta"）
+
+		UploadTTL        time.Duration `yaml:"upload_ttl"`         // 未完成上传的有效期，0 表示不设置（沿用 gc_max_age）
+		UploadTTLSliding bool          `yaml:"upload_ttl_sliding"` // 收到分片时顺延有效期
+
+		Dedup bool `yaml:"dedup"` // 按 SHA-256 去重完成的文件，相同内容以硬链接/符号链接共享一份数据
+
+		CompressExtensions []string `yaml:"compress_extensions"` // 完成后以 gzip 压缩存储的扩展名（如 .log、.csv），下载时透明解压
+
+		MaxPathBytes    int  `yaml:"max_path_bytes"`    // 相对路径的最大字节数（默认 1024）
+		MaxSegmentBytes int  `yaml:"max_segment_bytes"` // 单个路径段（目录名/文件名）的最大字节数（默认 255）
+		MaxPathDepth    int  `yaml:"max_path_depth"`    // 相对路径最多包含的段数（含文件名，默认 32）
+		PortableNames   bool `yaml:"portable_names"`    // 拒绝在 Windows 等文件系统上非法的名称（保留名、结尾的点/空格、<>:"|?*）
+
+		UploadIDFormat string `yaml:"upload_id_format"` // 新建上传的 upload_id 格式：hex（默认）| base32
+
+		PathTemplate     string `yaml:"path_template"`      // 按模板生成上传的目标路径，如 "{year}/{month}/{filename}"，见 pathtemplate.go
+		PathTemplateMode string `yaml:"path_template_mode"` // replace（默认，模板即完整路径）| prefix（模板作为客户端路径的前缀）
+
+		FileMode string `yaml:"file_mode"` // 完成文件的权限（八进制，默认 "0644"），不受 umask 影响
+		DirMode  string `yaml:"dir_mode"`  // 新建目录的权限（八进制，默认 "0755"）
+
+		Backend string   `yaml:"backend"` // 上传数据的存储后端：local（默认）| s3
+		S3      S3Config `yaml:"s3"`
 	} `yaml:"storage"`
 	Limits struct {
 		MaxChunkBytes int64 `yaml:"max_chunk_bytes"`
 		MaxFileBytes  int64 `yaml:"max_file_bytes"`
+		MaxUploadBps  int64 `yaml:"max_upload_bps"` // 单个上传的带宽上限（字节/秒），0 表示不限
+
+		DiskHeadroomBytes int64 `yaml:"disk_headroom_bytes"` // init 时除 total_size 外额外要求保留的磁盘空间
+		MinFreeInodes     int64 `yaml:"min_free_inodes"`     // init 时要求状态目录所在文件系统至少剩余的 inode 数，0 表示不检查
+
+		MaxConcurrentUploads int64 `yaml:"max_concurrent_uploads"` // 未完成上传数上限，0 表示不限
+		MaxConcurrentChunks  int   `yaml:"max_concurrent_chunks"`  // 全局同时写盘的分片数上限，0 表示不限，见 chunkslots.go
+		StrictChunks         bool  `yaml:"strict_chunks"`          // 要求分片按 chunk_size 对齐
+		ConsistentChunks     bool  `yaml:"consistent_chunks"`      // 要求各分片长度与首个分片一致（末片除外）
+		CopyBufferBytes      int   `yaml:"copy_buffer_bytes"`      // 分片写盘的缓冲区大小（4KB~16MB，默认 1MB）
+
+		TreeScanTimeout  time.Duration `yaml:"tree_scan_timeout"`  // 目录树扫描的最长耗时（默认 5s），超时返回部分结果
+		InitPerMinute    int           `yaml:"init_per_minute"`    // 单个客户端 IP 每分钟最多创建的上传数，0 表示不限
+		MaxJSONBytes     int64         `yaml:"max_json_bytes"`     // JSON 请求体上限（默认 4MB），超出返回 413
+		VerifyOverlaps   bool          `yaml:"verify_overlaps"`    // 分片与已接收区间重叠时比对内容，不一致则拒绝 complete
+		ChunkReadTimeout time.Duration `yaml:"chunk_read_timeout"` // 分片请求体超过该时间没有新数据到达即中止并返回 408（默认 60s）
+
+		ChunkQueueTimeout time.Duration `yaml:"chunk_queue_timeout"` // 分片等待写盘名额的最长时间（默认 30s），超时返回 503
+
+		SkipDuplicateChunks bool `yaml:"skip_duplicate_chunks"` // 分片区间已全部接收时丢弃请求体、不再写盘
+
+		AllowedExtensions   []string `yaml:"allowed_extensions"`    // 只接受这些扩展名（不区分大小写），为空时不限制
+		BlockedExtensions   []string `yaml:"blocked_extensions"`    // 拒绝这些扩展名，优先于 allowed_extensions
+		BlockedContentTypes []string `yaml:"blocked_content_types"` // 首个分片嗅探出这些类型时取消上传
 	} `yaml:"limits"`
+	Auth struct {
+		Keys      []string `yaml:"keys"`       // API Key 列表，为空时不启用鉴权
+		AdminKeys []string `yaml:"admin_keys"` // 可调用 /api/v1/admin/ 管理接口的 key，同时可访问普通接口
+	} `yaml:"auth"`
+	Log struct {
+		Format string `yaml:"format"` // text（默认）| json
+	} `yaml:"log"`
+	Quotas     map[string]int64 `yaml:"quotas"` // 顶层目录 -> 字节上限，如 team-a: 10737418240
+	Encryption struct {
+		Key string `yaml:"key"` // base64 编码的 32 字节密钥，配置后新上传的文件加密落盘
+	} `yaml:"encryption"`
+	Webhook WebhookConfig `yaml:"webhook"` // 上传完成通知，见 webhook.go
+	Events  EventsConfig  `yaml:"events"`  // 完成事件发布到消息队列，见 nats.go
+	Fetch   FetchConfig   `yaml:"fetch"`   // 服务端从 URL 拉取文件，见 fetch.go
 }
 
 type UploadMeta struct {
@@ -51,62 +149,194 @@ type UploadMeta struct {
 	RelPath      string    `json:"rel_path"` // 相对 root_dir 的子路径（可包含子目录）
 	TotalSize    int64     `json:"total_size"`
 	ChunkSize    int64     `json:"chunk_size"`
-	UploadedSize int64     `json:"uploaded_size"`
+	UploadedSize int64     `json:"uploaded_size"` // 从 0 开始连续接收的字节数（续传起点）
 	Completed    bool      `json:"completed"`
+
+	ReceivedRanges [][2]int64        `json:"received_ranges"`               // 已接收的字节区间 [start,end)，已合并
+	ExpiresAt      *time.Time        `json:"expires_at,omitempty"`          // 未完成上传的过期时间，过期后会被 GC 回收
+	ContentType    string            `json:"content_type,omitempty"`        // 按文件扩展名推断的 MIME
+	SniffedType    string            `json:"sniffed_type,omitempty"`        // 按首个分片内容嗅探的 MIME
+	Compressed     bool              `json:"compressed,omitempty"`          // 完成的文件以 gzip 压缩存储为 <路径>.gz
+	BatchID        string            `json:"batch_id,omitempty"`            // 通过 batch init 创建时所属的批次
+	RequestedPath  string            `json:"requested_path,omitempty"`      // 按 storage.path_template 改写路径时客户端原本请求的路径
+	ExpectedSHA256 string            `json:"expected_sha256,omitempty"`     // 客户端声明的整文件摘要（可选）
+	SHA256         string            `json:"sha256,omitempty"`              // 完成时计算出的整文件摘要
+	Streaming      bool              `json:"streaming,omitempty"`           // 流式上传：init 时大小未知，只能顺序追加，complete 时给出最终大小
+	Encrypted      bool              `json:"encrypted,omitempty"`           // .part 与最终文件按块加密存储，见 encrypt.go
+	HashState      []byte            `json:"hash_state,omitempty"`          // 已摘要前缀的 sha256 中间状态（本地后端），见 prefixhash.go
+	HashedSize     int64             `json:"hashed_size,omitempty"`         // hash_state 覆盖的前缀长度
+	ObservedChunk  int64             `json:"observed_chunk_size,omitempty"` // 首个分片的长度（limits.consistent_chunks）
+	ETag           string            `json:"etag,omitempty"`                // 完成时生成的强 ETag（基于 sha256），下载时直接使用
+	OriginalName   string            `json:"original_filename,omitempty"`   // 客户端原始文件名，下载时用于 Content-Disposition
+	CompletedAt    *time.Time        `json:"completed_at,omitempty"`
+	ConflictRanges [][2]int64        `json:"conflict_ranges,omitempty"`  // 重叠写入且内容不一致的区间（limits.verify_overlaps）
+	Metadata       map[string]string `json:"metadata,omitempty"`         // init 时客户端附带的自定义键值对
+	ObjectUploadID string            `json:"object_upload_id,omitempty"` // S3 后端的 multipart upload ID
 }
 
 type Server struct {
+	cfgMu            sync.RWMutex // 保护 cfg，SIGHUP 时会替换其中可热更新的部分
 	cfg              Config
 	rootAbs          string
 	stateAbs         string
-	muByUpload       sync.Map // uploadId -> *sync.Mutex
-	lastSaved        sync.Map // uploadId -> int64 已落盘的 uploaded_size
+	muByUpload       sync.Map     // uploadId -> *uploadLock
+	lastSaved        sync.Map     // uploadId -> int64 已落盘时的已接收字节数，由 saveMeta 更新、loadMeta 读盘时补齐
+	metaCache        sync.Map     // uploadId -> UploadMeta 未完成上传的最新元数据（可能领先于磁盘）
+	limiters         sync.Map     // uploadId -> *rateLimiter 单个上传共享的限速令牌桶
+	speeds           speedTracker // 未完成上传的最近进度样本，见 speed.go
+	fileIndex        sync.Map     // rel_path -> fileEntry 已完成上传的 ETag 与原始文件名，供下载使用
+	pending          pendingIndex // 请求路径 -> 未完成的 upload_id，供 resume 查找
 	staticOn         bool
-	metaSaveInterval int64 // 达到该增量或完成时才落盘一次元数据，减少频繁写盘
+	metaSaveInterval int64          // 达到该增量或完成时才落盘一次元数据，减少频繁写盘
+	metaCodec        metaCodec      // 元数据文件的编码，由 storage.meta_format 决定
+	metaSuffix       string         // 元数据文件的后缀，由 storage.meta_suffix 决定
+	partSuffix       string         // 数据文件的后缀，由 storage.part_suffix 决定
+	finalizeMu       sync.Mutex     // 串行化 complete 时的“目标是否存在 + rename”
+	quota            quotaState     // 顶层目录配额的占用缓存
+	activeUploads    atomic.Int64   // 未完成的上传数，启动时从状态目录扫描得到
+	readOnly         atomic.Bool    // 只读模式，初始为 server.read_only，可由 SIGHUP 或管理接口切换
+	bufPool          sync.Pool      // *[]byte，分片写盘缓冲区，避免并发分片各自分配
+	initLimiter      *ipRateLimiter // 按客户端 IP 限制 init 频率
+	trustedProxies   []netip.Prefix
+	fileMode         os.FileMode // 完成文件与 .part 的权限
+	dirMode          os.FileMode // 上传时新建目录的权限
+	encKey           []byte      // 落盘加密主密钥，未配置时为 nil
+	dedup            *dedupStore // storage.dedup 关闭时为 nil
+	store            Storage     // 上传数据的存储后端，见 storage.go
+	stats            statsCache  // /api/v1/stats 中 root_dir 扫描结果的缓存
+	events           *eventHub
+	notifiers        []notifier    // 完成通知的各个出口，见 notify.go
+	done             chan struct{} // 关闭后通知后台任务（GC 等）退出
+	startedAt        time.Time
+	closeOnce        sync.Once
+	chunkSlots       atomic.Pointer[chunkSlots] // 分片写盘名额，未配置上限时为 nil，见 chunkslots.go
+	fetchClient      *http.Client               // 从 URL 拉取用的客户端，fetch.allowed_hosts 为空时为 nil
 }
 
 func main() {
 	var cfgPath string
+	var showVersion bool
 	flag.StringVar(&cfgPath, "config", "config.yaml", "配置文件路径")
+	flag.BoolVar(&showVersion, "version", false, "打印版本信息后退出")
 	flag.Parse()
+	if showVersion {
+		fmt.Println(versionString())
+		return
+	}
 
 	cfg, err := loadConfig(cfgPath)
 	if err != nil {
 		log.Fatalf("load config failed: %v", err)
 	}
+	if err := setupLogging(cfg.Log.Format); err != nil {
+		log.Fatalf("init logging failed: %v", err)
+	}
 
 	srv, err := newServer(cfg)
 	if err != nil {
 		log.Fatalf("init server failed: %v", err)
 	}
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", srv.handleHealth)
-	mux.HandleFunc("/api/v1/storage/tree", srv.handleStorageTree)
-	mux.HandleFunc("/api/v1/uploads/init", srv.handleInit)
-	mux.HandleFunc("/api/v1/uploads/status", srv.handleStatus)
-	mux.HandleFunc("/api/v1/uploads/chunk", srv.handleChunk)
-	mux.HandleFunc("/api/v1/uploads/complete", srv.handleComplete)
-	mux.HandleFunc("/api/v1/uploads/cancel", srv.handleCancel)
+	go srv.watchReload(cfgPath)
+
+	routes := newRouteTable()
+	routes.handleFunc("/healthz", srv.handleHealth, "GET")
+	routes.handleFunc("/api/v1/storage/tree", srv.handleStorageTree, "GET")
+	routes.handleFunc("/api/v1/storage/stat", srv.handleStorageStat, "GET")
+	routes.handleFunc("/api/v1/storage/ls", srv.handleStorageLs, "GET")
+	routes.handleFunc("/api/v1/uploads/init", srv.handleInit, "POST")
+	routes.handleFunc("/api/v1/uploads/status", srv.handleStatus, "GET", "HEAD")
+	routes.handleFunc("/api/v1/uploads/list", srv.handleList, "GET")
+	routes.handleFunc("/api/v1/uploads/chunk", srv.handleChunk, "PUT", "POST", "HEAD")
+	routes.handleFunc("/api/v1/uploads/verify", srv.handleVerify, "GET")
+	routes.handleFunc("/api/v1/uploads/complete", srv.handleComplete, "POST")
+	routes.handleFunc("/api/v1/uploads/cancel", srv.handleCancel, "POST", "DELETE")
+	routes.handleFunc("/api/v1/uploads/events", srv.handleEvents, "GET")
+	routes.handleFunc("/api/v1/uploads/batch/init", srv.handleBatchInit, "POST")
+	routes.handleFunc("/api/v1/uploads/batch/status", srv.handleBatchStatus, "GET")
+	routes.handleFunc("/api/v1/uploads/from-url", srv.handleFromURL, "POST")
+	// 不带方法的通配模式，init/status 等字面路径优先匹配；方法在 handler 内限制为 DELETE
+	routes.handleFunc("/api/v1/uploads/{upload_id}", srv.handleCancel, "DELETE")
+	routes.handleFunc(tusBasePath, srv.handleTus, "POST", "HEAD", "PATCH", "DELETE")
+	routes.handleFunc("/api/v1/files/download", srv.handleDownload, "GET", "HEAD")
+	routes.handleFunc("/api/v1/files", srv.handleDeleteFile, "DELETE")
+	routes.handleFunc("/api/v1/files/move", srv.handleMoveFile, "POST")
+	routes.handleFunc("/api/v1/files/checksum", srv.handleFileChecksum, "POST")
+	routes.handleFunc("/api/v1/stats", srv.handleStats, "GET")
+	routes.handleFunc(discoveryPath, srv.handleDiscovery, "GET")
+	routes.handleFunc("/api/v1/admin/uploads/{upload_id}/force-complete", srv.handleForceComplete, "POST")
+	routes.handleFunc("/api/v1/admin/uploads/{upload_id}/force-cancel", srv.handleForceCancel, "POST")
+	routes.handleFunc("/api/v1/admin/read-only", srv.handleAdminReadOnly, "GET", "POST")
 	if srv.staticOn {
-		// 使用嵌入的静态文件系统
-		embeddedFS, err := fs.Sub(staticFS, "web/dist")
+		// static.dir 存在时读取磁盘目录，否则使用嵌入的静态文件系统
+		files, from, err := staticFiles(cfg.Static.Dir)
 		if err != nil {
-			log.Printf("failed to create embedded filesystem: %v", err)
+			log.Printf("failed to open static files: %v", err)
 		} else {
-			fileServer := http.FileServer(http.FS(embeddedFS))
-			mux.Handle("/", fileServer)
-			log.Printf("serving embedded static files")
+			routes.handle("/", newSPAHandler(files), "GET", "HEAD")
+			log.Printf("serving static files from %s", from)
+		}
+	}
+
+	if len(cfg.Auth.Keys) > 0 {
+		log.Printf("api key authentication enabled (%d keys)", len(cfg.Auth.Keys))
+	}
+	if cfg.Server.PprofEnable {
+		pprofSrv, err := startPprof(cfg.Server.PprofAddr)
+		if err != nil {
+			log.Fatalf("failed to start pprof server: %v", err)
 		}
+		defer pprofSrv.Close()
+		log.Printf("pprof enabled on http://%s/debug/pprof/", cfg.Server.PprofAddr)
 	}
 
-	log.Printf("go-upload backend listening on %s (root=%s)", cfg.Server.Addr, srv.rootAbs)
+	scheme := "http"
+	if cfg.Server.TLS.CertFile != "" {
+		scheme = "https"
+	}
+	log.Printf("go-upload backend %s listening on %s://%s (root=%s)", version, scheme, cfg.Server.Addr, srv.rootAbs)
 	httpSrv := &http.Server{
 		Addr:              cfg.Server.Addr,
-		Handler:           withCORS(withRequestID(mux)),
+		Handler:           srv.handler(cfg, routes),
 		ReadHeaderTimeout: 10 * time.Second,
 	}
-	log.Fatal(httpSrv.ListenAndServe())
+	if err := serve(httpSrv, srv, cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile, cfg.Server.ShutdownTimeout); err != nil {
+		log.Fatalf("server error: %v", err)
+	}
+	log.Printf("go-upload backend stopped")
+}
+
+// serve 运行 HTTP 服务直到收到 SIGINT/SIGTERM，然后在 grace 时间内等待进行中的请求
+// （包括正在写入的分片及其元数据落盘）结束，再停止后台任务。
+// certFile 非空时以 HTTPS 方式监听。
+func serve(httpSrv *http.Server, srv *Server, certFile, keyFile string, grace time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Shutdown 不会中断长连接，先让 SSE 事件流自行结束
+	httpSrv.RegisterOnShutdown(srv.events.shutdown)
+
+	errCh := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			errCh <- httpSrv.ListenAndServeTLS(certFile, keyFile)
+			return
+		}
+		errCh <- httpSrv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		srv.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down, waiting up to %s for in-flight requests", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := httpSrv.Shutdown(shutdownCtx)
+	srv.Close()
+	return err
 }
 
 func loadConfig(path string) (Config, error) {
@@ -121,18 +351,197 @@ func loadConfig(path string) (Config, error) {
 	if strings.TrimSpace(cfg.Server.Addr) == "" {
 		cfg.Server.Addr = "127.0.0.1:8088"
 	}
-	if strings.TrimSpace(cfg.Static.Dir) == "" {
-		cfg.Static.Dir = "../web/dist"
+	if cfg.Server.PprofAddr = strings.TrimSpace(cfg.Server.PprofAddr); cfg.Server.PprofAddr == "" {
+		cfg.Server.PprofAddr = defaultPprofAddr
+	}
+	if cfg.Server.GzipMinBytes <= 0 {
+		cfg.Server.GzipMinBytes = defaultGzipMinBytes
 	}
+	cfg.Static.Dir = strings.TrimSpace(cfg.Static.Dir)
+	cfg.Auth.Keys = trimKeys(cfg.Auth.Keys)
+	cfg.Auth.AdminKeys = trimKeys(cfg.Auth.AdminKeys)
 	if strings.TrimSpace(cfg.Storage.RootDir) == "" {
 		cfg.Storage.RootDir = "../uploads"
 	}
 	if strings.TrimSpace(cfg.Storage.StateDir) == "" {
 		cfg.Storage.StateDir = ".go-upload_state"
 	}
+	switch cfg.Storage.Overwrite = strings.TrimSpace(cfg.Storage.Overwrite); cfg.Storage.Overwrite {
+	case "":
+		cfg.Storage.Overwrite = overwriteReplace
+	case overwriteReplace, overwriteReject, overwriteRename:
+	default:
+		return Config{}, fmt.Errorf("invalid storage.overwrite %q", cfg.Storage.Overwrite)
+	}
+	cfg.Server.TLS.CertFile = strings.TrimSpace(cfg.Server.TLS.CertFile)
+	cfg.Server.TLS.KeyFile = strings.TrimSpace(cfg.Server.TLS.KeyFile)
+	if (cfg.Server.TLS.CertFile == "") != (cfg.Server.TLS.KeyFile == "") {
+		return Config{}, fmt.Errorf("server.tls.cert_file and server.tls.key_file must be set together")
+	}
+	for _, f := range []string{cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return Config{}, fmt.Errorf("tls file not accessible: %w", err)
+		}
+	}
+	if cfg.Server.ShutdownTimeout <= 0 {
+		cfg.Server.ShutdownTimeout = 30 * time.Second
+	}
+	if cfg.Storage.DurableMeta == nil {
+		durable := true
+		cfg.Storage.DurableMeta = &durable
+	}
+	if cfg.Storage.GCMaxAge <= 0 {
+		cfg.Storage.GCMaxAge = 7 * 24 * time.Hour
+	}
 	if cfg.Limits.MaxChunkBytes <= 0 {
 		cfg.Limits.MaxChunkBytes = 128 * 1024 * 1024
 	}
+	if cfg.Limits.CopyBufferBytes == 0 {
+		cfg.Limits.CopyBufferBytes = 1 << 20
+	}
+	if cfg.Limits.CopyBufferBytes < 4<<10 || cfg.Limits.CopyBufferBytes > 16<<20 {
+		return Config{}, fmt.Errorf("limits.copy_buffer_bytes must be between 4KB and 16MB, got %d", cfg.Limits.CopyBufferBytes)
+	}
+	if cfg.Limits.InitPerMinute < 0 {
+		cfg.Limits.InitPerMinute = 0
+	}
+	if _, err := parseTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Server.CORS.normalize(); err != nil {
+		return Config{}, err
+	}
+	if _, err := parseFileMode(cfg.Storage.FileMode, defaultFileMode); err != nil {
+		return Config{}, fmt.Errorf("invalid storage.file_mode: %w", err)
+	}
+	if _, err := parseFileMode(cfg.Storage.DirMode, defaultDirMode); err != nil {
+		return Config{}, fmt.Errorf("invalid storage.dir_mode: %w", err)
+	}
+	switch cfg.Storage.MetaFormat = strings.TrimSpace(cfg.Storage.MetaFormat); cfg.Storage.MetaFormat {
+	case "":
+		cfg.Storage.MetaFormat = metaFormatJSON
+	case metaFormatJSON, metaFormatBinary:
+	default:
+		return Config{}, fmt.Errorf("invalid storage.meta_format %q", cfg.Storage.MetaFormat)
+	}
+	if cfg.Storage.PartSuffix = strings.TrimSpace(cfg.Storage.PartSuffix); cfg.Storage.PartSuffix == "" {
+		cfg.Storage.PartSuffix = defaultPartSuffix
+	}
+	if cfg.Storage.MetaSuffix = strings.TrimSpace(cfg.Storage.MetaSuffix); cfg.Storage.MetaSuffix == "" {
+		cfg.Storage.MetaSuffix = metaCodecs[cfg.Storage.MetaFormat].ext
+	}
+	if err := checkStateSuffixes(cfg.Storage.PartSuffix, cfg.Storage.MetaSuffix); err != nil {
+		return Config{}, err
+	}
+	switch cfg.Storage.UploadIDFormat = strings.TrimSpace(cfg.Storage.UploadIDFormat); cfg.Storage.UploadIDFormat {
+	case "":
+		cfg.Storage.UploadIDFormat = uploadIDHex
+	case uploadIDHex, uploadIDBase32:
+	default:
+		return Config{}, fmt.Errorf("invalid storage.upload_id_format %q", cfg.Storage.UploadIDFormat)
+	}
+	cfg.Storage.PathTemplate = strings.TrimSpace(cfg.Storage.PathTemplate)
+	switch cfg.Storage.PathTemplateMode = strings.TrimSpace(cfg.Storage.PathTemplateMode); cfg.Storage.PathTemplateMode {
+	case "":
+		cfg.Storage.PathTemplateMode = pathTemplateReplace
+	case pathTemplateReplace, pathTemplatePrefix:
+	default:
+		return Config{}, fmt.Errorf("invalid storage.path_template_mode %q", cfg.Storage.PathTemplateMode)
+	}
+	if cfg.Storage.PathTemplate != "" {
+		if err := validatePathTemplate(cfg.Storage.PathTemplate, cfg.Storage.PathTemplateMode); err != nil {
+			return Config{}, fmt.Errorf("invalid storage.path_template: %w", err)
+		}
+	}
+	if cfg.Storage.MaxPathBytes <= 0 {
+		cfg.Storage.MaxPathBytes = 1024
+	}
+	if cfg.Storage.MaxSegmentBytes <= 0 {
+		cfg.Storage.MaxSegmentBytes = 255
+	}
+	if cfg.Storage.MaxPathDepth <= 0 {
+		cfg.Storage.MaxPathDepth = 32
+	}
+	if cfg.Limits.MaxJSONBytes <= 0 {
+		cfg.Limits.MaxJSONBytes = 4 << 20
+	}
+	cfg.Limits.AllowedExtensions = normalizeExtensions(cfg.Limits.AllowedExtensions)
+	cfg.Limits.BlockedExtensions = normalizeExtensions(cfg.Limits.BlockedExtensions)
+	cfg.Limits.BlockedContentTypes = normalizeContentTypes(cfg.Limits.BlockedContentTypes)
+	if cfg.Limits.ChunkReadTimeout <= 0 {
+		cfg.Limits.ChunkReadTimeout = 60 * time.Second
+	}
+	if cfg.Limits.MaxConcurrentChunks < 0 {
+		cfg.Limits.MaxConcurrentChunks = 0
+	}
+	if cfg.Limits.ChunkQueueTimeout <= 0 {
+		cfg.Limits.ChunkQueueTimeout = defaultChunkQueueTimeout
+	}
+	if cfg.Limits.TreeScanTimeout <= 0 {
+		cfg.Limits.TreeScanTimeout = 5 * time.Second
+	}
+	if cfg.Limits.DiskHeadroomBytes < 0 {
+		cfg.Limits.DiskHeadroomBytes = 0
+	}
+	if cfg.Limits.MinFreeInodes < 0 {
+		cfg.Limits.MinFreeInodes = 0
+	}
+	if cfg.Quotas, err = normalizeQuotas(cfg.Quotas); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Webhook.normalize(); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Events.normalize(); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Fetch.normalize(); err != nil {
+		return Config{}, err
+	}
+	cfg.Encryption.Key = strings.TrimSpace(cfg.Encryption.Key)
+	if _, err := parseEncryptionKey(cfg.Encryption.Key); err != nil {
+		return Config{}, err
+	}
+	cfg.Storage.CompressExtensions = normalizeExtensions(cfg.Storage.CompressExtensions)
+	// 密文无法压缩，读取时也只能解密或解压其一
+	if cfg.Encryption.Key != "" && len(cfg.Storage.CompressExtensions) > 0 {
+		return Config{}, fmt.Errorf("storage.compress_extensions is not supported with encryption")
+	}
+	// 加密文件头按 16 字节记录十六进制 upload_id，用于派生数据密钥
+	if cfg.Encryption.Key != "" && cfg.Storage.UploadIDFormat == uploadIDBase32 {
+		return Config{}, fmt.Errorf("storage.upload_id_format base32 is not supported with encryption")
+	}
+	switch cfg.Storage.Backend = strings.TrimSpace(cfg.Storage.Backend); cfg.Storage.Backend {
+	case "":
+		cfg.Storage.Backend = backendLocal
+	case backendLocal:
+	case backendS3:
+		if err := cfg.Storage.S3.normalize(); err != nil {
+			return Config{}, err
+		}
+		// 以下功能依赖对本地 .part 或 root_dir 的读写，无法用于 S3
+		switch {
+		case cfg.Encryption.Key != "":
+			return Config{}, fmt.Errorf("encryption is not supported with storage.backend s3")
+		case cfg.Storage.Dedup:
+			return Config{}, fmt.Errorf("storage.dedup is not supported with storage.backend s3")
+		case len(cfg.Storage.CompressExtensions) > 0:
+			return Config{}, fmt.Errorf("storage.compress_extensions is not supported with storage.backend s3")
+		case cfg.Storage.Overwrite == overwriteRename:
+			return Config{}, fmt.Errorf("storage.overwrite rename is not supported with storage.backend s3")
+		case cfg.Limits.VerifyOverlaps:
+			return Config{}, fmt.Errorf("limits.verify_overlaps is not supported with storage.backend s3")
+		case len(cfg.Quotas) > 0:
+			return Config{}, fmt.Errorf("quotas are not supported with storage.backend s3")
+		}
+		// 每个分片对应一个 part，分片必须按 chunk_size 对齐
+		cfg.Limits.StrictChunks = true
+	default:
+		return Config{}, fmt.Errorf("invalid storage.backend %q", cfg.Storage.Backend)
+	}
 	return cfg, nil
 }
 
@@ -141,7 +550,11 @@ func newServer(cfg Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	// state_dir 为绝对路径时可以放在 root_dir 之外（例如更快的临时盘），否则相对 root_dir
 	stateAbs := filepath.Join(rootAbs, cfg.Storage.StateDir)
+	if filepath.IsAbs(cfg.Storage.StateDir) {
+		stateAbs = filepath.Clean(cfg.Storage.StateDir)
+	}
 	if err := os.MkdirAll(rootAbs, 0o755); err != nil {
 		return nil, err
 	}
@@ -152,20 +565,88 @@ func newServer(cfg Config) (*Server, error) {
 		cfg:              cfg,
 		rootAbs:          rootAbs,
 		stateAbs:         stateAbs,
+		metaCodec:        metaCodecs[cfg.Storage.MetaFormat],
+		metaSuffix:       cfg.Storage.MetaSuffix,
+		partSuffix:       cfg.Storage.PartSuffix,
 		metaSaveInterval: maxInt64(64*1024*1024, cfg.Limits.MaxChunkBytes/2),
-	}
-
-	// 配置静态资源服务，使用嵌入的文件系统
+		done:             make(chan struct{}),
+		startedAt:        time.Now(),
+		initLimiter:      newIPRateLimiter(),
+		events:           newEventHub(),
+	}
+	s.resizeChunkSlots(cfg.Limits.MaxConcurrentChunks)
+	s.fetchClient = newFetchClient(cfg.Fetch)
+	// loadConfig 已校验过格式
+	s.trustedProxies, _ = parseTrustedProxies(cfg.Server.TrustedProxies)
+	s.encKey, _ = parseEncryptionKey(cfg.Encryption.Key)
+	s.fileMode, _ = parseFileMode(cfg.Storage.FileMode, defaultFileMode)
+	s.dirMode, _ = parseFileMode(cfg.Storage.DirMode, defaultDirMode)
+	s.quota.usage = map[string]quotaUsage{}
+	s.bufPool.New = func() any {
+		// 热更新 copy_buffer_bytes 后新分配的缓冲区使用新大小，池中旧缓冲区照常可用
+		b := make([]byte, s.config().Limits.CopyBufferBytes)
+		return &b
+	}
+
+	// 配置静态资源服务，默认使用嵌入的文件系统
 	if cfg.Static.Enable {
 		s.staticOn = true
-		log.Printf("static files enabled, using embedded filesystem")
+		log.Printf("static files enabled")
+	}
+
+	if s.store, err = s.newStorage(cfg); err != nil {
+		return nil, err
+	}
+	if err := s.resetSpoolDir(); err != nil {
+		return nil, err
+	}
+	if metas, parts, err := s.migrateStateLayout(cfg.Storage.MetaFormat); err != nil {
+		return nil, fmt.Errorf("migrate state dir: %w", err)
+	} else if metas > 0 || parts > 0 {
+		log.Printf("migrated state dir to %s format (meta_suffix %q, part_suffix %q): %d metadata files, %d part files",
+			cfg.Storage.MetaFormat, s.metaSuffix, s.partSuffix, metas, parts)
+	}
+	if err := s.seedFromState(); err != nil {
+		return nil, err
+	}
+	s.notifiers = s.newNotifiers(cfg)
+	s.readOnly.Store(cfg.Server.ReadOnly)
+	if cfg.Storage.Dedup {
+		if s.dedup, err = s.openDedupStore(); err != nil {
+			return nil, fmt.Errorf("open dedup store: %w", err)
+		}
+	}
+
+	go s.runIPLimiterEviction()
+	if cfg.Storage.GCInterval > 0 {
+		go s.runGC(cfg.Storage.GCInterval, cfg.Storage.GCMaxAge)
+		log.Printf("gc enabled: interval=%s max_age=%s", cfg.Storage.GCInterval, cfg.Storage.GCMaxAge)
+	}
+	if cfg.Storage.MetaFlushInterval > 0 {
+		go s.runMetaFlusher(cfg.Storage.MetaFlushInterval)
+		log.Printf("meta flush enabled: interval=%s", cfg.Storage.MetaFlushInterval)
 	}
 
 	return s, nil
 }
 
+// Close 停止后台任务，并把内存中尚未落盘的上传进度写回磁盘。
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.flushMetas()
+	})
+}
+
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	writeJSON(w, http.StatusOK, map[string]any{
+		"ok":               true,
+		"version":          version,
+		"commit":           commit,
+		"build_time":       buildTime,
+		"uptime_seconds":   int64(time.Since(s.startedAt).Seconds()),
+		"uploads_inflight": s.activeUploads.Load(),
+	})
 }
 
 type DirNode struct {
@@ -175,14 +656,19 @@ type DirNode struct {
 }
 
 type treeResp struct {
-	Root DirNode `json:"root"`
+	Root      DirNode `json:"root"`
+	Truncated bool    `json:"truncated,omitempty"` // 扫描超过 tree_scan_timeout，返回的是部分目录树
 }
 
-// GET /api/v1/storage/tree?max_depth=3&max_entries=5000
+// GET /api/v1/storage/tree?max_depth=3&max_entries=5000[&filter=*.log][&name_contains=2024]
 // 返回 root_dir 下的目录结构（不含文件），用于前端目录选择器。
+// filter（glob）与 name_contains（不区分大小写）按目录名过滤，不匹配的目录连同其子树一起跳过，不再深入扫描。
 func (s *Server) handleStorageTree(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if !s.localOnly(w) {
 		return
 	}
 
@@ -199,6 +685,29 @@ func (s *Server) handleStorageTree(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	filter := r.URL.Query().Get("filter")
+	if filter != "" {
+		if _, err := filepath.Match(filter, ""); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_filter", "invalid filter")
+			return
+		}
+	}
+	nameContains := strings.ToLower(r.URL.Query().Get("name_contains"))
+	keep := func(name string) bool {
+		if filter != "" {
+			if ok, _ := filepath.Match(filter, name); !ok {
+				return false
+			}
+		}
+		return nameContains == "" || strings.Contains(strings.ToLower(name), nameContains)
+	}
+
+	// 目录很多时扫描可能很久：超过期限或客户端断开就停止深入，返回已扫描的部分
+	cfg := s.config()
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.Limits.TreeScanTimeout)
+	defer cancel()
+	truncated := false
+
 	var entries int64
 	var build func(absDir, relDir string, depth int64) (DirNode, error)
 	build = func(absDir, relDir string, depth int64) (DirNode, error) {
@@ -226,19 +735,20 @@ func (s *Server) handleStorageTree(w http.ResponseWriter, r *http.Request) {
 			if entries >= maxEntries {
 				break
 			}
-			if !de.IsDir() {
-				continue
+			if ctx.Err() != nil {
+				truncated = true
+				break
 			}
-			// 跳过状态目录，避免暴露内部文件
-			if relDir == "" && de.Name() == s.cfg.Storage.StateDir {
+			if !de.IsDir() || !keep(de.Name()) {
 				continue
 			}
-			if de.Name() == s.cfg.Storage.StateDir {
+			childAbs := filepath.Join(absDir, de.Name())
+			// 跳过状态目录，避免暴露内部文件
+			if childAbs == s.stateAbs {
 				continue
 			}
 			entries++
 
-			childAbs := filepath.Join(absDir, de.Name())
 			childRel := de.Name()
 			if relDir != "" {
 				childRel = filepath.Join(relDir, de.Name())
@@ -260,363 +770,1842 @@ func (s *Server) handleStorageTree(w http.ResponseWriter, r *http.Request) {
 
 	rootNode, err := build(s.rootAbs, "", 0)
 	if err != nil {
-		http.Error(w, "scan failed", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "scan failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, treeResp{Root: rootNode, Truncated: truncated})
+}
+
+type storageStatResp struct {
+	FS        *diskUsage `json:"fs"` // 平台不支持时为 null
+	UsedBytes int64      `json:"used_bytes"`
+	Files     int64      `json:"files"`
+}
+
+// GET /api/v1/storage/stat
+// 返回 root_dir 所在文件系统的容量，以及 root_dir 下已完成文件（不含状态目录）的总大小。
+func (s *Server) handleStorageStat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if !s.localOnly(w) {
 		return
 	}
-	writeJSON(w, http.StatusOK, treeResp{Root: rootNode})
+	var resp storageStatResp
+	du, err := diskStat(s.rootAbs)
+	switch {
+	case err == nil:
+		resp.FS = &du
+	case errors.Is(err, errDiskStatUnsupported):
+	default:
+		writeError(w, http.StatusInternalServerError, "internal_error", "stat failed")
+		return
+	}
+	if resp.Files, resp.UsedBytes, err = s.scanRootFiles(); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "scan failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// scanRootFiles 遍历 root_dir（不含状态目录），返回普通文件的个数与总大小。
+func (s *Server) scanRootFiles() (files, bytes int64, err error) {
+	err = filepath.WalkDir(s.rootAbs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// 无权限等单个目录错误不致命：跳过
+			if d != nil && d.IsDir() && path != s.rootAbs {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if path == s.stateAbs {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			bytes += info.Size()
+			files++
+		}
+		return nil
+	})
+	return files, bytes, err
 }
 
 // ===== API 协议 =====
 //
 // 1) Init
 // POST /api/v1/uploads/init
-// body: { "filename": "a.bin", "path": "subdir/a.bin", "total_size": 123, "chunk_size": 5242880 }
-// resp: { "upload_id": "...", "uploaded_size": 0 }
+// body: { "filename": "a.bin", "path": "subdir/a.bin", "total_size": 123, "chunk_size": 5242880, "sha256": "<可选>" }
+// resp: { "upload_id": "...", "uploaded_size": 0, "expires_at": "<配置了 upload_ttl 时返回>" }
+// 带 "resume": true 且命中未完成的同路径上传时返回该会话，附带 "resumed": true 与 "missing_ranges"。
+// total_size 为 0 表示流式上传：大小未知，分片只能从 uploaded_size 处顺序追加。
 //
 // 2) Status
 // GET /api/v1/uploads/status?upload_id=...
-// resp: UploadMeta
+// resp: UploadMeta + { "bytes_per_second", "eta_seconds" }（按最近进度估算，样本不足时为 null）
+//
+// 2.1) List
+// GET /api/v1/uploads/list?limit=50&offset=0&completed=false&order=desc
+// resp: { "total": <int>, "items": [UploadMeta...] }
 //
 // 3) Chunk
-// PUT /api/v1/uploads/chunk?upload_id=...
+// PUT|POST /api/v1/uploads/chunk?upload_id=...
+// HEAD 时不带请求体，只通过 Upload-Offset / X-Uploaded-Size 响应头返回 uploaded_size
 // headers:
 // - X-Chunk-Offset: <int64>  // 本分片在文件中的起始偏移
+// - 或 Content-Range: bytes <start>-<end>/<total|*>  // 标准写法，与 X-Chunk-Offset 同时出现时必须一致
 // - Content-Length: <bytes>
+// - X-Chunk-Checksum: <hex sha256>  // 可选，分片内容校验，不匹配返回 422
+// - Content-Encoding: gzip|deflate + X-Chunk-Raw-Length: <解压后字节数>  // 可选，压缩分片
 // body: raw bytes
 // resp: { "uploaded_size": <int64> }
 //
+// 3.1) Verify
+// GET /api/v1/uploads/verify?upload_id=...&checksum=true
+// resp: { "covered": <bool>, "missing_ranges": [...], "sha256": "<[0, uploaded_size) 的摘要>", "ready": <bool>, ... }
+// 只检查不提交，见 verify.go。
+//
 // 4) Complete
-// POST /api/v1/uploads/complete?upload_id=...
-// resp: { "completed": true, "path": "<final_abs_path>" }
+// POST /api/v1/uploads/complete?upload_id=...&total_size=<流式上传必填>
+// resp: { "completed": true, "path": "<final_abs_path>", "sha256": "<hex>" }
+// 若 init 时提供了 sha256 且与实际内容不符，返回 409 且保留 .part 不做 rename。
+// 可选 If-Match: <目标现有文件的 ETag>，不匹配时返回 412，同样保留 .part。
+// 可选请求体 { "path": "<新的相对路径>" } 改写最终路径（仅本地存储）。
 
 type initReq struct {
 	Filename  string `json:"filename"`
 	Path      string `json:"path"` // 用户期望的“上传路径”，服务端会约束到 root_dir 内
 	TotalSize int64  `json:"total_size"`
 	ChunkSize int64  `json:"chunk_size"`
+	SHA256    string `json:"sha256"` // 可选：整文件 SHA-256（hex），complete 时校验
+
+	// 可选：客户端的原始文件名。path 可以是服务端生成的安全路径（如 <uuid>/original），
+	// 下载时以该名称作为 Content-Disposition 的文件名
+	OriginalFilename string `json:"original_filename"`
+
+	// 可选：为 true 时若已有指向同一路径、参数相同的未完成上传，直接返回该会话而不新建
+	Resume bool `json:"resume"`
+
+	// 可选：应用自定义的键值对（如 user_id、project），原样保存在元数据中，值必须是字符串
+	Metadata map[string]string `json:"metadata"`
+
+	// 可选：为 true 时只做校验（路径、大小、配额、磁盘空间、overwrite 策略），不创建会话
+	DryRun bool `json:"dry_run"`
+
+	batchID string // 由 batch init 创建时所属的批次
 }
 
 type initResp struct {
-	UploadID     string `json:"upload_id"`
-	UploadedSize int64  `json:"uploaded_size"`
+	UploadID     string     `json:"upload_id"`
+	UploadedSize int64      `json:"uploaded_size"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+
+	QuotaRemaining *int64 `json:"quota_remaining,omitempty"` // 目标目录配置了配额时，本次上传之后的剩余额度
+
+	// 按 total_size 推荐的分片大小（约 1000 片），仅供参考，不影响分片校验
+	RecommendedChunkSize int64 `json:"recommended_chunk_size,omitempty"`
+
+	// resume 命中已有会话时返回：客户端据此只补发缺失的区间（最多 100 个）
+	Resumed       bool       `json:"resumed,omitempty"`
+	MissingRanges [][2]int64 `json:"missing_ranges,omitempty"`
 }
 
 func (s *Server) handleInit(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
 		return
 	}
-	var req initReq
-	if err := readJSON(r, &req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !s.writable(w) || !s.allowInit(w, r) {
 		return
 	}
-	req.Filename = strings.TrimSpace(req.Filename)
-	req.Path = strings.TrimSpace(req.Path)
-	if req.Path == "" {
-		req.Path = req.Filename
-	}
-	if req.Filename == "" {
-		req.Filename = filepath.Base(req.Path)
-	}
-	if req.TotalSize <= 0 {
-		http.Error(w, "total_size must be > 0", http.StatusBadRequest)
+	var req initReq
+	if err := s.readJSON(r, &req); err != nil {
+		writeHTTPError(w, err)
 		return
 	}
-	if s.cfg.Limits.MaxFileBytes > 0 && req.TotalSize > s.cfg.Limits.MaxFileBytes {
-		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+	if req.DryRun {
+		s.handleInitDryRun(w, r, req)
 		return
 	}
-	if req.ChunkSize <= 0 || req.ChunkSize > s.cfg.Limits.MaxChunkBytes {
-		http.Error(w, "invalid chunk_size", http.StatusBadRequest)
-		return
+	if req.Resume {
+		if meta, ok := s.findResumable(req); ok {
+			missing := missingRanges(meta.ReceivedRanges, meta.TotalSize)
+			reqLogger(r).Info("upload resumed", "upload_id", meta.UploadID, "rel_path", meta.RelPath, "uploaded_size", meta.UploadedSize)
+			w.Header().Set("Location", uploadStatusPath(meta.UploadID))
+			writeJSON(w, http.StatusOK, initResp{
+				UploadID:      meta.UploadID,
+				UploadedSize:  meta.UploadedSize,
+				ExpiresAt:     meta.ExpiresAt,
+				Resumed:       true,
+				MissingRanges: missing[:min(len(missing), 100)],
+			})
+			return
+		}
 	}
-
-	rel, err := sanitizeRelPath(req.Path)
+	meta, quotaLeft, err := s.newUpload(req)
 	if err != nil {
-		http.Error(w, "invalid path", http.StatusBadRequest)
+		writeHTTPError(w, err)
 		return
 	}
-	// 强制使用传入 filename 的扩展名猜 MIME（可选：仅用于展示/未来扩展）
-	_ = mime.TypeByExtension(filepath.Ext(req.Filename))
 
-	uploadID := newUploadID()
-	meta := UploadMeta{
-		UploadID:     uploadID,
-		CreatedAt:    time.Now().UTC(),
-		Filename:     req.Filename,
-		RelPath:      rel,
-		TotalSize:    req.TotalSize,
-		ChunkSize:    req.ChunkSize,
-		UploadedSize: 0,
-		Completed:    false,
-	}
+	reqLogger(r).Info("upload initialized", "upload_id", meta.UploadID, "rel_path", meta.RelPath, "total_size", meta.TotalSize,
+		"duration_ms", time.Since(start).Milliseconds())
+	// 新建的会话按 REST 习惯返回 201 与指向该资源的 Location，响应体与此前相同
+	w.Header().Set("Location", uploadStatusPath(meta.UploadID))
+	writeJSON(w, http.StatusCreated, initResp{
+		UploadID:             meta.UploadID,
+		UploadedSize:         0,
+		ExpiresAt:            meta.ExpiresAt,
+		QuotaRemaining:       quotaLeft,
+		RecommendedChunkSize: s.recommendedChunkSize(meta),
+	})
+}
 
-	if err := s.saveMeta(meta); err != nil {
-		http.Error(w, "save meta failed", http.StatusInternalServerError)
-		return
-	}
-	// 预创建 .part 文件并设置长度，便于 WriteAt 随机写入
-	partPath := s.partPath(uploadID)
-	if err := ensureParentDir(partPath); err != nil {
-		http.Error(w, "mkdir failed", http.StatusInternalServerError)
+// uploadStatusPath 返回上传会话的资源地址（查询进度接口）。
+func uploadStatusPath(uploadID string) string {
+	return "/api/v1/uploads/status?upload_id=" + uploadID
+}
+
+// handleInitDryRun 执行 init 的全部校验但不创建会话，返回解析后的目标路径；
+// rename 策略下 final_path 是按当前状态会使用的名称，真正 complete 时可能不同。
+func (s *Server) handleInitDryRun(w http.ResponseWriter, r *http.Request, req initReq) {
+	meta, quotaLeft, err := s.newUpload(req)
+	if err != nil {
+		writeHTTPError(w, err)
 		return
 	}
-	f, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0o644)
+	final, err := s.store.Preflight(meta)
 	if err != nil {
-		http.Error(w, "create part failed", http.StatusInternalServerError)
+		var he *httpError
+		switch {
+		case errors.Is(err, errDestExists):
+			writeError(w, http.StatusConflict, "destination_exists", "destination exists")
+		case errors.As(err, &he):
+			writeHTTPError(w, err)
+		default:
+			reqLogger(r).Error("init dry run failed", "rel_path", meta.RelPath, "error", err)
+			writeError(w, http.StatusBadGateway, "backend_error", "storage backend error")
+		}
 		return
 	}
-	defer f.Close()
-	if err := f.Truncate(req.TotalSize); err != nil {
-		http.Error(w, "truncate failed", http.StatusInternalServerError)
-		return
+	resp := map[string]any{
+		"dry_run":                true,
+		"rel_path":               meta.RelPath,
+		"final_path":             final,
+		"recommended_chunk_size": s.recommendedChunkSize(meta),
 	}
-
-	writeJSON(w, http.StatusOK, initResp{UploadID: uploadID, UploadedSize: 0})
+	if quotaLeft != nil {
+		resp["quota_remaining"] = *quotaLeft
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
-func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	uploadID := strings.TrimSpace(r.URL.Query().Get("upload_id"))
-	if uploadID == "" {
-		http.Error(w, "missing upload_id", http.StatusBadRequest)
-		return
-	}
-	meta, err := s.loadMeta(uploadID)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			http.Error(w, "not found", http.StatusNotFound)
-			return
+// findResumable 查找可续传的上传：未完成、未过期，且目标路径、total_size、chunk_size、sha256 与本次 init 一致；
+// 有多个时取最近创建的。流式上传没有固定大小，不参与匹配。
+func (s *Server) findResumable(req initReq) (UploadMeta, bool) {
+	p := strings.TrimSpace(req.Path)
+	if p == "" {
+		p = strings.TrimSpace(req.Filename)
+	}
+	rel, err := sanitizeRelPath(p)
+	if err != nil || req.TotalSize <= 0 {
+		return UploadMeta{}, false
+	}
+	sum := strings.ToLower(strings.TrimSpace(req.SHA256))
+	now := time.Now()
+	var found UploadMeta
+	ok := false
+	// 只检查同一请求路径下的未完成上传，不必扫描整个状态目录
+	for _, id := range s.pending.ids(rel) {
+		meta, err := s.loadMeta(id)
+		if err != nil || meta.Completed || meta.Streaming {
+			continue
+		}
+		if requested := cmp.Or(meta.RequestedPath, meta.RelPath); requested != rel {
+			continue
+		}
+		if meta.TotalSize != req.TotalSize || meta.ChunkSize != req.ChunkSize || meta.ExpectedSHA256 != sum {
+			continue
+		}
+		if meta.Encrypted != (s.encKey != nil) || isExpired(meta, now, s.config().Storage.GCMaxAge) {
+			continue
+		}
+		if !ok || meta.CreatedAt.After(found.CreatedAt) {
+			found, ok = meta, true
 		}
-		http.Error(w, "load failed", http.StatusInternalServerError)
-		return
 	}
-	writeJSON(w, http.StatusOK, meta)
+	return found, ok
 }
 
-func (s *Server) handleChunk(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPut {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
+// pendingIndex 按请求路径（未改写时即 rel_path）索引未完成的上传，供 resume 查找，零值可用。
+// 启动时由 seedFromState 填充，之后随 saveMeta / forgetMeta 更新；索引只用于缩小范围，命中后仍以元数据为准。
+type pendingIndex struct {
+	mu     sync.Mutex
+	byPath map[string]map[string]struct{} // 请求路径 -> upload_id 集合
+	pathOf map[string]string              // upload_id -> 请求路径
+}
+
+// add 记录未完成的上传，请求路径变化时移到新路径下。
+func (x *pendingIndex) add(meta UploadMeta) {
+	path := cmp.Or(meta.RequestedPath, meta.RelPath)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if old, ok := x.pathOf[meta.UploadID]; ok {
+		if old == path {
+			return
+		}
+		x.removeLocked(meta.UploadID)
 	}
-	uploadID := strings.TrimSpace(r.URL.Query().Get("upload_id"))
-	if uploadID == "" {
-		http.Error(w, "missing upload_id", http.StatusBadRequest)
-		return
+	if x.byPath == nil {
+		x.byPath, x.pathOf = map[string]map[string]struct{}{}, map[string]string{}
 	}
-	offsetStr := strings.TrimSpace(r.Header.Get("X-Chunk-Offset"))
-	if offsetStr == "" {
-		http.Error(w, "missing X-Chunk-Offset", http.StatusBadRequest)
-		return
+	ids := x.byPath[path]
+	if ids == nil {
+		ids = map[string]struct{}{}
+		x.byPath[path] = ids
 	}
-	offset, err := strconv.ParseInt(offsetStr, 10, 64)
-	if err != nil || offset < 0 {
-		http.Error(w, "invalid offset", http.StatusBadRequest)
+	ids[meta.UploadID] = struct{}{}
+	x.pathOf[meta.UploadID] = path
+}
+
+// remove 在上传完成、取消或被回收时移除。
+func (x *pendingIndex) remove(uploadID string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(uploadID)
+}
+
+func (x *pendingIndex) removeLocked(uploadID string) {
+	path, ok := x.pathOf[uploadID]
+	if !ok {
 		return
 	}
-	chunkLen := r.ContentLength
-	if chunkLen <= 0 {
-		http.Error(w, "missing/invalid Content-Length", http.StatusBadRequest)
-		return
+	delete(x.pathOf, uploadID)
+	if ids := x.byPath[path]; len(ids) <= 1 {
+		delete(x.byPath, path)
+	} else {
+		delete(ids, uploadID)
 	}
-	if chunkLen > s.cfg.Limits.MaxChunkBytes {
-		http.Error(w, "chunk too large", http.StatusRequestEntityTooLarge)
-		return
+}
+
+// ids 返回请求路径为 path 的未完成上传。
+func (x *pendingIndex) ids(path string) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	ids := make([]string, 0, len(x.byPath[path]))
+	for id := range x.byPath[path] {
+		ids = append(ids, id)
 	}
+	return ids
+}
 
-	mu := s.lock(uploadID)
-	mu.Lock()
-	defer mu.Unlock()
+// 自定义元数据的上限：条目数、单个键 / 值的字节数，以及所有键值的总字节数
+const (
+	maxMetadataEntries    = 32
+	maxMetadataKeyBytes   = 64
+	maxMetadataValueBytes = 1024
+	maxMetadataTotalBytes = 8 << 10
+)
 
-	meta, err := s.loadMeta(uploadID)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			http.Error(w, "not found", http.StatusNotFound)
-			return
+// validateUploadMetadata 检查 init 的 metadata：非字符串的值在解析 JSON 时已被拒绝，
+// 这里限制大小并要求键非空、键值都是合法 UTF-8。
+func validateUploadMetadata(md map[string]string) error {
+	if len(md) > maxMetadataEntries {
+		return fmt.Errorf("metadata has more than %d entries", maxMetadataEntries)
+	}
+	total := 0
+	for k, v := range md {
+		if k == "" || len(k) > maxMetadataKeyBytes || !utf8.ValidString(k) {
+			return fmt.Errorf("invalid metadata key %q", k)
 		}
-		http.Error(w, "load failed", http.StatusInternalServerError)
-		return
+		if len(v) > maxMetadataValueBytes || !utf8.ValidString(v) {
+			return fmt.Errorf("invalid metadata value for %q", k)
+		}
+		total += len(k) + len(v)
 	}
-	if meta.Completed {
-		http.Error(w, "already completed", http.StatusConflict)
-		return
+	if total > maxMetadataTotalBytes {
+		return fmt.Errorf("metadata exceeds %d bytes", maxMetadataTotalBytes)
 	}
-	if offset+chunkLen > meta.TotalSize {
-		http.Error(w, "chunk out of range", http.StatusBadRequest)
-		return
+	return nil
+}
+
+// newUpload 校验初始化参数并创建上传会话（元数据 + 存储后端中预分配的空间），init 与 tus 创建共用。
+// 目标目录配置了配额时同时返回剩余额度；参数或资源问题以 *httpError 返回。
+func (s *Server) newUpload(req initReq) (UploadMeta, *int64, error) {
+	req.Filename = strings.TrimSpace(req.Filename)
+	req.Path = strings.TrimSpace(req.Path)
+	if req.Path == "" {
+		req.Path = req.Filename
+	}
+	if req.Filename == "" {
+		req.Filename = filepath.Base(req.Path)
+	}
+	// total_size 为 0 表示大小未知，按流式追加处理
+	if req.TotalSize < 0 {
+		return UploadMeta{}, nil, errStatus(http.StatusBadRequest, "invalid_total_size", "total_size must be >= 0")
+	}
+	cfg := s.config()
+	if cfg.Limits.MaxFileBytes > 0 && req.TotalSize > cfg.Limits.MaxFileBytes {
+		return UploadMeta{}, nil, errStatus(http.StatusRequestEntityTooLarge, "file_too_large", "file too large")
+	}
+	if req.ChunkSize <= 0 || req.ChunkSize > cfg.Limits.MaxChunkBytes {
+		return UploadMeta{}, nil, errStatus(http.StatusBadRequest, "invalid_chunk_size", "invalid chunk_size")
+	}
+	// 加密按 encBlockSize 分块，分片需要与块边界对齐
+	encrypted := s.encKey != nil
+	if encrypted && req.ChunkSize%encBlockSize != 0 {
+		return UploadMeta{}, nil, errStatus(http.StatusBadRequest, "invalid_chunk_size", fmt.Sprintf("chunk_size must be a multiple of %d when encryption is enabled", encBlockSize))
 	}
 
-	partPath := s.partPath(uploadID)
-	f, err := os.OpenFile(partPath, os.O_RDWR, 0o644)
-	if err != nil {
-		http.Error(w, "open part failed", http.StatusInternalServerError)
-		return
+	req.SHA256 = strings.ToLower(strings.TrimSpace(req.SHA256))
+	if req.SHA256 != "" && !isHexSHA256(req.SHA256) {
+		return UploadMeta{}, nil, errStatus(http.StatusBadRequest, "invalid_sha256", "invalid sha256")
 	}
-	defer f.Close()
 
-	// 限制读取，避免客户端不守规矩多发数据
-	lr := io.LimitReader(r.Body, chunkLen)
-	wrote, err := copyToWriterAt(f, lr, offset)
+	if _, err := sanitizeRelPath(req.Path); err != nil {
+		return UploadMeta{}, nil, errStatus(http.StatusBadRequest, "invalid_path", "invalid path")
+	}
+	// 路径模板可能引用 upload_id 与创建时间，两者需在确定 rel_path 之前生成
+	uploadID, err := s.newUploadID()
 	if err != nil {
-		http.Error(w, "write failed", http.StatusInternalServerError)
-		return
+		log.Printf("allocate upload_id failed: %v", err)
+		return UploadMeta{}, nil, errStatus(http.StatusInternalServerError, "internal_error", "allocate upload_id failed")
+	}
+	createdAt := time.Now().UTC()
+	rel, requested, err := s.resolveUploadPath(req.Path, uploadID, createdAt)
+	if err != nil {
+		return UploadMeta{}, nil, err
+	}
+	req.OriginalFilename = strings.TrimSpace(req.OriginalFilename)
+	if err := validateOriginalFilename(req.OriginalFilename); err != nil {
+		return UploadMeta{}, nil, errStatus(http.StatusBadRequest, "invalid_original_filename", err.Error())
+	}
+	if err := validateUploadMetadata(req.Metadata); err != nil {
+		return UploadMeta{}, nil, errStatus(http.StatusBadRequest, "invalid_metadata", err.Error())
+	}
+	// 检查配额与创建会话在同一把锁内完成，会话落盘后它的 total_size 就会计入占用
+	var quotaLeft *int64
+	if len(cfg.Quotas) > 0 {
+		s.quota.mu.Lock()
+		defer s.quota.mu.Unlock()
+		left, limited, err := s.checkQuota(rel, req.TotalSize)
+		if err != nil {
+			return UploadMeta{}, nil, err
+		}
+		if limited {
+			quotaLeft = &left
+		}
+	}
+	// 按传入 filename 的扩展名猜 MIME，内容嗅探结果在收到首个分片后补充
+	contentType := mime.TypeByExtension(filepath.Ext(req.Filename))
+
+	tooMany := &httpError{
+		status: http.StatusTooManyRequests,
+		code:   "too_many_uploads",
+		msg:    "too many concurrent uploads",
+		header: map[string]string{"Retry-After": strconv.Itoa(uploadSlotRetryAfter)},
+		body:   map[string]any{"retry_after": uploadSlotRetryAfter},
+	}
+	if req.DryRun {
+		if limit := cfg.Limits.MaxConcurrentUploads; limit > 0 && s.activeUploads.Load() >= limit {
+			return UploadMeta{}, nil, tooMany
+		}
+	} else if !s.reserveUploadSlot() {
+		return UploadMeta{}, nil, tooMany
+	}
+
+	meta := UploadMeta{
+		UploadID:     uploadID,
+		CreatedAt:    createdAt,
+		Filename:     req.Filename,
+		RelPath:      rel,
+		TotalSize:    req.TotalSize,
+		ChunkSize:    req.ChunkSize,
+		UploadedSize: 0,
+		Completed:    false,
+
+		ReceivedRanges: [][2]int64{},
+		ContentType:    contentType,
+		ExpectedSHA256: req.SHA256,
+		OriginalName:   req.OriginalFilename,
+		Metadata:       req.Metadata,
+		RequestedPath:  requested,
+		BatchID:        req.batchID,
+		Streaming:      req.TotalSize == 0,
+		Encrypted:      encrypted,
+	}
+	if ttl := cfg.Storage.UploadTTL; ttl > 0 {
+		exp := meta.CreatedAt.Add(ttl)
+		meta.ExpiresAt = &exp
+	}
+	// dry_run 到此为止：后端相关的检查由调用方通过 Storage.Preflight 完成，不分配任何资源
+	if req.DryRun {
+		return meta, quotaLeft, nil
+	}
+
+	// 先在存储后端分配空间，元数据落盘后会话才对其它接口可见
+	if err := s.store.Prepare(&meta); err != nil {
+		s.releaseUploadSlot()
+		s.store.Discard(meta)
+		var he *httpError
+		if errors.As(err, &he) {
+			return UploadMeta{}, nil, err
+		}
+		log.Printf("prepare storage for %s failed: %v", uploadID, err)
+		return UploadMeta{}, nil, errStatus(http.StatusBadGateway, "backend_error", "storage backend error")
+	}
+	if err := s.saveMeta(meta); err != nil {
+		s.releaseUploadSlot()
+		s.store.Discard(meta)
+		return UploadMeta{}, nil, errStatus(http.StatusInternalServerError, "internal_error", "save meta failed")
+	}
+	if quotaLeft != nil {
+		delete(s.quota.usage, topLevelDir(rel))
+	}
+	return meta, quotaLeft, nil
+}
+
+// resolveUploadPath 把客户端给出的路径解析为 rel_path：清理、按 storage.path_template 展开，再检查路径名与扩展名。
+// 配置了模板时 requested 为客户端原本请求的（已清理的）路径，否则为空。init 与 complete 改写路径时共用。
+func (s *Server) resolveUploadPath(p, uploadID string, createdAt time.Time) (rel, requested string, err error) {
+	rel, err = sanitizeRelPath(p)
+	if err != nil {
+		return "", "", errStatus(http.StatusBadRequest, "invalid_path", "invalid path")
+	}
+	cfg := s.config()
+	if tmpl := cfg.Storage.PathTemplate; tmpl != "" {
+		requested = rel
+		expanded := expandPathTemplate(tmpl, cfg.Storage.PathTemplateMode, rel, uploadID, createdAt)
+		if rel, err = sanitizeRelPath(expanded); err != nil {
+			return "", "", errStatus(http.StatusBadRequest, "invalid_path", "invalid path")
+		}
+	}
+	if err := s.checkPathNames(rel); err != nil {
+		return "", "", err
+	}
+	if err := s.checkExtension(rel); err != nil {
+		return "", "", err
+	}
+	return rel, requested, nil
+}
+
+// GET/HEAD /api/v1/uploads/status?upload_id=...[&wait_for=<bytes>&timeout=30s]
+// HEAD 返回与 GET 相同的响应头（含 Content-Length），不带响应体。
+// 带 wait_for 时为长轮询，见 waitForProgress。
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	uploadID := strings.TrimSpace(q.Get("upload_id"))
+	if !checkUploadID(w, uploadID) {
+		return
+	}
+	if v := strings.TrimSpace(q.Get("wait_for")); v != "" {
+		waitFor, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || waitFor < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_wait_for", "invalid wait_for")
+			return
+		}
+		timeout := statusWaitDefault
+		if v := strings.TrimSpace(q.Get("timeout")); v != "" {
+			if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid_timeout", "invalid timeout")
+				return
+			}
+			timeout = min(timeout, statusWaitMax)
+		}
+		meta, err := s.waitForProgress(r.Context(), uploadID, waitFor, timeout)
+		if err != nil {
+			writeLoadError(w, err)
+			return
+		}
+		writeJSONOrHead(w, r, http.StatusOK, s.statusOf(meta))
+		return
+	}
+	meta, err := s.loadMeta(uploadID)
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+	writeJSONOrHead(w, r, http.StatusOK, s.statusOf(meta))
+}
+
+const (
+	statusWaitDefault = 30 * time.Second
+	statusWaitMax     = 120 * time.Second
+)
+
+// waitForProgress 阻塞到 uploaded_size >= waitFor、上传完成、超时或请求取消，返回当时的元数据。
+// 复用 SSE 的按上传订阅：每个分片写入后都会收到通知，无需轮询磁盘。上传被取消时返回 os.ErrNotExist。
+func (s *Server) waitForProgress(ctx context.Context, uploadID string, waitFor int64, timeout time.Duration) (UploadMeta, error) {
+	// 先订阅再读取当前状态，避免两者之间的进度丢失
+	ch := s.events.subscribe(uploadID)
+	defer s.events.unsubscribe(uploadID, ch)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		meta, err := s.loadMeta(uploadID)
+		if err != nil || meta.Completed || meta.UploadedSize >= waitFor {
+			return meta, err
+		}
+		select {
+		case <-ch:
+		case <-timer.C:
+			return meta, nil
+		case <-ctx.Done():
+			return meta, nil
+		case <-s.events.closing:
+			return meta, nil
+		}
+	}
+}
+
+type listResp struct {
+	Total int          `json:"total"`
+	Items []UploadMeta `json:"items"`
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	limit := 50
+	offset := 0
+	if v := strings.TrimSpace(q.Get("limit")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, http.StatusBadRequest, "invalid_limit", "invalid limit")
+			return
+		}
+		limit = n
+	}
+	if v := strings.TrimSpace(q.Get("offset")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_offset", "invalid offset")
+			return
+		}
+		offset = n
+	}
+	var completed *bool
+	if v := strings.TrimSpace(q.Get("completed")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_completed", "invalid completed")
+			return
+		}
+		completed = &b
+	}
+	asc := false
+	switch strings.TrimSpace(q.Get("order")) {
+	case "", "desc":
+	case "asc":
+		asc = true
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_order", "invalid order")
+		return
+	}
+
+	ids, err := s.listUploadIDs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "scan failed")
+		return
+	}
+	items := make([]UploadMeta, 0, len(ids))
+	for _, id := range ids {
+		meta, err := s.loadMeta(id)
+		if err != nil {
+			// 写了一半或已被删除的元数据：跳过，不影响整体列表
+			continue
+		}
+		if completed != nil && meta.Completed != *completed {
+			continue
+		}
+		items = append(items, meta)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if asc {
+			return items[i].CreatedAt.Before(items[j].CreatedAt)
+		}
+		return items[i].CreatedAt.After(items[j].CreatedAt)
+	})
+
+	total := len(items)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	writeJSON(w, http.StatusOK, listResp{Total: total, Items: items[offset:end]})
+}
+
+func (s *Server) handleChunk(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	// 部分代理会拦截或改写 PUT，POST 与 PUT 语义完全相同
+	switch r.Method {
+	case http.MethodPut, http.MethodPost, http.MethodHead:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	uploadID := strings.TrimSpace(r.URL.Query().Get("upload_id"))
+	if !checkUploadID(w, uploadID) {
+		return
+	}
+	if r.Method == http.MethodHead {
+		s.chunkHead(w, uploadID)
+		return
+	}
+	if !s.writable(w) {
+		return
+	}
+	bodyLen := r.ContentLength
+	// 没有 Content-Length 时先把请求体暂存下来得到长度，见 chunkspool.go
+	var spool *spooledChunk
+	if bodyLen < 0 {
+		meta, err := s.loadMeta(uploadID)
+		if err != nil {
+			writeLoadError(w, err)
+			return
+		}
+		if spool, bodyLen, err = s.spoolChunkBody(w, r, uploadID, meta.Encrypted); err != nil {
+			var he *httpError
+			switch {
+			case isReadTimeout(err):
+				writeError(w, http.StatusRequestTimeout, "request_timeout", "request timeout")
+			case clientGone(r, err):
+				w.WriteHeader(statusClientClosedRequest)
+			case errors.As(err, &he):
+				writeHTTPError(w, err)
+			default:
+				writeError(w, http.StatusBadRequest, "read_body_failed", "read body failed")
+			}
+			return
+		}
+		defer spool.remove()
+		if bodyLen == 0 {
+			writeError(w, http.StatusBadRequest, "empty_chunk", "empty chunk")
+			return
+		}
+	}
+	if bodyLen <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid_content_length", "missing/invalid Content-Length")
+		return
+	}
+	// 压缩分片：Content-Length 是压缩后的大小，解压后的字节数由 X-Chunk-Raw-Length 给出，
+	// 偏移与各项范围检查都基于解压后的字节位置。
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		encoding = ""
+	}
+	chunkLen := bodyLen
+	if encoding != "" {
+		if encoding != "gzip" && encoding != "deflate" {
+			writeError(w, http.StatusUnsupportedMediaType, "unsupported_content_encoding", "unsupported Content-Encoding")
+			return
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(r.Header.Get("X-Chunk-Raw-Length")), 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid_raw_length", "missing/invalid X-Chunk-Raw-Length")
+			return
+		}
+		chunkLen = n
+	}
+	// 偏移可来自 X-Chunk-Offset 或标准的 Content-Range，两者同时出现时必须一致
+	offset := int64(-1)
+	if v := strings.TrimSpace(r.Header.Get("X-Chunk-Offset")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_offset", "invalid offset")
+			return
+		}
+		offset = n
+	}
+	rangeTotal := int64(-1)
+	if v := strings.TrimSpace(r.Header.Get("Content-Range")); v != "" {
+		start, end, total, err := parseContentRange(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_content_range", "invalid Content-Range")
+			return
+		}
+		if end-start+1 != chunkLen {
+			writeError(w, http.StatusBadRequest, "content_range_mismatch", "Content-Range does not match chunk length")
+			return
+		}
+		if offset >= 0 && offset != start {
+			writeError(w, http.StatusBadRequest, "content_range_mismatch", "X-Chunk-Offset does not match Content-Range")
+			return
+		}
+		offset = start
+		rangeTotal = total
+	}
+	if offset < 0 {
+		writeError(w, http.StatusBadRequest, "missing_offset", "missing X-Chunk-Offset or Content-Range")
+		return
+	}
+	if maxChunk := s.config().Limits.MaxChunkBytes; chunkLen > maxChunk || bodyLen > maxChunk {
+		writeError(w, http.StatusRequestEntityTooLarge, "chunk_too_large", "chunk too large")
+		return
+	}
+	// 可选的分片校验：未携带时跳过，兼容旧客户端
+	expectedSum := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Chunk-Checksum")))
+	if expectedSum != "" && !isHexSHA256(expectedSum) {
+		writeError(w, http.StatusBadRequest, "invalid_chunk_checksum", "invalid X-Chunk-Checksum")
+		return
+	}
+
+	// 上传锁只覆盖元数据的读取与更新，写盘在锁外进行，同一上传中不相交的分片可以并行写入。
+	// 写盘期间持有 part 读锁，complete/cancel 会等进行中的写入结束后再移走 .part；
+	// 流式上传要求顺序追加，分片之间用 part 写锁串行。
+	meta, err := s.loadMeta(uploadID)
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+	// 写盘名额按 limits.max_concurrent_chunks 排队（见 chunkslots.go），在取上传锁之前获取：
+	// 排队期间不占着 part 锁，complete/cancel 与同一上传的其它分片不会被挡住
+	release, err := s.acquireChunkSlot(r.Context())
+	if err != nil {
+		if clientGone(r, err) {
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		reqLogger(r).Warn("chunk queue timed out", "upload_id", uploadID, "offset", offset,
+			"duration_ms", time.Since(start).Milliseconds())
+		writeHTTPError(w, err)
+		return
+	}
+	defer release()
+	ul := s.lock(uploadID)
+	if meta.Streaming {
+		ul.part.Lock()
+		defer ul.part.Unlock()
+	} else {
+		ul.part.RLock()
+		defer ul.part.RUnlock()
+	}
+	ul.Lock()
+	meta, err = s.loadMeta(uploadID)
+	ul.Unlock()
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+	if meta.Completed {
+		writeError(w, http.StatusConflict, "upload_completed", "already completed")
+		return
+	}
+	if meta.Streaming {
+		// 流式上传只能顺序追加，Content-Range 中的 total 不做校验，最终大小在 complete 时确定
+		if offset != meta.UploadedSize {
+			writeError(w, http.StatusConflict, "offset_mismatch", fmt.Sprintf("streaming upload expects offset %d", meta.UploadedSize))
+			return
+		}
+		if maxFile := s.config().Limits.MaxFileBytes; maxFile > 0 && offset+chunkLen > maxFile {
+			writeError(w, http.StatusRequestEntityTooLarge, "file_too_large", "file too large")
+			return
+		}
+		// init 时大小未知，配额与磁盘空间只按 0 检查过，每个分片按增长后的大小（offset+chunkLen）重新检查
+		if err := s.checkStreamingGrowth(meta, chunkLen); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+	} else {
+		if rangeTotal >= 0 && rangeTotal != meta.TotalSize {
+			writeError(w, http.StatusBadRequest, "content_range_mismatch", "Content-Range total does not match total_size")
+			return
+		}
+		// 超出文件末尾与请求头格式错误区分开，客户端可据 total_size 修正偏移后续传
+		if offset+chunkLen > meta.TotalSize {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", meta.TotalSize))
+			writeErrorBody(w, http.StatusRequestedRangeNotSatisfiable, "chunk_out_of_range", "chunk out of range", map[string]any{
+				"total_size": meta.TotalSize,
+				"offset":     offset,
+				"length":     chunkLen,
+			})
+			return
+		}
+	}
+	if s.config().Limits.StrictChunks {
+		if err := checkChunkAlignment(meta, offset, chunkLen); err != nil {
+			writeError(w, http.StatusBadRequest, "misaligned_chunk", err.Error())
+			return
+		}
+	} else if s.config().Limits.ConsistentChunks {
+		ul.Lock()
+		err := s.checkChunkConsistency(uploadID, offset, chunkLen)
+		ul.Unlock()
+		var he *httpError
+		if errors.As(err, &he) {
+			writeHTTPError(w, err)
+			return
+		}
+		if err != nil {
+			writeLoadError(w, err)
+			return
+		}
+	}
+	if meta.Encrypted {
+		if err := checkEncryptedAlignment(meta, offset, chunkLen); err != nil {
+			writeError(w, http.StatusBadRequest, "misaligned_chunk", err.Error())
+			return
+		}
+	}
+
+	// 限制读取，避免客户端不守规矩多发数据；限速作用在线路上的（压缩后）字节，暂存的请求体在读入时已限速
+	var body io.Reader = spool
+	if spool == nil {
+		body = s.throttle(uploadID, io.LimitReader(s.chunkBody(w, r), bodyLen))
+	}
+
+	// 重试已成功的分片：区间已全部接收时读完并丢弃请求体，直接返回当前进度。
+	// 需要比对重叠内容时仍按正常流程写入
+	if s.config().Limits.SkipDuplicateChunks && !s.config().Limits.VerifyOverlaps && !meta.Streaming &&
+		rangesTotal(intersectRanges(meta.ReceivedRanges, offset, offset+chunkLen)) == chunkLen {
+		release()
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			switch {
+			case isReadTimeout(err):
+				writeError(w, http.StatusRequestTimeout, "request_timeout", "request timeout")
+			case clientGone(r, err):
+				w.WriteHeader(statusClientClosedRequest)
+			default:
+				writeError(w, http.StatusBadRequest, "read_body_failed", "read body failed")
+			}
+			return
+		}
+		reqLogger(r).Info("duplicate chunk skipped", "upload_id", uploadID, "offset", offset, "bytes", chunkLen,
+			"uploaded_size", meta.UploadedSize, "duration_ms", time.Since(start).Milliseconds())
+		writeJSON(w, http.StatusOK, map[string]any{"uploaded_size": meta.UploadedSize})
+		return
+	}
+
+	// 与已接收区间重叠的部分：写入前先对盘上原有内容求摘要，写入时对新内容的同一部分求摘要，
+	// 两者不同说明多个客户端/并行分片写了不一致的数据，记入 conflict_ranges
+	var overlaps [][2]int64
+	var existingSum []byte
+	var incoming *overlapHasher
+	if s.config().Limits.VerifyOverlaps && !meta.Streaming {
+		overlaps = intersectRanges(meta.ReceivedRanges, offset, offset+chunkLen)
+		if len(overlaps) > 0 {
+			if existingSum, err = s.hashPartRanges(meta, overlaps); err != nil {
+				writeError(w, http.StatusInternalServerError, "internal_error", "read part failed")
+				return
+			}
+			incoming = &overlapHasher{h: sha256.New(), pos: offset, ranges: overlaps}
+		}
+	}
+
+	src := body
+	var dec *readErrRecorder
+	if encoding != "" {
+		d, err := newChunkDecoder(encoding, src)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_compressed_body", "invalid compressed body")
+			return
+		}
+		dec = &readErrRecorder{r: d}
+		src = io.LimitReader(dec, chunkLen)
+	}
+	// 分片校验针对解压后的内容
+	var hasher hash.Hash
+	if expectedSum != "" {
+		hasher = sha256.New()
+		src = io.TeeReader(src, hasher)
+	}
+	if incoming != nil {
+		src = io.TeeReader(src, incoming)
+	}
+	ph := newPrefixHasher(meta, offset)
+	if ph != nil {
+		src = io.TeeReader(src, ph)
+	}
+	// 首个分片顺带保留开头的内容用于嗅探类型，不必再从存储读回
+	var head *headBuffer
+	if offset == 0 {
+		head = &headBuffer{}
+		src = io.TeeReader(src, head)
+	}
+	wrote, err := s.store.WriteChunk(r.Context(), meta, offset, chunkLen, src)
+	release()
+	if err != nil {
+		if dec != nil && dec.err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_compressed_body", "invalid compressed body")
+			return
+		}
+		if timedOut := isReadTimeout(err); timedOut || clientGone(r, err) {
+			// 客户端中途断开或停止发送不是服务端错误：已写入的前缀照常记入区间，续传时只需补发剩余部分。
+			// 带分片校验、需要比对重叠内容或要求分片对齐时，半个分片无法确认或无法续写，不记录
+			if wrote > 0 && hasher == nil && incoming == nil && !s.config().Limits.StrictChunks && !s.config().Limits.ConsistentChunks {
+				ul.Lock()
+				if meta, err = s.loadMeta(uploadID); err == nil {
+					blocked := false
+					if head != nil && meta.SniffedType == "" {
+						meta.SniffedType = head.contentType()
+						blocked = s.rejectSniffed(r, meta)
+					}
+					if blocked {
+						wrote = 0
+					} else {
+						meta, err = s.commitChunk(meta, offset, wrote, ph)
+					}
+				}
+				ul.Unlock()
+				if err != nil {
+					reqLogger(r).Error("save partial chunk failed", "upload_id", uploadID, "offset", offset, "error", err)
+					wrote = 0
+				}
+			} else {
+				wrote = 0
+			}
+			if timedOut {
+				reqLogger(r).Info("chunk read timed out", "upload_id", uploadID, "offset", offset, "bytes", wrote,
+					"duration_ms", time.Since(start).Milliseconds())
+				writeError(w, http.StatusRequestTimeout, "request_timeout", "request timeout")
+				return
+			}
+			reqLogger(r).Info("chunk aborted by client", "upload_id", uploadID, "offset", offset, "bytes", wrote,
+				"duration_ms", time.Since(start).Milliseconds())
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		reqLogger(r).Error("write chunk failed", "upload_id", uploadID, "offset", offset, "error", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "write failed")
+		return
+	}
+	if dec != nil && (wrote != chunkLen || !drained(dec.r)) {
+		writeError(w, http.StatusBadRequest, "raw_length_mismatch", "decompressed size does not match X-Chunk-Raw-Length")
+		return
 	}
 	if wrote != chunkLen {
-		http.Error(w, "short write", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "short write")
 		return
 	}
+	// 校验失败时不推进 uploaded_size，该区域等待客户端重传覆盖
+	if hasher != nil {
+		if got := hex.EncodeToString(hasher.Sum(nil)); got != expectedSum {
+			writeErrorBody(w, http.StatusUnprocessableEntity, "checksum_mismatch", "checksum mismatch", map[string]any{
+				"expected": expectedSum,
+				"got":      got,
+			})
+			return
+		}
+	}
+
+	ul.Lock()
+	defer ul.Unlock()
+	// 写盘期间其它分片可能已更新区间，基于最新元数据合并
+	if meta, err = s.loadMeta(uploadID); err != nil {
+		writeLoadError(w, err)
+		return
+	}
+	// 首个分片到达后嗅探内容类型，不依赖客户端给出的扩展名
+	if head != nil && meta.SniffedType == "" {
+		meta.SniffedType = head.contentType()
+		if s.rejectSniffed(r, meta) {
+			writeError(w, http.StatusUnsupportedMediaType, "file_type_not_allowed", "file type not allowed: "+meta.SniffedType)
+			return
+		}
+	}
+	if incoming != nil && !bytes.Equal(existingSum, incoming.h.Sum(nil)) {
+		for _, rg := range overlaps {
+			meta.ConflictRanges = mergeRange(meta.ConflictRanges, rg[0], rg[1])
+		}
+		reqLogger(r).Warn("conflicting overlapping write", "upload_id", uploadID, "offset", offset, "bytes", chunkLen)
+	}
+	if meta, err = s.commitChunk(meta, offset, chunkLen, ph); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "save failed")
+		return
+	}
+	if meta.Streaming {
+		s.addQuotaUsage(meta.RelPath, chunkLen)
+	}
+	reqLogger(r).Info("chunk written", "upload_id", uploadID, "offset", offset, "bytes", wrote,
+		"uploaded_size", meta.UploadedSize, "duration_ms", time.Since(start).Milliseconds())
+	writeJSON(w, http.StatusOK, map[string]any{"uploaded_size": meta.UploadedSize})
+}
+
+// throttle 按 max_upload_bps 为该上传的读取限速，同一上传的所有请求共享令牌桶。
+// chunkBody 返回带读取超时的请求体：每次读取前把连接的读截止时间推后 chunk_read_timeout，
+// 数据持续到达的慢速上传不会超时，停止发送的连接则在超时后以 os.ErrDeadlineExceeded 失败，
+// 不会一直占着上传锁。限速等待发生在两次读取之间，不计入超时。
+func (s *Server) chunkBody(w http.ResponseWriter, r *http.Request) io.Reader {
+	return &idleTimeoutReader{r: r.Body, rc: http.NewResponseController(w), timeout: s.config().Limits.ChunkReadTimeout}
+}
+
+type idleTimeoutReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (t *idleTimeoutReader) Read(p []byte) (int, error) {
+	// ResponseWriter 不支持设置截止时间时照常读取，只是没有超时保护
+	_ = t.rc.SetReadDeadline(time.Now().Add(t.timeout))
+	return t.r.Read(p)
+}
+
+// isReadTimeout 判断读取失败是否因 chunkBody 设置的截止时间到期。
+func isReadTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func (s *Server) throttle(uploadID string, r io.Reader) io.Reader {
+	bps := s.config().Limits.MaxUploadBps
+	if bps <= 0 {
+		return r
+	}
+	l, _ := s.limiters.LoadOrStore(uploadID, newRateLimiter(bps))
+	return NewThrottledReader(r, l.(*rateLimiter))
+}
+
+// copyToPart 使用池化缓冲区将 src 写入 .part 的 offset 处，加密上传按块加密后写入。
+// 出错时返回已确实落盘的明文字节数：加密时不足一块的缓冲数据不计入。
+func (s *Server) copyToPart(f *os.File, meta UploadMeta, src io.Reader, offset int64) (int64, error) {
+	bufp := s.bufPool.Get().(*[]byte)
+	defer s.bufPool.Put(bufp)
+	if !meta.Encrypted {
+		return copyToWriterAt(f, src, offset, *bufp)
+	}
+	aead, err := s.uploadAEAD(meta.UploadID)
+	if err != nil {
+		return 0, err
+	}
+	w := newEncWriter(f, aead, offset)
+	n, err := io.CopyBuffer(w, src, *bufp)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return (w.block - offset/encBlockSize) * encBlockSize, err
+	}
+	return n, nil
+}
+
+// overlapHasher 接收从 pos 开始的分片数据流，只对落在 ranges 内的字节求摘要。
+type overlapHasher struct {
+	h      hash.Hash
+	pos    int64
+	ranges [][2]int64
+}
+
+func (o *overlapHasher) Write(p []byte) (int, error) {
+	start, end := o.pos, o.pos+int64(len(p))
+	for _, rg := range o.ranges {
+		if lo, hi := max(rg[0], start), min(rg[1], end); lo < hi {
+			o.h.Write(p[lo-start : hi-start])
+		}
+	}
+	o.pos = end
+	return len(p), nil
+}
+
+// hashPartRanges 按顺序对 .part 中若干区间的明文求摘要。
+func (s *Server) hashPartRanges(meta UploadMeta, ranges [][2]int64) ([]byte, error) {
+	f, err := os.Open(s.partPath(meta.UploadID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ra, err := s.partReaderAt(f, meta, meta.TotalSize)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	for _, rg := range ranges {
+		if _, err := io.Copy(h, io.NewSectionReader(ra, rg[0], rg[1]-rg[0])); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
 
-	// 断点续传的“已上传大小”这里做保守计算：取当前文件的最大连续写入前缀。
-	// 为了保持简单，这里不维护位图；改为维护 uploaded_size = max(uploaded_size, offset+chunkLen)
-	// 注意：这允许乱序分片，但 uploaded_size 只是“已接收的最大偏移”，不代表连续性。
-	if end := offset + chunkLen; end > meta.UploadedSize {
-		meta.UploadedSize = end
+// partReaderAt 返回 .part 的明文视图，size 为需要读取的明文范围。
+func (s *Server) partReaderAt(f *os.File, meta UploadMeta, size int64) (io.ReaderAt, error) {
+	if !meta.Encrypted {
+		return f, nil
 	}
-	lastSavedAny, _ := s.lastSaved.LoadOrStore(uploadID, int64(0))
+	aead, err := s.uploadAEAD(meta.UploadID)
+	if err != nil {
+		return nil, err
+	}
+	return newEncReaderAt(f, aead, size), nil
+}
+
+// headBuffer 保留写入数据的前 512 字节，用于嗅探内容类型。
+type headBuffer struct {
+	buf []byte
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	if n := 512 - len(h.buf); n > 0 {
+		h.buf = append(h.buf, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+func (h *headBuffer) contentType() string {
+	if len(h.buf) == 0 {
+		return ""
+	}
+	return http.DetectContentType(h.buf)
+}
+
+// readErrRecorder 记录底层 Reader 返回的第一个非 EOF 错误，
+// 用于在写入失败时区分是请求体（如解压）出错还是存储出错。
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (e *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// commitChunk 记录已写入的 [offset, offset+n)，并按 metaSaveInterval 决定落盘还是仅更新内存。
+// 调用方需持有该上传的锁。
+func (s *Server) commitChunk(meta UploadMeta, offset, n int64, ph *prefixHasher) (UploadMeta, error) {
+	applyPrefixHash(&meta, offset, n, ph)
+	// uploaded_size 取从 0 开始的连续前缀，乱序分片不会让续传跳过缺口。
+	meta.ReceivedRanges = mergeRange(meta.ReceivedRanges, offset, offset+n)
+	meta.UploadedSize = contiguousPrefix(meta.ReceivedRanges)
+	if cfg := s.config(); cfg.Storage.UploadTTL > 0 && cfg.Storage.UploadTTLSliding {
+		exp := time.Now().UTC().Add(cfg.Storage.UploadTTL)
+		meta.ExpiresAt = &exp
+	}
+	received := rangesTotal(meta.ReceivedRanges)
+	s.speeds.record(meta.UploadID, received, time.Now())
+	lastSavedAny, _ := s.lastSaved.LoadOrStore(meta.UploadID, int64(0))
 	lastSaved := lastSavedAny.(int64)
-	needPersist := meta.UploadedSize == meta.TotalSize || meta.UploadedSize-lastSaved >= s.metaSaveInterval
+	needPersist := received == meta.TotalSize || received-lastSaved >= s.metaSaveInterval
 	if needPersist {
 		if err := s.saveMeta(meta); err != nil {
-			http.Error(w, "save failed", http.StatusInternalServerError)
-			return
+			return meta, err
 		}
-		s.lastSaved.Store(uploadID, meta.UploadedSize)
+	} else {
+		// 暂不落盘，但后续分片/状态查询需要看到最新区间
+		s.metaCache.Store(meta.UploadID, meta)
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"uploaded_size": meta.UploadedSize})
+	s.events.publish(meta.UploadID, progressEvent(meta))
+	return meta, nil
 }
 
 func (s *Server) handleComplete(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if !s.writable(w) {
 		return
 	}
 	uploadID := strings.TrimSpace(r.URL.Query().Get("upload_id"))
-	if uploadID == "" {
-		http.Error(w, "missing upload_id", http.StatusBadRequest)
+	if !checkUploadID(w, uploadID) {
 		return
 	}
+	// 可选的最终大小；流式上传必须提供
+	finalSize := int64(-1)
+	if v := strings.TrimSpace(r.URL.Query().Get("total_size")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_total_size", "invalid total_size")
+			return
+		}
+		finalSize = n
+	}
+	// 可选的请求体 {"path": "..."}：改写最终路径，用于上传完才能确定落盘位置的场景
+	var req completeReq
+	if r.ContentLength != 0 {
+		if err := s.readJSON(r, &req); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		req.Path = strings.TrimSpace(req.Path)
+	}
+	// S3 的 multipart upload 在 init 时已绑定对象 key
+	if req.Path != "" && !s.localOnly(w) {
+		return
+	}
+
+	// If-Match：目标路径上现有文件的 ETag 必须匹配，否则返回 412，避免覆盖调用方没有预料到的内容
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
 
+	// 等待进行中的分片写入结束
 	mu := s.lock(uploadID)
+	mu.part.Lock()
+	defer mu.part.Unlock()
 	mu.Lock()
 	defer mu.Unlock()
 
 	meta, err := s.loadMeta(uploadID)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			http.Error(w, "not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "load failed", http.StatusInternalServerError)
+		writeLoadError(w, err)
 		return
 	}
 	if meta.Completed {
-		finalPath, _ := s.finalAbsPath(meta.RelPath)
-		writeJSON(w, http.StatusOK, map[string]any{"completed": true, "path": finalPath})
+		writeJSON(w, http.StatusOK, map[string]any{"completed": true, "path": s.store.Location(meta.RelPath), "sha256": meta.SHA256})
 		return
 	}
-	if meta.UploadedSize < meta.TotalSize {
-		http.Error(w, fmt.Sprintf("not fully uploaded: %d/%d", meta.UploadedSize, meta.TotalSize), http.StatusConflict)
+	if meta.Streaming {
+		if finalSize < 0 {
+			writeError(w, http.StatusBadRequest, "missing_total_size", "streaming upload requires total_size")
+			return
+		}
+		if finalSize != meta.UploadedSize {
+			writeError(w, http.StatusConflict, "size_mismatch", fmt.Sprintf("total_size %d does not match uploaded size %d", finalSize, meta.UploadedSize))
+			return
+		}
+		// 校验失败未确认的分片可能已把 .part 写长，按最终大小截断
+		if err := s.store.Resize(meta, finalSize); err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "truncate failed")
+			return
+		}
+		meta.TotalSize = finalSize
+	} else if finalSize >= 0 && finalSize != meta.TotalSize {
+		writeError(w, http.StatusBadRequest, "size_mismatch", "total_size does not match")
+		return
+	}
+	if req.Path != "" {
+		if meta, err = s.overridePath(meta, req.Path); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+	}
+	var check func() error
+	if ifMatch != "" {
+		rel := meta.RelPath
+		check = func() error { return s.checkIfMatch(rel, ifMatch) }
+	}
+	meta, finalAbs, err := s.finalizeUploadIf(meta, check)
+	if err != nil {
+		writeHTTPError(w, err)
 		return
 	}
+	reqLogger(r).Info("upload completed", "upload_id", uploadID, "rel_path", meta.RelPath, "bytes", meta.TotalSize,
+		"duration_ms", time.Since(start).Milliseconds())
+	writeJSON(w, http.StatusOK, map[string]any{"completed": true, "path": finalAbs, "sha256": meta.SHA256})
+}
+
+type completeReq struct {
+	Path string `json:"path"` // 可选，代替 init 时的路径作为最终路径，同样约束在 root_dir 内
+}
+
+// overridePath 把未完成上传的目标改为 p：与 init 相同地解析与校验路径，目标换到另一个顶层目录时检查配额；
+// overwrite 为 reject 且目标已存在时返回 409。新路径先写入元数据再落盘，此后 complete 失败时重试也使用新路径。
+// 调用方需持有该上传的锁。
+func (s *Server) overridePath(meta UploadMeta, p string) (UploadMeta, error) {
+	rel, requested, err := s.resolveUploadPath(p, meta.UploadID, meta.CreatedAt)
+	if err != nil {
+		return meta, err
+	}
+	if rel == meta.RelPath {
+		return meta, nil
+	}
+	finalAbs, err := s.finalAbsPath(rel)
+	if err != nil {
+		return meta, errStatus(http.StatusBadRequest, "invalid_path", "invalid path")
+	}
+	if _, err := s.applyOverwritePolicy(finalAbs); err != nil {
+		if errors.Is(err, errDestExists) {
+			return meta, errStatus(http.StatusConflict, "destination_exists", "destination exists")
+		}
+		return meta, errStatus(http.StatusInternalServerError, "internal_error", "check destination failed")
+	}
+	old := meta.RelPath
+	meta.RelPath = rel
+	meta.RequestedPath = requested
+	if len(s.config().Quotas) > 0 && topLevelDir(rel) != topLevelDir(old) {
+		s.quota.mu.Lock()
+		_, _, err := s.checkQuota(rel, max(meta.TotalSize, meta.UploadedSize))
+		s.quota.mu.Unlock()
+		if err != nil {
+			return UploadMeta{}, err
+		}
+	}
+	if err := s.saveMeta(meta); err != nil {
+		return UploadMeta{}, errStatus(http.StatusInternalServerError, "internal_error", "save meta failed")
+	}
+	s.invalidateQuota(old)
+	s.invalidateQuota(rel)
+	return meta, nil
+}
+
+// finalizeUpload 校验已接收区间与整文件摘要，由存储后端按 overwrite 策略落到最终路径，
+// 返回更新后的元数据与最终位置。调用方需持有该上传的锁。
+func (s *Server) finalizeUpload(meta UploadMeta) (UploadMeta, string, error) {
+	return s.finalizeUploadIf(meta, nil)
+}
+
+// finalizeUploadIf 同 finalizeUpload，check 不为 nil 时在落盘前（与目标检查同一把锁内）再校验一次前置条件，
+// 返回的 *httpError 原样交给调用方，.part 保留。
+func (s *Server) finalizeUploadIf(meta UploadMeta, check func() error) (UploadMeta, string, error) {
+	if !rangesCover(meta.ReceivedRanges, meta.TotalSize) {
+		missing := missingRanges(meta.ReceivedRanges, meta.TotalSize)
+		msg := fmt.Sprintf("not fully uploaded: %d/%d", rangesTotal(meta.ReceivedRanges), meta.TotalSize)
+		return meta, "", &httpError{status: http.StatusConflict, code: "incomplete_upload", msg: msg, body: map[string]any{
+			"received_bytes": rangesTotal(meta.ReceivedRanges),
+			"total_size":     meta.TotalSize,
+			"missing_ranges": missing[:min(len(missing), 100)],
+		}}
+	}
+	if len(meta.ConflictRanges) > 0 {
+		return meta, "", &httpError{status: http.StatusConflict, code: "conflicting_writes", msg: "conflicting overlapping writes", body: map[string]any{
+			"conflict_ranges": meta.ConflictRanges,
+		}}
+	}
+
+	if _, err := s.finalAbsPath(meta.RelPath); err != nil {
+		return meta, "", errStatus(http.StatusBadRequest, "invalid_path", "invalid path")
+	}
+	// rename 之前完整计算一遍摘要：校验失败时保留 .part，客户端可重传后再次 complete
+	sum, err := s.store.Sum(meta)
+	if err != nil {
+		return meta, "", errStatus(http.StatusInternalServerError, "internal_error", "checksum failed")
+	}
+	meta.HashState, meta.HashedSize = nil, 0
+	if meta.ExpectedSHA256 != "" && sum != meta.ExpectedSHA256 {
+		return meta, "", &httpError{status: http.StatusConflict, code: "checksum_mismatch", msg: "checksum mismatch", body: map[string]any{
+			"expected": meta.ExpectedSHA256,
+			"got":      sum,
+		}}
+	}
 
-	finalAbs, err := s.finalAbsPath(meta.RelPath)
+	meta.Compressed = s.shouldCompress(meta)
+	rel, err := s.store.Place(meta, sum, check)
 	if err != nil {
-		http.Error(w, "invalid path", http.StatusBadRequest)
+		if errors.Is(err, errDestExists) {
+			return meta, "", errStatus(http.StatusConflict, "destination_exists", "destination exists")
+		}
+		var he *httpError
+		if errors.As(err, &he) {
+			return meta, "", err
+		}
+		log.Printf("finalize %s failed: %v", meta.UploadID, err)
+		return meta, "", errStatus(http.StatusInternalServerError, "internal_error", "finalize failed")
+	}
+	meta.RelPath = rel
+	now := time.Now().UTC()
+	meta.Completed = true
+	meta.CompletedAt = &now
+	// 后端无法计算摘要时（S3）不生成 ETag，下载时使用对象自身的 ETag
+	meta.SHA256 = sum
+	if sum != "" {
+		meta.ETag = `"` + sum + `"`
+	}
+	if err := s.saveMeta(meta); err != nil {
+		return meta, "", errStatus(http.StatusInternalServerError, "internal_error", "save failed")
+	}
+	s.indexCompleted(meta)
+	s.events.publish(meta.UploadID, completedEvent(meta))
+	s.limiters.Delete(meta.UploadID)
+	s.speeds.forget(meta.UploadID)
+	s.releaseUploadSlot()
+	// 覆盖或改名都会改变目录占用
+	s.invalidateQuota(meta.RelPath)
+	location := s.store.Location(rel)
+	s.notifyCompleted(meta, location)
+	return meta, location, nil
+}
+
+// POST/DELETE /api/v1/uploads/cancel?upload_id=...
+// DELETE /api/v1/uploads/{upload_id}
+// 取消上传：清理元数据与临时分片文件，后续分片请求将收到 404。
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	// DELETE /api/v1/uploads/{upload_id} 是 cancel 的 REST 形式，只接受 DELETE
+	uploadID := r.PathValue("upload_id")
+	if uploadID != "" {
+		if r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+			return
+		}
+	} else {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+			return
+		}
+		uploadID = strings.TrimSpace(r.URL.Query().Get("upload_id"))
+	}
+	if !s.writable(w) {
 		return
 	}
-	if err := ensureParentDir(finalAbs); err != nil {
-		http.Error(w, "mkdir failed", http.StatusInternalServerError)
+	if !checkUploadID(w, uploadID) {
 		return
 	}
-	partPath := s.partPath(uploadID)
-	if err := os.Rename(partPath, finalAbs); err != nil {
-		http.Error(w, "finalize failed", http.StatusInternalServerError)
+
+	// 等待进行中的分片写入结束
+	mu := s.lock(uploadID)
+	mu.part.Lock()
+	defer mu.part.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	meta, err := s.loadMeta(uploadID)
+	if errors.Is(err, errCorruptMeta) {
+		// 元数据损坏的上传无法续传，允许直接取消以清理残留
+		s.removeUpload(uploadID)
+		reqLogger(r).Warn("corrupt upload cancelled", "upload_id", uploadID)
+		writeJSON(w, http.StatusOK, map[string]any{"cancelled": true})
 		return
 	}
-	meta.Completed = true
-	if err := s.saveMeta(meta); err != nil {
-		http.Error(w, "save failed", http.StatusInternalServerError)
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+	if meta.Completed {
+		writeError(w, http.StatusConflict, "upload_completed", "already completed")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"completed": true, "path": finalAbs})
+
+	s.removeUpload(uploadID)
+
+	reqLogger(r).Info("upload cancelled", "upload_id", uploadID, "uploaded_size", meta.UploadedSize,
+		"duration_ms", time.Since(start).Milliseconds())
+	writeJSON(w, http.StatusOK, map[string]any{"cancelled": true})
+}
+
+// ===== 存储与状态 =====
+
+const defaultPartSuffix = ".part"
+
+// checkStateSuffixes 校验状态目录中数据文件与元数据文件的后缀：不能含路径分隔符，
+// 且互不为对方的结尾（否则扫描元数据时会把数据文件当成元数据），元数据后缀也不能与写入时的 .tmp 临时文件混淆。
+func checkStateSuffixes(part, meta string) error {
+	for _, v := range []struct{ key, suffix string }{{"part_suffix", part}, {"meta_suffix", meta}} {
+		if strings.ContainsAny(v.suffix, `/\`) || strings.ContainsRune(v.suffix, 0) || v.suffix == "." || v.suffix == ".." {
+			return fmt.Errorf("invalid storage.%s %q: must be a file name suffix", v.key, v.suffix)
+		}
+	}
+	if strings.HasSuffix(part, meta) || strings.HasSuffix(meta, part) {
+		return fmt.Errorf("storage.part_suffix %q and storage.meta_suffix %q must not end with each other", part, meta)
+	}
+	if strings.HasSuffix(meta, ".tmp") {
+		return fmt.Errorf("invalid storage.meta_suffix %q: must not end with .tmp", meta)
+	}
+	return nil
+}
+
+func (s *Server) metaPath(uploadID string) string {
+	return filepath.Join(s.stateAbs, uploadID+s.metaSuffix)
+}
+
+func (s *Server) partPath(uploadID string) string {
+	return filepath.Join(s.stateAbs, uploadID+s.partSuffix)
+}
+
+// runMetaFlusher 按 meta_flush_interval 定期落盘，崩溃后需要重传的数据量按时间而不只按字节封顶。
+func (s *Server) runMetaFlusher(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.flushMetas()
+		}
+	}
+}
+
+// flushMetas 将内存中领先于磁盘的元数据全部落盘。
+func (s *Server) flushMetas() {
+	s.metaCache.Range(func(k, _ any) bool {
+		uploadID := k.(string)
+		mu := s.lock(uploadID)
+		mu.Lock()
+		defer mu.Unlock()
+		// 持锁后重新读取，期间可能已被完成或取消
+		v, ok := s.metaCache.Load(uploadID)
+		if !ok {
+			return true
+		}
+		meta := v.(UploadMeta)
+		// 与上次落盘时的进度相同，无需重写
+		received := rangesTotal(meta.ReceivedRanges)
+		if saved, ok := s.lastSaved.Load(uploadID); ok && saved.(int64) == received {
+			return true
+		}
+		if err := s.saveMeta(meta); err != nil {
+			log.Printf("flush meta %s failed: %v", uploadID, err)
+		}
+		return true
+	})
+}
+
+// uploadSlotRetryAfter 是并发上传数达到上限时建议客户端等待的秒数。
+const uploadSlotRetryAfter = 30
+
+// seedFromState 扫描状态目录：统计未完成的上传数作为并发上限计数的初值，
+// 并为已完成的上传建立下载用的 ETag 索引。
+func (s *Server) seedFromState() error {
+	ids, err := s.listUploadIDs()
+	if err != nil {
+		return err
+	}
+	var n int64
+	for _, id := range ids {
+		meta, err := s.loadMeta(id)
+		if errors.Is(err, errCorruptMeta) {
+			// 仍占用并发名额，取消或被 GC 回收时归还
+			log.Printf("upload %s has corrupt metadata: %v", id, err)
+			n++
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !meta.Completed {
+			s.pending.add(meta)
+			n++
+			continue
+		}
+		s.indexCompleted(meta)
+	}
+	s.activeUploads.Store(n)
+	return nil
+}
+
+// reserveUploadSlot 占用一个并发上传名额，达到 max_concurrent_uploads 时返回 false。
+func (s *Server) reserveUploadSlot() bool {
+	limit := s.config().Limits.MaxConcurrentUploads
+	n := s.activeUploads.Add(1)
+	if limit > 0 && n > limit {
+		s.activeUploads.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (s *Server) releaseUploadSlot() {
+	s.activeUploads.Add(-1)
+}
+
+// removeUpload 清理未完成上传的元数据与临时分片并释放并发名额，调用方需持有该上传的锁。
+// 可以重复调用：元数据已不存在时说明已清理过，名额不再重复释放。
+func (s *Server) removeUpload(uploadID string) {
+	meta, err := s.loadMeta(uploadID)
+	if err == nil {
+		s.invalidateQuota(meta.RelPath)
+		s.pruneEmptyDirs(meta.RelPath)
+	} else {
+		meta = UploadMeta{UploadID: uploadID}
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		s.releaseUploadSlot()
+	}
+	s.store.Discard(meta)
+	s.forgetMeta(uploadID)
+	s.muByUpload.Delete(uploadID)
+	s.events.publish(uploadID, cancelledEvent(uploadID))
+}
+
+// moveRename 是把 .part 或已完成的文件移到目标路径时首先尝试的 rename，测试中替换为返回 EXDEV 的实现以走复制的路径。
+var moveRename = os.Rename
+
+// moveStaged 以 place 在 finalizeMu 内完成目标检查并把 src rename 到 dst。源与目标不在同一文件系统时
+// （state_dir 在别的盘、容器内 bind mount / overlayfs 等）rename 会失败，此时先在锁外把 src 复制到 dst 所在目录的
+// 临时文件并 fsync，再以临时文件重新调用 place（同一目录内的 rename），最后同步目录并删除 src。
+// 耗时的复制不持有 finalizeMu，目标路径上也不会出现写了一半的文件。place 不持有 finalizeMu 时调用。
+func (s *Server) moveStaged(src, dst string, place func(src string, rename func(string, string) error) error) error {
+	err := place(src, moveRename)
+	if !isCrossDevice(err) {
+		return err
+	}
+	log.Printf("rename %s -> %s crosses devices, falling back to copy", src, dst)
+	tmp, err := s.stageFile(dst, ".moving", func(f *os.File) error {
+		return s.copyFileTo(f, src)
+	})
+	if err != nil {
+		return err
+	}
+	if err := place(tmp, os.Rename); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	// 先让目标的目录项落盘，再删除源文件，崩溃时至少保留一份完整数据
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		log.Printf("sync dir %s failed: %v", filepath.Dir(dst), err)
+	}
+	return os.Remove(src)
+}
+
+// moveFile 将 src 移动到 dst，跨文件系统时在原地复制。只用于去重落盘时链接失败的回退（调用方已持有 finalizeMu，
+// 无法按 moveStaged 在锁外复制）；其余落盘与移动都走 moveStaged。
+func (s *Server) moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+	log.Printf("rename %s -> %s crosses devices, falling back to copy", src, dst)
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".moving")
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, s.fileMode)
+	if err != nil {
+		return err
+	}
+	err = s.copyFileTo(out, src)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		log.Printf("sync dir %s failed: %v", filepath.Dir(dst), err)
+	}
+	return os.Remove(src)
 }
 
-// POST/DELETE /api/v1/uploads/cancel?upload_id=...
-// 取消上传：清理元数据与临时分片文件，后续分片请求将收到 404。
-func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	uploadID := strings.TrimSpace(r.URL.Query().Get("upload_id"))
-	if uploadID == "" {
-		http.Error(w, "missing upload_id", http.StatusBadRequest)
-		return
+// copyFileTo 把 src 的全部内容写入 w。
+func (s *Server) copyFileTo(w io.Writer, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
 	}
+	defer in.Close()
+	bufp := s.bufPool.Get().(*[]byte)
+	_, err = io.CopyBuffer(w, in, *bufp)
+	s.bufPool.Put(bufp)
+	return err
+}
 
-	mu := s.lock(uploadID)
-	mu.Lock()
-	defer mu.Unlock()
-
-	meta, err := s.loadMeta(uploadID)
+// pruneEmptyDirs 从 rel 的父目录开始逐级向上删除空目录，止于 root_dir（不含）和状态目录。
+// 非空目录删除失败即停止；持有 finalizeMu，不会删掉其它上传刚创建、尚未 rename 进去的目录。
+func (s *Server) pruneEmptyDirs(rel string) {
+	abs, err := s.finalAbsPath(rel)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			http.Error(w, "not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "load failed", http.StatusInternalServerError)
 		return
 	}
-	if meta.Completed {
-		http.Error(w, "already completed", http.StatusConflict)
-		return
+	s.finalizeMu.Lock()
+	defer s.finalizeMu.Unlock()
+	for dir := filepath.Dir(abs); dir != s.rootAbs && isSubpath(dir, s.rootAbs); dir = filepath.Dir(dir) {
+		if dir == s.stateAbs || os.Remove(dir) != nil {
+			return
+		}
 	}
+}
 
-	// 清理元数据与临时分片
-	_ = os.Remove(s.partPath(uploadID))
-	_ = os.Remove(s.metaPath(uploadID))
-	s.lastSaved.Delete(uploadID)
-	s.muByUpload.Delete(uploadID)
-
-	writeJSON(w, http.StatusOK, map[string]any{"cancelled": true})
+// availableBytes 返回状态目录（.part 所在）文件系统的可用空间；平台不支持或查询失败时 ok=false。
+func (s *Server) availableBytes() (uint64, bool) {
+	du, ok := s.stateDiskUsage()
+	return du.Available, ok
 }
 
-// ===== 存储与状态 =====
+// freeInodes 返回状态目录所在文件系统的剩余 inode 数；平台或文件系统不提供 inode 信息时 ok=false。
+func (s *Server) freeInodes() (uint64, bool) {
+	du, ok := s.stateDiskUsage()
+	return du.InodesFree, ok && du.Inodes > 0
+}
 
-func (s *Server) metaPath(uploadID string) string {
-	return filepath.Join(s.stateAbs, uploadID+".json")
+func (s *Server) stateDiskUsage() (diskUsage, bool) {
+	du, err := diskStat(s.stateAbs)
+	if err != nil {
+		if !errors.Is(err, errDiskStatUnsupported) {
+			log.Printf("stat disk failed: %v", err)
+		}
+		return diskUsage{}, false
+	}
+	return du, true
 }
 
-func (s *Server) partPath(uploadID string) string {
-	return filepath.Join(s.stateAbs, uploadID+".part")
+// listUploadIDs 扫描状态目录，返回所有存在元数据文件的 upload_id（忽略 .tmp 等临时文件与 layout.json 等其它文件）。
+func (s *Server) listUploadIDs() ([]string, error) {
+	entries, err := os.ReadDir(s.stateAbs)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for _, de := range entries {
+		name := de.Name()
+		id, ok := strings.CutSuffix(name, s.metaSuffix)
+		if de.IsDir() || !ok || !validUploadID(id) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
 }
 
+// loadMeta 优先返回内存中的最新快照，没有时再读盘。
 func (s *Server) loadMeta(uploadID string) (UploadMeta, error) {
+	if v, ok := s.metaCache.Load(uploadID); ok {
+		return v.(UploadMeta), nil
+	}
 	b, err := os.ReadFile(s.metaPath(uploadID))
 	if err != nil {
 		return UploadMeta{}, err
 	}
 	var meta UploadMeta
-	if err := json.Unmarshal(b, &meta); err != nil {
-		return UploadMeta{}, err
+	if err := s.metaCodec.unmarshal(b, &meta); err != nil {
+		// 写入中途崩溃或被截断的元数据无法恢复（文件名、大小等都在其中），交由调用方按冲突处理
+		return UploadMeta{}, fmt.Errorf("%w: %v", errCorruptMeta, err)
+	}
+	// 兼容旧版本元数据：没有区间信息时，按 uploaded_size 视为连续前缀
+	if len(meta.ReceivedRanges) == 0 && meta.UploadedSize > 0 {
+		meta.ReceivedRanges = [][2]int64{{0, meta.UploadedSize}}
+	}
+	// 缓存未命中说明磁盘上就是最新进度（如重启后，seedFromState 会逐个读入），以它作为落盘间隔的起点；
+	// .part 中超出已记录区间的数据视为未收到，客户端按 received_ranges 重传
+	if !meta.Completed {
+		s.lastSaved.LoadOrStore(uploadID, rangesTotal(meta.ReceivedRanges))
 	}
 	return meta, nil
 }
 
+// saveMeta 先写临时文件再 rename 覆盖，保证元数据要么是旧版本要么是新版本。
+// durable_meta 开启时临时文件与所在目录都会 fsync，崩溃后不会丢失或截断。
 func (s *Server) saveMeta(meta UploadMeta) error {
 	tmp := s.metaPath(meta.UploadID) + ".tmp"
-	b, err := json.MarshalIndent(meta, "", "  ")
+	b, err := s.metaCodec.marshal(meta)
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+	durable := *s.config().Storage.DurableMeta
+	if err := writeFileSync(tmp, b, 0o644, durable); err != nil {
 		return err
 	}
-	return os.Rename(tmp, s.metaPath(meta.UploadID))
+	if err := os.Rename(tmp, s.metaPath(meta.UploadID)); err != nil {
+		return err
+	}
+	if durable {
+		if err := syncDir(s.stateAbs); err != nil {
+			return err
+		}
+	}
+	// 已完成的上传不再变化，以磁盘为准即可，避免缓存无限增长
+	if meta.Completed {
+		s.metaCache.Delete(meta.UploadID)
+		s.lastSaved.Delete(meta.UploadID)
+		s.pending.remove(meta.UploadID)
+	} else {
+		s.metaCache.Store(meta.UploadID, meta)
+		s.lastSaved.Store(meta.UploadID, rangesTotal(meta.ReceivedRanges))
+		s.pending.add(meta)
+	}
+	return nil
 }
 
 func (s *Server) finalAbsPath(rel string) (string, error) {
@@ -636,27 +2625,247 @@ func (s *Server) finalAbsPath(rel string) (string, error) {
 	return abs, nil
 }
 
-func (s *Server) lock(uploadID string) *sync.Mutex {
-	v, _ := s.muByUpload.LoadOrStore(uploadID, &sync.Mutex{})
-	return v.(*sync.Mutex)
+// checkParentInRoot 确认 abs 的父目录解析符号链接后仍在根目录内。finalAbsPath 只检查字面路径，
+// 根目录内指向外部的目录链接（此前的上传或其他进程创建）会让创建目录与 rename 写到根目录之外。
+// 父目录尚不存在时检查最近的已存在祖先，其下的目录由 ensureParentDir 新建，不会是链接。
+func (s *Server) checkParentInRoot(abs string) error {
+	return s.checkInRoot(filepath.Dir(abs))
+}
+
+// checkInRoot 确认 p 解析符号链接后仍在根目录（或 also 中的目录）内，p 不存在时检查最近的已存在祖先。
+// 读取已有文件（下载等）时对文件本身调用，根目录内指向外部文件的链接同样被拒绝。
+func (s *Server) checkInRoot(p string, also ...string) error {
+	var allowed []string
+	for _, dir := range append([]string{s.rootAbs}, also...) {
+		real, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			if dir == s.rootAbs {
+				return err
+			}
+			continue
+		}
+		allowed = append(allowed, real)
+	}
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			for _, dir := range allowed {
+				if isSubpath(real, dir) {
+					return nil
+				}
+			}
+			log.Printf("path %s resolves outside root: %s", p, real)
+			return errStatus(http.StatusBadRequest, "invalid_path", "path escapes root")
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return err
+		}
+		p = parent
+	}
+}
+
+const (
+	overwriteReplace = "overwrite"
+	overwriteReject  = "reject"
+	overwriteRename  = "rename"
+)
+
+var errDestExists = errors.New("destination exists")
+
+// errCorruptMeta 表示元数据文件无法解析（如写入中途崩溃后被截断）。
+var errCorruptMeta = errors.New("corrupt upload metadata")
+
+// applyOverwritePolicy 根据 storage.overwrite 决定最终落盘路径：
+// overwrite 原样返回；reject 在目标已存在时返回 errDestExists；
+// rename 依次尝试 "name (1).ext"、"name (2).ext"… 直到找到不存在的路径。
+func (s *Server) applyOverwritePolicy(finalAbs string) (string, error) {
+	policy := s.config().Storage.Overwrite
+	if policy == overwriteReplace {
+		return finalAbs, nil
+	}
+	// 压缩存储的 <路径>.gz 同样视为目标已存在
+	exists, err := storedExists(finalAbs)
+	if err != nil || !exists {
+		return finalAbs, err
+	}
+	if policy == overwriteReject {
+		return "", errDestExists
+	}
+	dir, name := filepath.Split(finalAbs)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; i <= 10000; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		exists, err := storedExists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+	return "", errDestExists
+}
+
+// uploadLock 是单个上传的锁：嵌入的 Mutex 保护元数据的读改写；
+// part 在分片写盘期间以读锁持有，complete/cancel 等会移走或删除 .part 的操作需要写锁。
+// 两者都要持有时先取 part 再取 Mutex。
+type uploadLock struct {
+	sync.Mutex
+	part sync.RWMutex
+}
+
+func (s *Server) lock(uploadID string) *uploadLock {
+	v, _ := s.muByUpload.LoadOrStore(uploadID, &uploadLock{})
+	return v.(*uploadLock)
 }
 
 // ===== 工具函数 =====
 
-func newUploadID() string {
+const (
+	uploadIDHex    = "hex"    // 32 位小写十六进制（默认）
+	uploadIDBase32 = "base32" // 26 位小写 base32（a-z2-7），更短，同样可直接用于 URL 与文件名
+
+	uploadIDAttempts = 5
+)
+
+// base32ID 为不带填充的小写 base32 编码，输出只含 a-z 与 2-7。
+var base32ID = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// uploadIDRand 是 upload_id 的随机源，测试中替换为固定序列以制造重名。
+var uploadIDRand io.Reader = rand.Reader
+
+// generateUploadID 按 format 生成 128 位随机的 upload_id。
+func generateUploadID(format string) string {
 	var b [16]byte
-	_, _ = rand.Read(b[:])
+	_, _ = io.ReadFull(uploadIDRand, b[:])
+	if format == uploadIDBase32 {
+		return base32ID.EncodeToString(b[:])
+	}
 	return hex.EncodeToString(b[:])
 }
 
-func readJSON(r *http.Request, dst any) error {
+// newUploadID 生成状态目录中尚不存在的 upload_id：与已有元数据（含此前崩溃残留的）重名时重新生成，
+// 避免新会话覆盖旧会话。
+func (s *Server) newUploadID() (string, error) {
+	for i := 0; i < uploadIDAttempts; i++ {
+		id := generateUploadID(s.config().Storage.UploadIDFormat)
+		exists, err := pathExists(s.metaPath(id))
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return id, nil
+		}
+		log.Printf("upload_id %s already exists, regenerating", id)
+	}
+	return "", errors.New("could not allocate a unique upload_id")
+}
+
+// httpError 是带 HTTP 状态码的错误，供多个接口共用的逻辑返回给 handler。
+// code 为机器可读的错误码（见 writeError）；body 中的字段与 error 对象并列输出，用于附带缺失区间、配额等细节。
+type httpError struct {
+	status int
+	code   string
+	msg    string
+	body   map[string]any
+	header map[string]string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+func errStatus(status int, code, msg string) *httpError {
+	return &httpError{status: status, code: code, msg: msg}
+}
+
+// writeHTTPError 输出 err；非 *httpError 一律视为内部错误。
+func writeHTTPError(w http.ResponseWriter, err error) {
+	var he *httpError
+	if !errors.As(err, &he) {
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	for k, v := range he.header {
+		w.Header().Set(k, v)
+	}
+	writeErrorBody(w, he.status, he.code, he.msg, he.body)
+}
+
+// errorObject 是错误响应中 error 字段的内容。
+type errorObject struct {
+	Code      string `json:"code"`                 // 稳定的机器可读错误码，如 invalid_path、chunk_out_of_range
+	Message   string `json:"message"`              // 给人看的说明，措辞可能调整，客户端不应据此判断
+	RequestID string `json:"request_id,omitempty"` // 与 X-Request-Id 响应头相同
+}
+
+// writeError 以统一的 JSON 格式输出错误：{"error":{"code":"...","message":"...","request_id":"..."}}。
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorBody(w, status, code, message, nil)
+}
+
+// writeErrorBody 同 writeError，extra 中的字段与 error 对象并列放在顶层。
+func writeErrorBody(w http.ResponseWriter, status int, code, message string, extra map[string]any) {
+	body := make(map[string]any, len(extra)+1)
+	for k, v := range extra {
+		body[k] = v
+	}
+	body["error"] = errorObject{Code: code, Message: message, RequestID: w.Header().Get("X-Request-Id")}
+	// 与 http.Error 相同，去掉 handler 可能已设置的 Content-Length
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, body)
+}
+
+// writeLoadError 输出 loadMeta 的错误：不存在为 404，其余为 500。
+func writeLoadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, "upload_not_found", "not found")
+		return
+	}
+	if errors.Is(err, errCorruptMeta) {
+		writeError(w, http.StatusConflict, "corrupt_metadata", "upload metadata is corrupt; cancel the upload and start over")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "internal_error", "load failed")
+}
+
+// checkUploadID 校验请求中的 upload_id：缺少时返回 400 missing_upload_id，格式不对时返回 400 invalid_upload_id。
+// upload_id 会直接拼进状态目录下的文件名，所有按它读写元数据与 .part 的接口都要先经过这里。
+// tus 接口例外，格式不对时返回 404，客户端据此重新创建上传。
+func checkUploadID(w http.ResponseWriter, uploadID string) bool {
+	if uploadID == "" {
+		writeError(w, http.StatusBadRequest, "missing_upload_id", "missing upload_id")
+		return false
+	}
+	if !validUploadID(uploadID) {
+		writeError(w, http.StatusBadRequest, "invalid_upload_id", "invalid upload_id")
+		return false
+	}
+	return true
+}
+
+// readJSON 读取并解析 JSON 请求体，大小受 limits.max_json_bytes 约束。
+// 多读一个字节来区分“正好读到上限”与“被截断”：超出上限返回 413，其余解析错误返回 400。
+func (s *Server) readJSON(r *http.Request, dst any) error {
 	defer r.Body.Close()
-	b, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
+	limit := s.config().Limits.MaxJSONBytes
+	tooLarge := errStatus(http.StatusRequestEntityTooLarge, "request_too_large", fmt.Sprintf("request body exceeds %d bytes", limit))
+	if r.ContentLength > limit {
+		return tooLarge
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
 	if err != nil {
-		return err
+		return errStatus(http.StatusBadRequest, "read_body_failed", err.Error())
+	}
+	if int64(len(b)) > limit {
+		return tooLarge
 	}
 	if err := json.Unmarshal(b, dst); err != nil {
-		return err
+		return errStatus(http.StatusBadRequest, "invalid_json", err.Error())
 	}
 	return nil
 }
@@ -667,13 +2876,281 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
-func ensureParentDir(path string) error {
-	return os.MkdirAll(filepath.Dir(path), 0o755)
+// writeJSONOrHead 与 writeJSON 输出相同的内容，但预先计算 Content-Length；
+// HEAD 请求只输出响应头。
+func writeJSONOrHead(w http.ResponseWriter, r *http.Request, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "encode failed")
+		return
+	}
+	b = append(b, '\n')
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(b)
+	}
+}
+
+// writeFileSync 与 os.WriteFile 相同，sync 为 true 时在关闭前 fsync。
+func writeFileSync(path string, data []byte, perm os.FileMode, sync bool) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// syncDir fsync 目录，使其中的 rename/创建在崩溃后可见。Windows 不支持对目录 fsync，直接跳过。
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func pathExists(path string) (bool, error) {
+	_, err := os.Lstat(path)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+const (
+	defaultFileMode os.FileMode = 0o644
+	defaultDirMode  os.FileMode = 0o755
+)
+
+// parseFileMode 解析八进制权限字符串（如 "0640"、"750"），为空时返回 def。
+func parseFileMode(v string, def os.FileMode) (os.FileMode, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(v, "0o"), 8, 32)
+	if err != nil || n > 0o777 {
+		return 0, fmt.Errorf("%q is not an octal permission", v)
+	}
+	return os.FileMode(n), nil
+}
+
+// ensureParentDir 逐级创建 path 的父目录。新建的目录显式 chmod 为 storage.dir_mode，
+// 避免被进程 umask 去掉组写等权限；已存在的目录保持原样。
+func (s *Server) ensureParentDir(path string) error {
+	dir := filepath.Dir(path)
+	var missing []string
+	for {
+		st, err := os.Stat(dir)
+		if err == nil {
+			if !st.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		missing = append(missing, dir)
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], s.dirMode); err != nil {
+			// 并发上传可能同时创建同一目录
+			if errors.Is(err, os.ErrExist) {
+				continue
+			}
+			return err
+		}
+		if err := os.Chmod(missing[i], s.dirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statusClientClosedRequest 沿用 nginx 的 499，仅用于访问日志：此时客户端已经收不到响应。
+const statusClientClosedRequest = 499
+
+// clientGone 判断写分片失败是否因客户端断开（请求被取消或请求体提前结束）。
+func clientGone(r *http.Request, err error) bool {
+	return r.Context().Err() != nil || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// newChunkDecoder 按 Content-Encoding 返回解压 reader（HTTP 的 deflate 指 zlib 格式）。
+func newChunkDecoder(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// drained 判断 r 已经没有剩余数据。
+func drained(r io.Reader) bool {
+	var b [1]byte
+	n, err := io.ReadFull(r, b[:])
+	return n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF)
+}
+
+// checkChunkAlignment 严格分片模式：offset 必须是 chunk_size 的整数倍，
+// 长度必须等于 chunk_size，只有最后一片可以是剩余部分。
+func checkChunkAlignment(meta UploadMeta, offset, length int64) error {
+	if offset%meta.ChunkSize != 0 {
+		return fmt.Errorf("offset %d is not aligned to chunk_size %d", offset, meta.ChunkSize)
+	}
+	// 流式上传不知道哪一片是末片，只要求不超过 chunk_size；短片之后的偏移自然无法对齐
+	if meta.Streaming {
+		if length > meta.ChunkSize {
+			return fmt.Errorf("chunk length %d exceeds chunk_size %d", length, meta.ChunkSize)
+		}
+		return nil
+	}
+	expected := meta.ChunkSize
+	if rest := meta.TotalSize - offset; rest < expected {
+		expected = rest
+	}
+	if length != expected {
+		return fmt.Errorf("chunk length %d at offset %d, expected %d", length, offset, expected)
+	}
+	return nil
+}
+
+// chunkHead 只通过响应头返回进度，与 tus 的 HEAD 相同：Upload-Offset 与 X-Uploaded-Size 均为 uploaded_size，
+// 客户端从该偏移续传即可。
+func (s *Server) chunkHead(w http.ResponseWriter, uploadID string) {
+	mu := s.lock(uploadID)
+	mu.Lock()
+	meta, err := s.loadMeta(uploadID)
+	mu.Unlock()
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+	offset := strconv.FormatInt(meta.UploadedSize, 10)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", offset)
+	w.Header().Set("X-Uploaded-Size", offset)
+	if !meta.Streaming {
+		w.Header().Set("Upload-Length", strconv.FormatInt(meta.TotalSize, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// checkChunkConsistency 分片长度一致性检查：首个非末片的长度记为 observed_chunk_size，
+// 之后的分片必须与之相同；末片（结束于 total_size）的长度必须是 total_size % size（整除时为 size），
+// 尚未记录时 size 取 init 的 chunk_size。调用方需持有该上传的锁。
+func (s *Server) checkChunkConsistency(uploadID string, offset, length int64) error {
+	meta, err := s.loadMeta(uploadID)
+	if err != nil {
+		return err // 由调用方按 writeLoadError 处理
+	}
+	size := cmp.Or(meta.ObservedChunk, meta.ChunkSize)
+	expected := size
+	switch {
+	case !meta.Streaming && offset+length == meta.TotalSize:
+		if rest := meta.TotalSize % size; rest != 0 {
+			expected = rest
+		}
+	case meta.ObservedChunk == 0:
+		// 首个分片：记录长度，后续分片以它为准
+		meta.ObservedChunk = length
+		return s.saveMeta(meta)
+	case meta.Streaming && length < size:
+		// 流式上传不知道哪一片是末片，允许短片
+		return nil
+	}
+	if length != expected {
+		return &httpError{status: http.StatusBadRequest, code: "inconsistent_chunk_size", msg: "inconsistent chunk size", body: map[string]any{
+			"offset":          offset,
+			"length":          length,
+			"expected_length": expected,
+		}}
+	}
+	return nil
+}
+
+// parseContentRange 解析 "bytes start-end/total"，total 为 "*" 时返回 -1。
+func parseContentRange(v string) (start, end, total int64, err error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(v), "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("unsupported unit")
+	}
+	span, totalStr, ok := strings.Cut(strings.TrimSpace(rest), "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("missing total")
+	}
+	startStr, endStr, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("missing range")
+	}
+	if start, err = strconv.ParseInt(startStr, 10, 64); err != nil || start < 0 {
+		return 0, 0, 0, fmt.Errorf("invalid start")
+	}
+	if end, err = strconv.ParseInt(endStr, 10, 64); err != nil || end < start {
+		return 0, 0, 0, fmt.Errorf("invalid end")
+	}
+	total = -1
+	if totalStr != "*" {
+		if total, err = strconv.ParseInt(totalStr, 10, 64); err != nil || total <= end {
+			return 0, 0, 0, fmt.Errorf("invalid total")
+		}
+	}
+	return start, end, total, nil
+}
+
+// isHexSHA256 判断 s 是否为 64 位小写十六进制的 SHA-256 摘要。
+func isHexSHA256(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
 }
 
+// sanitizeRelPath 将用户提供的路径规范化为 root_dir 下的相对路径。
+// 除 ".." 外，还拒绝控制字符、非法 UTF-8、UNC 前缀，以及只由点号和 NFKC 会折叠成点号的字符组成的
+// 路径段（如全角 "．．"，见 isDotSegment），这类写法在某些文件系统或下游工具上可能被还原成 ".."。
 func sanitizeRelPath(p string) (string, error) {
-	p = strings.ReplaceAll(p, "\\", "/")
+	if !utf8.ValidString(p) {
+		return "", fmt.Errorf("invalid path: not valid UTF-8")
+	}
+	for _, r := range p {
+		if r == 0 || unicode.IsControl(r) {
+			return "", fmt.Errorf("invalid path: control character")
+		}
+	}
 	p = strings.TrimSpace(p)
+	// \\server\share 与 //server/share 在 Windows 上指向网络位置
+	if len(p) >= 2 && isPathSep(p[0]) && isPathSep(p[1]) {
+		return "", fmt.Errorf("invalid path: UNC prefix")
+	}
+	p = strings.ReplaceAll(p, "\\", "/")
 	p = strings.TrimPrefix(p, "/")
 	p = strings.TrimPrefix(p, "./")
 	if p == "" {
@@ -687,9 +3164,102 @@ func sanitizeRelPath(p string) (string, error) {
 	if filepath.VolumeName(clean) != "" {
 		return "", fmt.Errorf("invalid path")
 	}
+	for _, seg := range strings.Split(clean, string(filepath.Separator)) {
+		if isDotSegment(seg) {
+			return "", fmt.Errorf("invalid path: dot segment %q", seg)
+		}
+		if hasEncodedSeparator(seg) {
+			return "", fmt.Errorf("invalid path: percent-encoded separator in %q", seg)
+		}
+	}
 	return clean, nil
 }
 
+// checkPathNames 按 storage.max_path_bytes / max_segment_bytes / max_path_depth 检查路径长度与层数，
+// 开启 storage.portable_names 时再拒绝在 Windows 上非法的名称，避免到 complete 时才在 rename 上失败。
+// rel 需已经过 sanitizeRelPath；出错时返回 400，并指出有问题的路径段。
+func (s *Server) checkPathNames(rel string) error {
+	cfg := s.config().Storage
+	if len(rel) > cfg.MaxPathBytes {
+		return errStatus(http.StatusBadRequest, "path_too_long", fmt.Sprintf("path too long: %d bytes, max %d", len(rel), cfg.MaxPathBytes))
+	}
+	segs := strings.Split(rel, string(filepath.Separator))
+	if len(segs) > cfg.MaxPathDepth {
+		return errStatus(http.StatusBadRequest, "path_too_deep", fmt.Sprintf("path too deep: %d segments, max %d", len(segs), cfg.MaxPathDepth))
+	}
+	for _, seg := range segs {
+		if len(seg) > cfg.MaxSegmentBytes {
+			return errStatus(http.StatusBadRequest, "invalid_path_segment", fmt.Sprintf("invalid path segment %q: longer than %d bytes", seg, cfg.MaxSegmentBytes))
+		}
+		if !cfg.PortableNames {
+			continue
+		}
+		if reason := nonPortableReason(seg); reason != "" {
+			return errStatus(http.StatusBadRequest, "invalid_path_segment", fmt.Sprintf("invalid path segment %q: %s", seg, reason))
+		}
+	}
+	return nil
+}
+
+// windowsReservedNames 是 Windows 上不能用作文件名的设备名（不区分大小写，带扩展名同样保留）。
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// nonPortableReason 返回路径段在 Windows 上非法的原因，合法时返回空串。
+func nonPortableReason(seg string) string {
+	if i := strings.IndexAny(seg, `<>:"|?*`); i >= 0 {
+		return fmt.Sprintf("character %q is not allowed", seg[i])
+	}
+	if strings.HasSuffix(seg, ".") || strings.HasSuffix(seg, " ") {
+		return "trailing dot or space"
+	}
+	base, _, _ := strings.Cut(seg, ".")
+	if windowsReservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		return "reserved name"
+	}
+	return ""
+}
+
+func isPathSep(c byte) bool {
+	return c == '/' || c == '\\'
+}
+
+// isDotSegment 判断路径段去掉空白与不可见格式字符后是否只由点号组成。不做完整的 Unicode 规范化，
+// 而是逐个识别 NFKC 折叠结果只有点号的全部字符（U+2024–2026、U+FE19、U+FE30、U+FE52、U+FF0E），
+// 效果与先折叠再判断相同。只剩点号的段在 Windows 上会被截掉末尾的点和空格，统一拒绝。
+func isDotSegment(seg string) bool {
+	dots := 0
+	for _, r := range seg {
+		switch {
+		case r == '.' || r == '\uFF0E' || r == '\uFE52' || r == '\u2024': // 全角、小型句点与单点前导符
+			dots++
+		case r == '\u2025' || r == '\uFE30': // 两点前导符 ‥ 及其竖排形式
+			dots += 2
+		case r == '\u2026' || r == '\uFE19': // 省略号 … 及其竖排形式
+			dots += 3
+		case unicode.IsSpace(r) || unicode.Is(unicode.Cf, r):
+		default:
+			return false
+		}
+	}
+	return dots > 0
+}
+
+// hasEncodedSeparator 检测 %2e / %2f / %5c 等编码后的点号与分隔符。
+// 查询参数已被解码过一次，残留的编码序列说明是二次编码，下游再解码一次就可能变成 "../"。
+func hasEncodedSeparator(seg string) bool {
+	lower := strings.ToLower(seg)
+	for _, enc := range []string{"%2e", "%2f", "%5c", "%00"} {
+		if strings.Contains(lower, enc) {
+			return true
+		}
+	}
+	return false
+}
+
 func isSubpath(childAbs, rootAbs string) bool {
 	rootAbs = filepath.Clean(rootAbs)
 	childAbs = filepath.Clean(childAbs)
@@ -707,9 +3277,15 @@ func maxInt64(a, b int64) int64 {
 	return b
 }
 
-func copyToWriterAt(f *os.File, r io.Reader, offset int64) (int64, error) {
-	// 手动循环，避免大 buffer；同时保证按 offset 写入
-	buf := make([]byte, 1<<20) // 1MB 缓冲，减少 syscalls 提升吞吐
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func copyToWriterAt(f *os.File, r io.Reader, offset int64, buf []byte) (int64, error) {
+	// 手动循环，按 offset 写入；buf 由调用方提供（见 limits.copy_buffer_bytes）
 	var total int64
 	for {
 		n, err := r.Read(buf)
@@ -732,26 +3308,21 @@ func copyToWriterAt(f *os.File, r io.Reader, offset int64) (int64, error) {
 	}
 }
 
+// handler 按顺序组装中间件：请求 ID 在最外层（仅次于解析客户端地址）分配，鉴权失败、预检等
+// 由中间件直接写出的响应与访问日志都带同一个 request_id；访问日志包住其余中间件，响应压缩紧随其后，
+// 日志记录的是压缩后的字节数；CORS 在鉴权之前：浏览器预检请求不携带 Authorization。
+func (s *Server) handler(cfg Config, routes *routeTable) http.Handler {
+	return s.withClientInfo(withRequestID(withLogging(withGzip(cfg.Server.GzipResponses, cfg.Server.GzipMinBytes,
+		withCORS(cfg.Server.CORS, routes, withAuth(cfg.Auth.Keys, cfg.Auth.AdminKeys, routes.mux))))))
+}
+
 func withRequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		id := r.Header.Get("X-Request-Id")
 		if id == "" {
-			id = newUploadID()
+			id = newRequestID()
 		}
 		w.Header().Set("X-Request-Id", id)
-		next.ServeHTTP(w, r)
-	})
-}
-
-func withCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,X-Chunk-Offset,X-Request-Id")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withRequestIDContext(r, id))
 	})
 }
@@ -0,0 +1,816 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// 处理函数的日志在测试中没有意义，-v 时保留便于排查
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer 在临时目录中以默认配置创建 Server，opts 在 loadConfig 之后修改配置。
+func newTestServer(tb testing.TB, opts ...func(*Config)) *Server {
+	tb.Helper()
+	return newTestServerAt(tb, filepath.Join(tb.TempDir(), "root"), opts...)
+}
+
+// newTestServerAt 同 newTestServer，使用给定的 root_dir（用于模拟重启后在同一目录上重建）。
+func newTestServerAt(tb testing.TB, root string, opts ...func(*Config)) *Server {
+	tb.Helper()
+	cfgPath := filepath.Join(tb.TempDir(), "config.yaml")
+	if err := os.WriteFile(cfgPath, []byte("storage:\n  root_dir: "+strconv.Quote(root)+"\n"), 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	cfg, err := loadConfig(cfgPath)
+	if err != nil {
+		tb.Fatalf("load config: %v", err)
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	s, err := newServer(cfg)
+	if err != nil {
+		tb.Fatalf("new server: %v", err)
+	}
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// newTestUpload 创建一个上传会话，total 为 0 时为流式上传。
+func newTestUpload(tb testing.TB, s *Server, path string, total, chunkSize int64) UploadMeta {
+	tb.Helper()
+	meta, _, err := s.newUpload(initReq{Path: path, TotalSize: total, ChunkSize: chunkSize})
+	if err != nil {
+		tb.Fatalf("init %s: %v", path, err)
+	}
+	return meta
+}
+
+// putChunk 以 PUT 上传 offset 处的分片，返回响应。
+func putChunk(s *Server, uploadID string, offset int64, data []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, "/api/v1/uploads/chunk?upload_id="+uploadID, bytes.NewReader(data))
+	r.Header.Set("X-Chunk-Offset", strconv.FormatInt(offset, 10))
+	w := httptest.NewRecorder()
+	s.handleChunk(w, r)
+	return w
+}
+
+// completeUpload 调用 complete，query 为附加的查询参数（如 "&total_size=10"）。
+func completeUpload(s *Server, uploadID, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/uploads/complete?upload_id="+uploadID+query, nil)
+	w := httptest.NewRecorder()
+	s.handleComplete(w, r)
+	return w
+}
+
+// errorCode 取出错误响应中的 error.code。
+func errorCode(tb testing.TB, w *httptest.ResponseRecorder) string {
+	tb.Helper()
+	var body struct {
+		Error errorObject `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		tb.Fatalf("decode error body %q: %v", w.Body.String(), err)
+	}
+	return body.Error.Code
+}
+
+// 流式上传在 init 时大小未知，配额要按每个分片追加后的大小检查。
+func TestStreamingChunkQuota(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Quotas = map[string]int64{"q": 10}
+	})
+	meta := newTestUpload(t, s, "q/stream.bin", 0, 8)
+	if w := putChunk(s, meta.UploadID, 0, []byte("123456")); w.Code != http.StatusOK {
+		t.Fatalf("first chunk: status %d: %s", w.Code, w.Body)
+	}
+	w := putChunk(s, meta.UploadID, 6, []byte("789012"))
+	if w.Code != http.StatusForbidden || errorCode(t, w) != "quota_exceeded" {
+		t.Fatalf("chunk past quota: status %d: %s", w.Code, w.Body)
+	}
+	if w := putChunk(s, meta.UploadID, 6, []byte("7890")); w.Code != http.StatusOK {
+		t.Fatalf("chunk within quota: status %d: %s", w.Code, w.Body)
+	}
+	if w := completeUpload(s, meta.UploadID, "&total_size=10"); w.Code != http.StatusOK {
+		t.Fatalf("complete: status %d: %s", w.Code, w.Body)
+	}
+}
+
+// 根目录内指向外部的目录链接不能让 complete 把文件放到根目录之外；指向根目录内的链接照常可用。
+func TestCompleteSymlinkedParent(t *testing.T) {
+	s := newTestServer(t)
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(s.rootAbs, "evil")); err != nil {
+		t.Fatal(err)
+	}
+	meta := newTestUpload(t, s, "evil/a.bin", 4, 4)
+	if w := putChunk(s, meta.UploadID, 0, []byte("abcd")); w.Code != http.StatusOK {
+		t.Fatalf("chunk: status %d: %s", w.Code, w.Body)
+	}
+	w := completeUpload(s, meta.UploadID, "")
+	if w.Code != http.StatusBadRequest || errorCode(t, w) != "invalid_path" {
+		t.Fatalf("complete through escaping link: status %d: %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "a.bin")); !os.IsNotExist(err) {
+		t.Fatalf("file written outside root: %v", err)
+	}
+
+	if err := os.Mkdir(filepath.Join(s.rootAbs, "real"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(s.rootAbs, "real"), filepath.Join(s.rootAbs, "link")); err != nil {
+		t.Fatal(err)
+	}
+	meta = newTestUpload(t, s, "link/sub/b.bin", 4, 4)
+	if w := putChunk(s, meta.UploadID, 0, []byte("efgh")); w.Code != http.StatusOK {
+		t.Fatalf("chunk: status %d: %s", w.Code, w.Body)
+	}
+	if w := completeUpload(s, meta.UploadID, ""); w.Code != http.StatusOK {
+		t.Fatalf("complete through in-root link: status %d: %s", w.Code, w.Body)
+	}
+	if b, err := os.ReadFile(filepath.Join(s.rootAbs, "real", "sub", "b.bin")); err != nil || string(b) != "efgh" {
+		t.Fatalf("placed file: %q %v", b, err)
+	}
+}
+
+// sanitizeRelPath 的对抗性输入：各种形式的 ..、编码的分隔符、前导 /、UNC 与 NUL 都不能逃出根目录。
+func TestSanitizeRelPath(t *testing.T) {
+	accepted := map[string]string{
+		"a/b.txt":      "a/b.txt",
+		"/abs/x":       "abs/x", // 前导 / 按相对路径处理
+		"./a":          "a",
+		"a//b":         "a/b",
+		`a\b`:          "a/b",
+		"a/./b":        "a/b",
+		"a..b/...c":    "a..b/...c",
+		".hidden":      ".hidden",
+		"  spaced.txt": "spaced.txt",
+	}
+	for in, want := range accepted {
+		got, err := sanitizeRelPath(in)
+		if err != nil || got != filepath.FromSlash(want) {
+			t.Errorf("sanitizeRelPath(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+
+	rejected := []string{
+		"", "/", ".", "./", "..", "../a", "a/../../b", "/../etc/passwd", `..\a`, `a\..\..\b`,
+		"a/..", "a/b/../../..",
+		"%2e%2e/a", "a/%2e%2e%2fb", "..%2fetc", "%2E%2E%5Cwin", "a%5c..%5cb", "a%00b",
+		"a\x00b", "\x00", "a/b\x00.txt", "a\nb", "\xff\xfe",
+		"//server/share/a", `\\server\share`, `\/server`,
+		"\uff0e\uff0e/a", "\u2025/a", " .. /a", ".\u200b./a", "\u2026", "\ufe19", "\ufe30/a", "\ufe52\u2024",
+	}
+	for _, in := range rejected {
+		if got, err := sanitizeRelPath(in); err == nil {
+			t.Errorf("sanitizeRelPath(%q) = %q, want error", in, got)
+		}
+	}
+}
+
+// 开启 portable_names 后，盘符、结尾的点或空格、保留设备名等在 Windows 上有特殊含义的名称同样被拒绝。
+func TestCheckPathNamesPortable(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Storage.PortableNames = true })
+	for _, in := range []string{
+		"C:/Windows/x", `C:\x`, "c:x", "a/D:", "a/b.", "a /b", "con.txt", "a/NUL", "Com1.log", "a<b", `a"b`, "a|b", "a?b", "a*b",
+	} {
+		rel, err := sanitizeRelPath(in)
+		if err == nil {
+			err = s.checkPathNames(rel)
+		}
+		if err == nil {
+			t.Errorf("%q accepted, want error", in)
+		}
+	}
+	for _, in := range []string{"a/b.txt", "console.txt", "a.b/c d", "lpt10"} {
+		rel, err := sanitizeRelPath(in)
+		if err == nil {
+			err = s.checkPathNames(rel)
+		}
+		if err != nil {
+			t.Errorf("%q rejected: %v", in, err)
+		}
+	}
+}
+
+// fixedUploadIDs 让 generateUploadID 依次使用 ids 对应的随机字节，测试结束后恢复。
+func fixedUploadIDs(t *testing.T, ids ...[16]byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, id := range ids {
+		buf.Write(id[:])
+	}
+	orig := uploadIDRand
+	uploadIDRand = &buf
+	t.Cleanup(func() { uploadIDRand = orig })
+}
+
+// 生成的 upload_id 与状态目录中已有的元数据重名时重新生成，不覆盖旧会话。
+func TestNewUploadIDRetriesOnCollision(t *testing.T) {
+	s := newTestServer(t)
+	taken, fresh := [16]byte{1}, [16]byte{2}
+	takenID := hex.EncodeToString(taken[:])
+	if err := os.WriteFile(s.metaPath(takenID), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fixedUploadIDs(t, taken, taken, fresh)
+	meta, _, err := s.newUpload(initReq{Path: "c/a.bin", TotalSize: 4, ChunkSize: 4})
+	if err != nil {
+		t.Fatalf("newUpload: %v", err)
+	}
+	if want := hex.EncodeToString(fresh[:]); meta.UploadID != want {
+		t.Fatalf("upload_id %s, want %s", meta.UploadID, want)
+	}
+	if b, _ := os.ReadFile(s.metaPath(takenID)); string(b) != "{}" {
+		t.Fatalf("existing meta overwritten: %q", b)
+	}
+
+	// 每次都重名时放弃，返回 500 而不是覆盖
+	ids := make([][16]byte, uploadIDAttempts)
+	for i := range ids {
+		ids[i] = taken
+	}
+	fixedUploadIDs(t, ids...)
+	_, _, err = s.newUpload(initReq{Path: "c/b.bin", TotalSize: 4, ChunkSize: 4})
+	if he, ok := err.(*httpError); !ok || he.status != http.StatusInternalServerError {
+		t.Fatalf("got %v, want 500 after %d collisions", err, uploadIDAttempts)
+	}
+}
+
+// skip_duplicate_chunks：区间已全部接收的分片不再写盘，部分重叠的分片照常写入。
+func TestSkipDuplicateChunks(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Limits.SkipDuplicateChunks = true })
+	meta := newTestUpload(t, s, "dup/a.bin", 12, 4)
+	if w := putChunk(s, meta.UploadID, 0, []byte("aaaa")); w.Code != http.StatusOK {
+		t.Fatalf("chunk: status %d: %s", w.Code, w.Body)
+	}
+	part := func() string {
+		b, err := os.ReadFile(s.partPath(meta.UploadID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	t.Run("fully covered", func(t *testing.T) {
+		w := putChunk(s, meta.UploadID, 0, []byte("XXXX"))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"uploaded_size":4`) {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		if got := part()[:4]; got != "aaaa" {
+			t.Fatalf("covered range rewritten: %q", got)
+		}
+	})
+
+	t.Run("partially covered", func(t *testing.T) {
+		w := putChunk(s, meta.UploadID, 2, []byte("bbbb"))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"uploaded_size":6`) {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		if got := part()[:6]; got != "aabbbb" {
+			t.Fatalf("partial chunk not written: %q", got)
+		}
+		m, err := s.loadMeta(meta.UploadID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.ReceivedRanges) != 1 || m.ReceivedRanges[0] != [2]int64{0, 6} {
+			t.Fatalf("received_ranges %v", m.ReceivedRanges)
+		}
+	})
+}
+
+// 截断或损坏的元数据返回 errCorruptMeta，接口以 409 corrupt_metadata 区分，而不是笼统的 500。
+func TestLoadMetaCorrupt(t *testing.T) {
+	s := newTestServer(t)
+	cases := []struct {
+		name string
+		data func(valid []byte) []byte
+	}{
+		{"truncated", func(valid []byte) []byte { return valid[:len(valid)/2] }},
+		{"empty", func([]byte) []byte { return nil }},
+		{"garbage", func([]byte) []byte { return []byte("\x00\x01not json") }},
+		{"wrong type", func([]byte) []byte { return []byte(`{"total_size":"ten"}`) }},
+	}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			meta := newTestUpload(t, s, fmt.Sprintf("corrupt/%d.bin", i), 8, 4)
+			valid, err := os.ReadFile(s.metaPath(meta.UploadID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(s.metaPath(meta.UploadID), tc.data(valid), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			// 模拟重启后缓存为空，只能读盘
+			s.metaCache.Delete(meta.UploadID)
+
+			if _, err := s.loadMeta(meta.UploadID); !errors.Is(err, errCorruptMeta) {
+				t.Fatalf("loadMeta: got %v, want errCorruptMeta", err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/uploads/status?upload_id="+meta.UploadID, nil)
+			w := httptest.NewRecorder()
+			s.handleStatus(w, r)
+			if w.Code != http.StatusConflict || errorCode(t, w) != "corrupt_metadata" {
+				t.Fatalf("status: %d %s", w.Code, w.Body)
+			}
+			if w := putChunk(s, meta.UploadID, 0, []byte("abcd")); w.Code != http.StatusConflict || errorCode(t, w) != "corrupt_metadata" {
+				t.Fatalf("chunk: %d %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+// saveMeta 先写临时文件再 rename，并发读取者看到的元数据文件始终是完整的 JSON，结束后不留 .tmp。
+func TestSaveMetaAtomic(t *testing.T) {
+	s := newTestServer(t)
+	meta := newTestUpload(t, s, "atomic/a.bin", 1<<20, 16)
+	path := s.metaPath(meta.UploadID)
+
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(readErr)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			var m UploadMeta
+			if err := json.Unmarshal(b, &m); err != nil {
+				readErr <- fmt.Errorf("invalid meta (%d bytes): %v", len(b), err)
+				return
+			}
+		}
+	}()
+
+	// 区间数逐步增加，每次写入的文件长度都不同，非原子写入时读者会读到半截内容
+	for i := 0; i < 500; i++ {
+		meta.ReceivedRanges = append(meta.ReceivedRanges, [2]int64{int64(i) * 32, int64(i)*32 + 16})
+		if err := s.saveMeta(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(s.stateAbs, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Fatalf("leftover temp files: %v", matches)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got UploadMeta
+	if err := json.Unmarshal(b, &got); err != nil || len(got.ReceivedRanges) != 500 {
+		t.Fatalf("final meta: %d ranges, err %v", len(got.ReceivedRanges), err)
+	}
+}
+
+// 并发乱序写入分片：接收区间正确合并，uploaded_size 只统计从 0 开始的连续前缀（配合 -race 运行）。
+func TestConcurrentOutOfOrderChunks(t *testing.T) {
+	const (
+		chunks    = 64
+		chunkSize = 1024
+	)
+	s := newTestServer(t)
+	meta := newTestUpload(t, s, "race/a.bin", chunks*chunkSize, chunkSize)
+	data := make([]byte, chunks*chunkSize)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	send := func(idx []int) {
+		t.Helper()
+		var wg sync.WaitGroup
+		for _, i := range idx {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				off := int64(i) * chunkSize
+				if w := putChunk(s, meta.UploadID, off, data[off:off+chunkSize]); w.Code != http.StatusOK {
+					t.Errorf("chunk %d: status %d: %s", i, w.Code, w.Body)
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+	check := func(ranges [][2]int64, uploaded int64) {
+		t.Helper()
+		m, err := s.loadMeta(meta.UploadID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(m.ReceivedRanges, ranges) || m.UploadedSize != uploaded {
+			t.Fatalf("received_ranges %v uploaded_size %d, want %v %d", m.ReceivedRanges, m.UploadedSize, ranges, uploaded)
+		}
+	}
+
+	// 先倒序发奇数分片：前缀缺第 0 片，uploaded_size 仍为 0
+	var odd, even []int
+	for i := chunks - 1; i >= 0; i-- {
+		if i%2 == 1 {
+			odd = append(odd, i)
+		} else {
+			even = append(even, i)
+		}
+	}
+	send(odd)
+	var want [][2]int64
+	for i := 1; i < chunks; i += 2 {
+		want = append(want, [2]int64{int64(i) * chunkSize, int64(i+1) * chunkSize})
+	}
+	check(want, 0)
+
+	send(even)
+	check([][2]int64{{0, chunks * chunkSize}}, chunks*chunkSize)
+	got, err := os.ReadFile(s.partPath(meta.UploadID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal(".part content mismatch")
+	}
+}
+
+// 重启后在同一目录上重建 Server：正常关闭时未落盘的进度由 Close 写出，续传从磁盘记录的进度继续；
+// 崩溃时内存中的进度丢失，以磁盘上的元数据为准，客户端重传未记录的区间即可完成。
+func TestResumeAfterRestart(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	status := func(s *Server, id string) string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/uploads/status?upload_id="+id, nil)
+		w := httptest.NewRecorder()
+		s.handleStatus(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status: %d %s", w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+	diskReceived := func(s *Server, id string) [][2]int64 {
+		t.Helper()
+		b, err := os.ReadFile(s.metaPath(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m UploadMeta
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m.ReceivedRanges
+	}
+	finish := func(s *Server, root, id string, from int64) {
+		t.Helper()
+		for off := from; off < int64(len(data)); off += 4 {
+			if w := putChunk(s, id, off, data[off:off+4]); w.Code != http.StatusOK {
+				t.Fatalf("chunk %d after restart: %d %s", off, w.Code, w.Body)
+			}
+		}
+		if w := completeUpload(s, id, ""); w.Code != http.StatusOK {
+			t.Fatalf("complete: %d %s", w.Code, w.Body)
+		}
+		got, err := os.ReadFile(filepath.Join(root, "r", "a.bin"))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("final file %q, err %v", got, err)
+		}
+	}
+
+	t.Run("graceful", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "root")
+		a := newTestServerAt(t, root)
+		id := newTestUpload(t, a, "r/a.bin", 16, 4).UploadID
+		for off := int64(0); off < 8; off += 4 {
+			if w := putChunk(a, id, off, data[off:off+4]); w.Code != http.StatusOK {
+				t.Fatalf("chunk %d: %d %s", off, w.Code, w.Body)
+			}
+		}
+		a.Close()
+
+		b := newTestServerAt(t, root)
+		b.metaSaveInterval = 6
+		if body := status(b, id); !strings.Contains(body, `"uploaded_size":8`) {
+			t.Fatalf("status after restart: %s", body)
+		}
+		if n := b.activeUploads.Load(); n != 1 {
+			t.Fatalf("activeUploads = %d, want 1", n)
+		}
+		// lastSaved 已按磁盘进度补齐：下一个分片只新增 4 字节，不足落盘间隔，不会立即重写元数据
+		if w := putChunk(b, id, 8, data[8:12]); w.Code != http.StatusOK {
+			t.Fatalf("chunk 8: %d %s", w.Code, w.Body)
+		}
+		if got := diskReceived(b, id); !slices.Equal(got, [][2]int64{{0, 8}}) {
+			t.Fatalf("meta rewritten after restart: %v", got)
+		}
+		finish(b, root, id, 12)
+	})
+
+	t.Run("crash", func(t *testing.T) {
+		root := filepath.Join(t.TempDir(), "root")
+		a := newTestServerAt(t, root)
+		id := newTestUpload(t, a, "r/a.bin", 16, 4).UploadID
+		for off := int64(0); off < 8; off += 4 {
+			if w := putChunk(a, id, off, data[off:off+4]); w.Code != http.StatusOK {
+				t.Fatalf("chunk %d: %d %s", off, w.Code, w.Body)
+			}
+		}
+		// 崩溃：内存中的进度丢失，.part 中已写入的数据未记录在元数据里
+		a.metaCache.Delete(id)
+
+		b := newTestServerAt(t, root)
+		if body := status(b, id); !strings.Contains(body, `"uploaded_size":0`) {
+			t.Fatalf("status after crash: %s", body)
+		}
+		finish(b, root, id, 0)
+	})
+}
+
+// BenchmarkCopyBuffer 以不同的 copy_buffer_bytes 把 16MB 分片写入 .part，缓冲区越小系统调用越多。
+func BenchmarkCopyBuffer(b *testing.B) {
+	const chunk = 16 << 20
+	data := make([]byte, chunk)
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20, 4 << 20, 16 << 20} {
+		b.Run(fmt.Sprintf("copy_buffer_bytes=%d", size), func(b *testing.B) {
+			f, err := os.Create(filepath.Join(b.TempDir(), "bench.part"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.Close()
+			buf := make([]byte, size)
+			b.SetBytes(chunk)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := copyToWriterAt(f, bytes.NewReader(data), 0, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// 所有按 upload_id 读写状态目录的接口对格式不正确的 upload_id 一律返回 400 invalid_upload_id，
+// 不会拼出状态目录之外的路径；tus 接口按协议返回 404。
+func TestInvalidUploadID(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Auth.AdminKeys = []string{"admin-key"} })
+	valid := newTestUpload(t, s, "id/a.bin", 8, 8).UploadID
+
+	type call func(id string) *httptest.ResponseRecorder
+	query := func(method, path string, h http.HandlerFunc) call {
+		return func(id string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(method, path+"upload_id="+url.QueryEscape(id), nil))
+			return w
+		}
+	}
+	pathValue := func(method, pattern string, h http.HandlerFunc) call {
+		return func(id string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(method, strings.Replace(pattern, "{upload_id}", url.PathEscape(id), 1), nil)
+			r.SetPathValue("upload_id", id)
+			r.Header.Set("Authorization", "Bearer admin-key")
+			w := httptest.NewRecorder()
+			h(w, r)
+			return w
+		}
+	}
+	handlers := map[string]call{
+		"status":       query(http.MethodGet, "/api/v1/uploads/status?", s.handleStatus),
+		"status wait":  query(http.MethodGet, "/api/v1/uploads/status?wait_for=1&timeout=1ms&", s.handleStatus),
+		"chunk":        query(http.MethodPut, "/api/v1/uploads/chunk?", s.handleChunk),
+		"chunk HEAD":   query(http.MethodHead, "/api/v1/uploads/chunk?", s.handleChunk),
+		"complete":     query(http.MethodPost, "/api/v1/uploads/complete?", s.handleComplete),
+		"verify":       query(http.MethodGet, "/api/v1/uploads/verify?", s.handleVerify),
+		"events":       query(http.MethodGet, "/api/v1/uploads/events?", s.handleEvents),
+		"cancel":       query(http.MethodPost, "/api/v1/uploads/cancel?", s.handleCancel),
+		"force cancel": pathValue(http.MethodPost, "/api/v1/admin/uploads/{upload_id}/force-cancel", s.handleForceCancel),
+		"force complete": pathValue(http.MethodPost, "/api/v1/admin/uploads/{upload_id}/force-complete",
+			s.handleForceComplete),
+	}
+	ids := []string{
+		"../" + valid,
+		"..%2f..%2fetc%2fpasswd",
+		strings.ToUpper(valid),
+		valid[:31],
+		valid + "0",
+		valid[:31] + "/",
+		valid[:31] + "\x00",
+	}
+	for name, h := range handlers {
+		for _, id := range ids {
+			w := h(id)
+			if w.Code != http.StatusBadRequest || errorCode(t, w) != "invalid_upload_id" {
+				t.Errorf("%s %q: %d %s", name, id, w.Code, w.Body)
+			}
+		}
+	}
+	// DELETE /api/v1/uploads/{upload_id} 与查询参数形式一致
+	if w := pathValue(http.MethodDelete, "/api/v1/uploads/{upload_id}", s.handleCancel)("../" + valid); w.Code != http.StatusBadRequest {
+		t.Errorf("DELETE: %d %s", w.Code, w.Body)
+	}
+	// 会话仍在，未受上述请求影响
+	if _, err := s.loadMeta(valid); err != nil {
+		t.Fatalf("valid upload affected: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.handleTus(w, tusRequest(http.MethodHead, tusBasePath+strings.ToUpper(valid)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("tus HEAD: %d, want 404", w.Code)
+	}
+}
+
+func TestCheckStateSuffixes(t *testing.T) {
+	for _, tc := range []struct {
+		part, meta string
+		ok         bool
+	}{
+		{".part", ".json", true},
+		{".p", ".m", true},
+		{".dat", ".dat", false},
+		{".part", ".json.part", false},
+		{".x.json", ".json", false},
+		{"a/b", ".json", false},
+		{".part", `\m`, false},
+		{"..", ".json", false},
+		{".part", "\x00", false},
+		{".part", ".meta.tmp", false},
+	} {
+		if err := checkStateSuffixes(tc.part, tc.meta); (err == nil) != tc.ok {
+			t.Errorf("checkStateSuffixes(%q, %q) = %v, want ok=%v", tc.part, tc.meta, err, tc.ok)
+		}
+	}
+}
+
+// 自定义后缀下上传列表与过期回收只识别当前后缀的元数据，回收时同时删除对应的数据文件。
+func TestCustomSuffixListAndGC(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Storage.PartSuffix = ".p"
+		cfg.Storage.MetaSuffix = ".m"
+	})
+	keep := newTestUpload(t, s, "g/keep.bin", 8, 4)
+	stale := newTestUpload(t, s, "g/stale.bin", 8, 4)
+	past := time.Now().Add(-time.Minute)
+	stale.ExpiresAt = &past
+	if err := s.saveMeta(stale); err != nil {
+		t.Fatal(err)
+	}
+	// 其它后缀与非 upload_id 的文件不属于任何上传
+	for _, name := range []string{keep.UploadID + ".json", "notes.m"} {
+		if err := os.WriteFile(filepath.Join(s.stateAbs, name), []byte("{}"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.handleList(w, httptest.NewRequest(http.MethodGet, "/api/v1/uploads/list", nil))
+	var list listResp
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK || list.Total != 2 {
+		t.Fatalf("list: %d %s", w.Code, w.Body)
+	}
+
+	if n := s.collectStale(time.Hour); n != 1 {
+		t.Fatalf("collectStale reclaimed %d, want 1", n)
+	}
+	for _, name := range []string{stale.UploadID + ".p", stale.UploadID + ".m"} {
+		if _, err := os.Stat(filepath.Join(s.stateAbs, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s not reclaimed: %v", name, err)
+		}
+	}
+	for _, name := range []string{keep.UploadID + ".p", keep.UploadID + ".m"} {
+		if _, err := os.Stat(filepath.Join(s.stateAbs, name)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+// resume 只匹配同一请求路径下未完成的上传：重启后照常找到，完成或取消后不再返回。
+func TestFindResumable(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	a := newTestServerAt(t, root)
+	req := initReq{Path: "res/a.bin", TotalSize: 8, ChunkSize: 4, Resume: true}
+	id := newTestUpload(t, a, "res/a.bin", 8, 4).UploadID
+	newTestUpload(t, a, "res/other.bin", 8, 4)
+	if meta, ok := a.findResumable(req); !ok || meta.UploadID != id {
+		t.Fatalf("findResumable = %s, %v; want %s", meta.UploadID, ok, id)
+	}
+	if _, ok := a.findResumable(initReq{Path: "res/a.bin", TotalSize: 9, ChunkSize: 4}); ok {
+		t.Fatal("matched an upload with a different total_size")
+	}
+	a.Close()
+
+	b := newTestServerAt(t, root)
+	if meta, ok := b.findResumable(req); !ok || meta.UploadID != id {
+		t.Fatalf("after restart: findResumable = %s, %v; want %s", meta.UploadID, ok, id)
+	}
+	for off := int64(0); off < 8; off += 4 {
+		if w := putChunk(b, id, off, []byte("abcd")); w.Code != http.StatusOK {
+			t.Fatalf("chunk %d: %d %s", off, w.Code, w.Body)
+		}
+	}
+	if w := completeUpload(b, id, ""); w.Code != http.StatusOK {
+		t.Fatalf("complete: %d %s", w.Code, w.Body)
+	}
+	if meta, ok := b.findResumable(req); ok {
+		t.Fatalf("completed upload %s returned for resume", meta.UploadID)
+	}
+
+	id = newTestUpload(t, b, "res/a.bin", 8, 4).UploadID
+	mu := b.lock(id)
+	mu.Lock()
+	b.removeUpload(id)
+	mu.Unlock()
+	if meta, ok := b.findResumable(req); ok {
+		t.Fatalf("cancelled upload %s returned for resume", meta.UploadID)
+	}
+}
+
+// GC 只为将要回收的上传加锁：未过期的上传不会在 muByUpload 中留下条目，回收的上传条目随之删除。
+func TestCollectStaleLeavesNoLocks(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	a := newTestServerAt(t, root)
+	newTestUpload(t, a, "gc/keep.bin", 8, 4)
+	stale := newTestUpload(t, a, "gc/stale.bin", 8, 4)
+	past := time.Now().Add(-time.Minute)
+	stale.ExpiresAt = &past
+	if err := a.saveMeta(stale); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	b := newTestServerAt(t, root)
+	for i := 0; i < 3; i++ {
+		b.collectStale(time.Hour)
+	}
+	b.muByUpload.Range(func(k, _ any) bool {
+		t.Errorf("lock entry left for %v", k)
+		return true
+	})
+	if _, err := b.loadMeta(stale.UploadID); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("stale upload not reclaimed: %v", err)
+	}
+}
+
+// 鉴权失败的 401 同样带 X-Request-Id，错误体中的 request_id 与之相同；客户端传入的 ID 原样沿用。
+func TestUnauthorizedHasRequestID(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Auth.Keys = []string{"secret"} })
+	routes := newRouteTable()
+	routes.handleFunc("/api/v1/uploads/status", s.handleStatus, "GET")
+	h := s.handler(s.config(), routes)
+
+	for _, sent := range []string{"", "client-id-1"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/uploads/status?upload_id=x", nil)
+		if sent != "" {
+			r.Header.Set("X-Request-Id", sent)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		id := w.Header().Get("X-Request-Id")
+		if id == "" || (sent != "" && id != sent) {
+			t.Fatalf("X-Request-Id = %q, sent %q", id, sent)
+		}
+		var body struct {
+			Error errorObject `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.RequestID != id {
+			t.Fatalf("body request_id %q, header %q (%v)", body.Error.RequestID, id, err)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ===== 元数据格式 =====
+//
+// storage.meta_format 选择元数据文件的编码：
+//   - json（默认）：缩进的 JSON，<upload_id>.json，便于人工查看与排查；
+//   - binary：<upload_id>.meta，接收区间（received_ranges、conflict_ranges）以差分 varint 编码，
+//     其余字段仍是紧凑的 JSON，便于增加字段。乱序分片多、区间数大时编码更快、文件更小，减少频繁落盘的开销。
+// 启动时把状态目录中按上次配置命名的元数据与数据文件迁移为当前的格式与后缀，切换配置后已有会话照常可用。
+
+const (
+	metaFormatJSON   = "json"
+	metaFormatBinary = "binary"
+)
+
+type metaCodec struct {
+	ext       string
+	marshal   func(UploadMeta) ([]byte, error)
+	unmarshal func([]byte, *UploadMeta) error
+}
+
+var metaCodecs = map[string]metaCodec{
+	metaFormatJSON: {
+		ext: ".json",
+		marshal: func(meta UploadMeta) ([]byte, error) {
+			return json.MarshalIndent(meta, "", "  ")
+		},
+		unmarshal: func(b []byte, meta *UploadMeta) error {
+			return json.Unmarshal(b, meta)
+		},
+	},
+	metaFormatBinary: {
+		ext:       ".meta",
+		marshal:   marshalBinaryMeta,
+		unmarshal: unmarshalBinaryMeta,
+	},
+}
+
+// binaryMetaMagic 标识 binary 格式及其版本。
+var binaryMetaMagic = []byte("GUM1")
+
+// marshalBinaryMeta 编码为：magic | uvarint(JSON 长度) | 不含区间的 JSON | received_ranges | conflict_ranges。
+func marshalBinaryMeta(meta UploadMeta) ([]byte, error) {
+	received, conflicts := meta.ReceivedRanges, meta.ConflictRanges
+	meta.ReceivedRanges, meta.ConflictRanges = nil, nil
+	js, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(binaryMetaMagic)+binary.MaxVarintLen64+len(js)+4*(len(received)+len(conflicts))+8)
+	b = append(b, binaryMetaMagic...)
+	b = binary.AppendUvarint(b, uint64(len(js)))
+	b = append(b, js...)
+	b = appendRanges(b, received)
+	b = appendRanges(b, conflicts)
+	return b, nil
+}
+
+// appendRanges 以差分方式编码已合并、按起点排序的区间：每个区间记与上一区间终点的间隔及自身长度。
+func appendRanges(b []byte, ranges [][2]int64) []byte {
+	b = binary.AppendUvarint(b, uint64(len(ranges)))
+	prev := int64(0)
+	for _, rg := range ranges {
+		b = binary.AppendVarint(b, rg[0]-prev)
+		b = binary.AppendVarint(b, rg[1]-rg[0])
+		prev = rg[1]
+	}
+	return b
+}
+
+func unmarshalBinaryMeta(b []byte, meta *UploadMeta) error {
+	rest, ok := bytes.CutPrefix(b, binaryMetaMagic)
+	if !ok {
+		return errors.New("bad magic")
+	}
+	n, k := binary.Uvarint(rest)
+	if k <= 0 || n > uint64(len(rest)-k) {
+		return errors.New("truncated")
+	}
+	rest = rest[k:]
+	if err := json.Unmarshal(rest[:n], meta); err != nil {
+		return err
+	}
+	rest = rest[n:]
+	var err error
+	if meta.ReceivedRanges, rest, err = readRanges(rest); err != nil {
+		return err
+	}
+	if meta.ConflictRanges, rest, err = readRanges(rest); err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errors.New("trailing data")
+	}
+	if len(meta.ConflictRanges) == 0 {
+		meta.ConflictRanges = nil
+	}
+	return nil
+}
+
+func readRanges(b []byte) ([][2]int64, []byte, error) {
+	count, k := binary.Uvarint(b)
+	// 每个区间至少占两个字节，防止损坏的计数导致超大分配
+	if k <= 0 || count > uint64(len(b)-k)/2 {
+		return nil, nil, errors.New("truncated")
+	}
+	b = b[k:]
+	ranges := make([][2]int64, 0, count)
+	prev := int64(0)
+	for i := uint64(0); i < count; i++ {
+		gap, k1 := binary.Varint(b)
+		if k1 <= 0 {
+			return nil, nil, errors.New("truncated")
+		}
+		length, k2 := binary.Varint(b[k1:])
+		if k2 <= 0 {
+			return nil, nil, errors.New("truncated")
+		}
+		b = b[k1+k2:]
+		start := prev + gap
+		ranges = append(ranges, [2]int64{start, start + length})
+		prev = start + length
+	}
+	return ranges, b, nil
+}
+
+// stateLayout 记录状态目录中文件的命名方式（数据与元数据文件的后缀、元数据格式），
+// 保存在 state_dir/layout.json。启动时与当前配置比较，据此迁移已有上传的文件。
+type stateLayout struct {
+	PartSuffix string `json:"part_suffix"`
+	MetaSuffix string `json:"meta_suffix"`
+	MetaFormat string `json:"meta_format"`
+}
+
+const stateLayoutFile = "layout.json"
+
+// migrateStateLayout 把状态目录中按上次配置命名的文件迁移为当前的后缀与格式：数据文件改名，
+// 元数据转换后写入新文件，返回迁移的元数据与数据文件数量。目标文件已存在时拒绝启动，不覆盖任何文件；
+// 无法解析的元数据保持原样并记录日志，不影响启动。
+func (s *Server) migrateStateLayout(format string) (metas, parts int, err error) {
+	cur := stateLayout{PartSuffix: s.partSuffix, MetaSuffix: s.metaSuffix, MetaFormat: format}
+	layoutPath := filepath.Join(s.stateAbs, stateLayoutFile)
+	var prev stateLayout
+	b, err := os.ReadFile(layoutPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &prev); err != nil {
+			return 0, 0, fmt.Errorf("parse %s: %w", layoutPath, err)
+		}
+		if _, ok := metaCodecs[prev.MetaFormat]; !ok {
+			return 0, 0, fmt.Errorf("parse %s: unknown meta_format %q", layoutPath, prev.MetaFormat)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		// 没有记录（新目录或旧版本留下的目录）：数据文件是默认的 .part，元数据是任一格式的默认后缀
+		prev = stateLayout{PartSuffix: defaultPartSuffix}
+	default:
+		return 0, 0, err
+	}
+	if prev == cur {
+		return 0, 0, nil
+	}
+
+	// 待转换的元数据：有记录时只有上次的后缀与格式，否则为两种格式的默认后缀
+	type oldMeta struct {
+		suffix string
+		codec  metaCodec
+	}
+	var oldMetas []oldMeta
+	if prev.MetaSuffix != "" {
+		if prev.MetaSuffix != cur.MetaSuffix || prev.MetaFormat != cur.MetaFormat {
+			oldMetas = append(oldMetas, oldMeta{prev.MetaSuffix, metaCodecs[prev.MetaFormat]})
+		}
+	} else {
+		for _, codec := range metaCodecs {
+			// 与当前后缀相同的文件不是待转换的元数据（如 meta_suffix 沿用了另一种格式的后缀）
+			if codec.ext != cur.MetaSuffix && codec.ext != cur.PartSuffix {
+				oldMetas = append(oldMetas, oldMeta{codec.ext, codec})
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(s.stateAbs)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, de := range entries {
+		name := de.Name()
+		if de.IsDir() {
+			continue
+		}
+		if prev.PartSuffix != cur.PartSuffix {
+			if id, ok := strings.CutSuffix(name, prev.PartSuffix); ok && validUploadID(id) {
+				if err := renameNoReplace(filepath.Join(s.stateAbs, name), s.partPath(id)); err != nil {
+					return metas, parts, fmt.Errorf("rename %s%s to %s%s: %w", id, prev.PartSuffix, id, cur.PartSuffix, err)
+				}
+				parts++
+				continue
+			}
+		}
+		for _, m := range oldMetas {
+			id, ok := strings.CutSuffix(name, m.suffix)
+			if !ok || !validUploadID(id) {
+				continue
+			}
+			old := filepath.Join(s.stateAbs, name)
+			if old != s.metaPath(id) {
+				if _, err := os.Stat(s.metaPath(id)); err == nil {
+					return metas, parts, fmt.Errorf("convert %s to %s%s: %w", name, id, cur.MetaSuffix, os.ErrExist)
+				}
+			}
+			if err := s.convertMetaFile(old, m.codec); err != nil {
+				log.Printf("convert metadata %s failed: %v", old, err)
+				break
+			}
+			metas++
+			break
+		}
+	}
+
+	if b, err = json.Marshal(cur); err != nil {
+		return metas, parts, err
+	}
+	if err := writeFileSync(layoutPath+".tmp", b, 0o644, true); err != nil {
+		return metas, parts, err
+	}
+	return metas, parts, os.Rename(layoutPath+".tmp", layoutPath)
+}
+
+// renameNoReplace 把 from 改名为 to，to 已存在时返回 os.ErrExist 而不覆盖。
+// 仅用于启动时的单线程迁移，检查与改名之间没有并发写入。
+func renameNoReplace(from, to string) error {
+	if _, err := os.Lstat(to); err == nil {
+		return os.ErrExist
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+func (s *Server) convertMetaFile(path string, from metaCodec) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var meta UploadMeta
+	if err := from.unmarshal(b, &meta); err != nil {
+		return fmt.Errorf("%w: %v", errCorruptMeta, err)
+	}
+	if err := s.saveMeta(meta); err != nil {
+		return err
+	}
+	// 只换格式不换后缀时 saveMeta 已原地覆盖旧文件
+	if path == s.metaPath(meta.UploadID) {
+		return nil
+	}
+	return os.Remove(path)
+}
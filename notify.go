@@ -0,0 +1,47 @@
+package main
+
+import "log"
+
+// ===== 完成通知 =====
+//
+// 上传完成后依次交给配置的各个通知出口（webhook、NATS），各自在后台发送、重试，互不影响，也不阻塞 complete 的响应。
+// 都未配置时不发送任何通知。
+
+// notifier 是完成通知的一个出口。notify 在调用方的 goroutine 中阻塞直到送达或放弃（内部负责重试），
+// 返回 true 表示接收方确认已取走文件，服务端可以删除它。
+type notifier interface {
+	name() string
+	notify(p completionPayload) (bool, error)
+}
+
+// newNotifiers 按配置创建通知出口。
+func (s *Server) newNotifiers(cfg Config) []notifier {
+	var ns []notifier
+	if cfg.Webhook.URL != "" {
+		ns = append(ns, &webhookNotifier{s: s, cfg: cfg.Webhook})
+	}
+	if cfg.Events.NATSURL != "" {
+		ns = append(ns, newNATSNotifier(s, cfg.Events))
+	}
+	return ns
+}
+
+// notifyCompleted 在后台发送完成通知，调用方无需等待。
+func (s *Server) notifyCompleted(meta UploadMeta, location string) {
+	if len(s.notifiers) == 0 {
+		return
+	}
+	p := newCompletionPayload(meta, location)
+	for _, n := range s.notifiers {
+		go func(n notifier) {
+			acked, err := n.notify(p)
+			if err != nil {
+				log.Printf("%s notification for %s failed: %v", n.name(), meta.UploadID, err)
+				return
+			}
+			if acked {
+				s.deleteAcked(meta)
+			}
+		}(n)
+	}
+}
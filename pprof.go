@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// ===== 性能分析 =====
+//
+// server.pprof_enable 开启后，在单独的监听地址 server.pprof_addr（默认 127.0.0.1:6060）上提供
+// net/http/pprof 的 /debug/pprof/ 接口，用于在运行中的实例上采集 CPU、堆与 goroutine 等 profile。
+// 该监听与 API 完全分开：不经过 CORS、鉴权与访问日志，也不受只读模式影响，因此默认只监听本机，
+// 需要远程采集时应通过 SSH 隧道等方式访问，不要暴露到公网。
+
+const defaultPprofAddr = "127.0.0.1:6060"
+
+// startPprof 开始在 addr 上提供 pprof 接口。监听失败（如端口被占用）时返回错误，不在后台静默失败。
+func startPprof(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("pprof server error: %v", err)
+		}
+	}()
+	return srv, nil
+}
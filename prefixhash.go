@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+)
+
+// ===== 增量整文件摘要 =====
+//
+// complete 需要整文件的 SHA-256，对大文件完整读一遍 .part 代价很高。本地后端在元数据中保存
+// “已摘要前缀”的 sha256 中间状态（hash_state）及其长度（hashed_size）：分片恰好从该前缀末尾开始时，
+// 写盘的同时更新摘要，顺序上传结束时 complete 直接得到结果，无需回读。
+// 乱序到达的分片不参与，complete 从 hashed_size 处恢复摘要状态，只读剩余部分。
+// 任何写入与已摘要前缀重叠（重传、并发写同一区间）时摘要状态作废，complete 退回完整读取。
+// 中间状态与接收区间随同一份元数据落盘，重启后两者仍然一致。
+
+// prefixHasher 在写盘的同时计算从 off 开始的数据摘要，提交时才并入元数据。
+type prefixHasher struct {
+	h   hash.Hash
+	off int64
+	n   int64
+}
+
+func (p *prefixHasher) Write(b []byte) (int, error) {
+	p.n += int64(len(b))
+	return p.h.Write(b)
+}
+
+// newPrefixHasher 在分片从已摘要前缀末尾开始时返回 prefixHasher，否则返回 nil。
+func newPrefixHasher(meta UploadMeta, offset int64) *prefixHasher {
+	if meta.HashState == nil || offset != meta.HashedSize {
+		return nil
+	}
+	h, ok := restoreHash(meta.HashState)
+	if !ok {
+		return nil
+	}
+	return &prefixHasher{h: h, off: offset}
+}
+
+// initialHashState 返回空数据的摘要状态，作为新上传的起点。
+func initialHashState() []byte {
+	b, _ := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	return b
+}
+
+func restoreHash(state []byte) (hash.Hash, bool) {
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, false
+	}
+	return h, true
+}
+
+// applyPrefixHash 在区间 [offset, offset+n) 提交前更新摘要状态，调用方需持有该上传的锁，且 meta 为最新元数据。
+// ph 为写入该区间时计算的摘要（可为 nil）。
+func applyPrefixHash(meta *UploadMeta, offset, n int64, ph *prefixHasher) {
+	if meta.HashState == nil {
+		return
+	}
+	if offset < meta.HashedSize {
+		// 已摘要的数据被改写，内容可能不同
+		meta.HashState, meta.HashedSize = nil, 0
+		return
+	}
+	// 其它写入已提交到同一区间时盘上内容未必是本次的数据，保持前缀不变，complete 时从盘上读取
+	if ph == nil || ph.off != meta.HashedSize || ph.n != n || len(intersectRanges(meta.ReceivedRanges, offset, offset+n)) > 0 {
+		return
+	}
+	state, err := ph.h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		meta.HashState, meta.HashedSize = nil, 0
+		return
+	}
+	meta.HashState, meta.HashedSize = state, offset+n
+}
+
+// partSHA256 计算 .part 中 [0, total_size) 明文的 SHA-256（hex），有可用的摘要状态时只读尚未摘要的部分。
+func (s *Server) partSHA256(meta UploadMeta) (string, error) {
+	return s.prefixSHA256(meta, meta.TotalSize)
+}
+
+// prefixSHA256 计算 .part 中 [0, size) 明文的 SHA-256（hex），同样复用已摘要前缀。
+func (s *Server) prefixSHA256(meta UploadMeta, size int64) (string, error) {
+	h, from := sha256.New(), int64(0)
+	if meta.HashState != nil && meta.HashedSize <= size {
+		if restored, ok := restoreHash(meta.HashState); ok {
+			h, from = restored, meta.HashedSize
+		}
+	}
+	if from < size {
+		f, err := os.Open(s.partPath(meta.UploadID))
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		var ra io.ReaderAt = f
+		if meta.Encrypted {
+			// 按块解密需要知道末块的真实长度，取整个文件的明文大小而不是前缀长度
+			if ra, err = s.partReaderAt(f, meta, max(size, meta.TotalSize)); err != nil {
+				return "", err
+			}
+		}
+		sum, _, err := sumSHA256(h, io.NewSectionReader(ra, from, size-from))
+		return sum, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sumSHA256 把 src 中的明文追加到摘要 h（从头计算时传 sha256.New()），返回 hex 摘要与读取的字节数。
+// complete 时对 .part 的摘要与校验和接口对已完成文件的摘要都经过这里。
+func sumSHA256(h hash.Hash, src io.Reader) (string, int64, error) {
+	n, err := io.Copy(h, src)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ===== 反向代理 =====
+//
+// 部署在 nginx、Traefik 等反向代理之后时，直连地址是代理本身，协议也可能与客户端实际使用的不同。
+// server.trusted_proxies 列出可信代理的 CIDR：只有直连地址属于其中时才采信 X-Forwarded-For 与 X-Forwarded-Proto，
+// 否则完全忽略这两个请求头，防止客户端伪造。解析结果放在请求上下文中，供日志与按 IP 限流使用。
+
+type clientInfo struct {
+	ip     string
+	scheme string // http | https
+}
+
+// withClientInfo 解析请求方 IP 与协议并放入请求上下文，放在最外层，访问日志同样使用。
+func (s *Server) withClientInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := clientInfo{ip: s.resolveClientIP(r), scheme: s.resolveScheme(r)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientInfoKey, info)))
+	})
+}
+
+// clientIP 返回请求方 IP，未经过 withClientInfo 时按直连地址与请求头现场解析。
+func (s *Server) clientIP(r *http.Request) string {
+	if info, ok := r.Context().Value(clientInfoKey).(clientInfo); ok {
+		return info.ip
+	}
+	return s.resolveClientIP(r)
+}
+
+// remoteIP 返回 withClientInfo 解析出的请求方 IP，没有时退回直连地址。日志等拿不到 *Server 的地方使用。
+func remoteIP(r *http.Request) string {
+	if info, ok := r.Context().Value(clientInfoKey).(clientInfo); ok {
+		return info.ip
+	}
+	return r.RemoteAddr
+}
+
+// requestScheme 返回客户端实际使用的协议：经可信代理转发时取 X-Forwarded-Proto，否则按连接是否为 TLS。
+func requestScheme(r *http.Request) string {
+	if info, ok := r.Context().Value(clientInfoKey).(clientInfo); ok {
+		return info.scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (s *Server) resolveScheme(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if !s.fromTrustedProxy(r) {
+		return scheme
+	}
+	// 多级代理时各级依次追加，只有最后一个值是直连的可信代理写入的，之前的值可能由客户端伪造
+	vals := r.Header.Values("X-Forwarded-Proto")
+	if len(vals) == 0 {
+		return scheme
+	}
+	last := vals[len(vals)-1]
+	if i := strings.LastIndexByte(last, ','); i >= 0 {
+		last = last[i+1:]
+	}
+	switch p := strings.ToLower(strings.TrimSpace(last)); p {
+	case "http", "https":
+		return p
+	}
+	return scheme
+}
+
+// fromTrustedProxy 判断直连地址是否属于 server.trusted_proxies。
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	return len(s.trustedProxies) > 0 && s.isTrustedProxy(peerIP(r))
+}
+
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// resolveClientIP 直连地址属于 server.trusted_proxies 时才信任 X-Forwarded-For：
+// 从右往左跳过可信代理，第一个不可信的地址即为客户端。
+func (s *Server) resolveClientIP(r *http.Request) string {
+	host := peerIP(r)
+	if !s.fromTrustedProxy(r) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	client := host
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		client = hop
+		if !s.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return client
+}
+
+func (s *Server) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range s.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies 解析 CIDR 列表，单个 IP 视为 /32 或 /128。
+func parseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", v)
+			}
+			out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", v)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 只采信可信代理转发的 X-Forwarded-Proto，多个值时取直连代理追加的最后一个。
+func TestResolveScheme(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Server.TrustedProxies = []string{"10.0.0.0/8"} })
+	for _, tc := range []struct {
+		name   string
+		remote string
+		proto  []string
+		want   string
+	}{
+		{"untrusted peer", "192.0.2.1:1234", []string{"https"}, "http"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"https"}, "https"},
+		{"no header", "10.0.0.1:1234", nil, "http"},
+		{"client-supplied first value ignored", "10.0.0.1:1234", []string{"https, http"}, "http"},
+		{"last header line wins", "10.0.0.1:1234", []string{"http", "HTTPS"}, "https"},
+		{"unknown value", "10.0.0.1:1234", []string{"ftp"}, "http"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remote
+		for _, v := range tc.proto {
+			r.Header.Add("X-Forwarded-Proto", v)
+		}
+		if got := s.resolveScheme(r); got != tc.want {
+			t.Errorf("%s: scheme %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== 顶层目录配额 =====
+//
+// quotas 以 root_dir 下的顶层目录为单位限制占用：已落盘文件 + 指向该目录的未完成上传的 total_size。
+// 遍历目录代价较高，结果缓存 quotaCacheTTL；新建、完成、取消上传时主动失效。
+
+const quotaCacheTTL = 10 * time.Second
+
+type quotaUsage struct {
+	bytes int64
+	at    time.Time
+}
+
+// quotaState 缓存各顶层目录的占用，并串行化 init 时的“检查配额 + 创建会话”，
+// 避免并发 init 同时通过检查。
+type quotaState struct {
+	mu    sync.Mutex
+	usage map[string]quotaUsage
+}
+
+// normalizeQuotas 校验配置中的配额：key 必须是单层目录名，值必须为正数。
+func normalizeQuotas(in map[string]int64) (map[string]int64, error) {
+	out := make(map[string]int64, len(in))
+	for k, v := range in {
+		top := filepath.Clean(strings.Trim(filepath.FromSlash(strings.TrimSpace(k)), string(filepath.Separator)))
+		if top == "." || top == ".." || strings.ContainsRune(top, filepath.Separator) {
+			return nil, fmt.Errorf("invalid quotas key %q: must be a top-level directory", k)
+		}
+		if v <= 0 {
+			return nil, fmt.Errorf("invalid quota for %q: must be > 0", k)
+		}
+		out[top] = v
+	}
+	return out, nil
+}
+
+// topLevelDir 返回 rel_path 的第一级路径；文件直接位于 root_dir 下时返回空串。
+func topLevelDir(rel string) string {
+	top, _, found := strings.Cut(rel, string(filepath.Separator))
+	if !found {
+		return ""
+	}
+	return top
+}
+
+// checkQuota 判断向 rel 新增 size 字节后是否超出配额，返回剩余额度（扣除本次之后）。
+// 调用方需持有 s.quota.mu。未配置配额时 limited=false。
+func (s *Server) checkQuota(rel string, size int64) (remaining int64, limited bool, err error) {
+	top := topLevelDir(rel)
+	limit, ok := s.config().Quotas[top]
+	if top == "" || !ok {
+		return 0, false, nil
+	}
+	used, err := s.quotaUsed(top)
+	if err != nil {
+		return 0, true, errStatus(http.StatusInternalServerError, "internal_error", "quota check failed")
+	}
+	if used+size > limit {
+		return 0, true, &httpError{status: http.StatusForbidden, code: "quota_exceeded", msg: "quota exceeded", body: map[string]any{
+			"quota":     limit,
+			"used":      used,
+			"remaining": maxInt64(limit-used, 0),
+		}}
+	}
+	return limit - used - size, true, nil
+}
+
+// quotaUsed 返回顶层目录当前占用，优先使用未过期的缓存。调用方需持有 s.quota.mu。
+func (s *Server) quotaUsed(top string) (int64, error) {
+	if u, ok := s.quota.usage[top]; ok && time.Since(u.at) < quotaCacheTTL {
+		return u.bytes, nil
+	}
+	var used int64
+	dir := filepath.Join(s.rootAbs, top)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			if p == s.stateAbs {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		used += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// 未完成的上传还在状态目录中，按声明的 total_size 预留；流式上传按已接收的字节计
+	ids, err := s.listUploadIDs()
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		meta, err := s.loadMeta(id)
+		if err != nil || meta.Completed {
+			continue
+		}
+		if topLevelDir(meta.RelPath) == top {
+			used += maxInt64(meta.TotalSize, meta.UploadedSize)
+		}
+	}
+
+	s.quota.usage[top] = quotaUsage{bytes: used, at: time.Now()}
+	return used, nil
+}
+
+// checkStreamingGrowth 检查流式上传再追加 n 字节后是否超出配额或磁盘空间。
+// 占用中已按 uploaded_size 计入该上传（quotaUsed），.part 也已占着这部分磁盘，因此两者都只需再容纳 n 字节。
+func (s *Server) checkStreamingGrowth(meta UploadMeta, n int64) error {
+	if len(s.config().Quotas) > 0 {
+		s.quota.mu.Lock()
+		_, _, err := s.checkQuota(meta.RelPath, n)
+		s.quota.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return s.checkFreeSpace(n)
+}
+
+// addQuotaUsage 把流式上传新接收的 n 字节计入缓存的占用，缓存过期前的检查也能看到增长。
+func (s *Server) addQuotaUsage(rel string, n int64) {
+	top := topLevelDir(rel)
+	if top == "" {
+		return
+	}
+	s.quota.mu.Lock()
+	if u, ok := s.quota.usage[top]; ok {
+		u.bytes += n
+		s.quota.usage[top] = u
+	}
+	s.quota.mu.Unlock()
+}
+
+// invalidateQuota 使 rel 所在顶层目录的占用缓存失效。
+func (s *Server) invalidateQuota(rel string) {
+	top := topLevelDir(rel)
+	if top == "" {
+		return
+	}
+	s.quota.mu.Lock()
+	delete(s.quota.usage, top)
+	s.quota.mu.Unlock()
+}
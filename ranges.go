@@ -0,0 +1,92 @@
+package main
+
+// ===== 已接收区间 =====
+//
+// 区间统一使用半开区间 [start, end)，切片按 start 升序，且任意两个区间既不重叠也不相邻。
+// 元数据快照会在多个 goroutine 之间共享，所以这里的函数一律返回新切片，不修改入参。
+
+// mergeRange 将 [start, end) 并入 ranges，合并重叠与相邻的区间。
+func mergeRange(ranges [][2]int64, start, end int64) [][2]int64 {
+	if start >= end {
+		return ranges
+	}
+	out := make([][2]int64, 0, len(ranges)+1)
+	inserted := false
+	for _, rg := range ranges {
+		switch {
+		case rg[1] < start:
+			out = append(out, rg)
+		case rg[0] > end:
+			if !inserted {
+				out = append(out, [2]int64{start, end})
+				inserted = true
+			}
+			out = append(out, rg)
+		default:
+			// 重叠或相邻：吸收进待插入区间
+			if rg[0] < start {
+				start = rg[0]
+			}
+			if rg[1] > end {
+				end = rg[1]
+			}
+		}
+	}
+	if !inserted {
+		out = append(out, [2]int64{start, end})
+	}
+	return out
+}
+
+// contiguousPrefix 返回从 0 开始连续接收的字节数，即客户端可以安全续传的起点。
+func contiguousPrefix(ranges [][2]int64) int64 {
+	if len(ranges) == 0 || ranges[0][0] != 0 {
+		return 0
+	}
+	return ranges[0][1]
+}
+
+// rangesTotal 返回所有区间覆盖的字节总数。
+func rangesTotal(ranges [][2]int64) int64 {
+	var n int64
+	for _, rg := range ranges {
+		n += rg[1] - rg[0]
+	}
+	return n
+}
+
+// rangesCover 判断 ranges 是否无缺口地覆盖 [0, total)。
+func rangesCover(ranges [][2]int64, total int64) bool {
+	if total == 0 {
+		return true
+	}
+	return len(ranges) == 1 && ranges[0][0] == 0 && ranges[0][1] >= total
+}
+
+// intersectRanges 返回 ranges 与 [start, end) 重叠的部分，按 start 升序。
+func intersectRanges(ranges [][2]int64, start, end int64) [][2]int64 {
+	var out [][2]int64
+	for _, rg := range ranges {
+		lo, hi := max(rg[0], start), min(rg[1], end)
+		if lo < hi {
+			out = append(out, [2]int64{lo, hi})
+		}
+	}
+	return out
+}
+
+// missingRanges 返回 [0, total) 中尚未接收的区间。
+func missingRanges(ranges [][2]int64, total int64) [][2]int64 {
+	var out [][2]int64
+	pos := int64(0)
+	for _, rg := range ranges {
+		if rg[0] > pos {
+			out = append(out, [2]int64{pos, min(rg[0], total)})
+		}
+		pos = max(pos, rg[1])
+	}
+	if pos < total {
+		out = append(out, [2]int64{pos, total})
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ===== 按客户端 IP 限制 init 频率 =====
+//
+// 每个 IP 一个令牌桶：容量为 init_per_minute，按每分钟 init_per_minute 个匀速补充。
+// 与 rateLimiter 不同，这里不允许透支，令牌不足直接拒绝。
+
+// ipBucketIdle 桶闲置超过该时长后必然已补满，可以回收。
+const ipBucketIdle = 2 * time.Minute
+
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type ipRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*ipBucket
+}
+
+func newIPRateLimiter() *ipRateLimiter {
+	return &ipRateLimiter{buckets: map[string]*ipBucket{}}
+}
+
+// allow 尝试为 ip 消耗一个令牌；拒绝时返回需要等待的时长。
+func (l *ipRateLimiter) allow(ip string, perMinute int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	capacity := float64(perMinute)
+	rate := capacity / 60 // 每秒补充的令牌
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &ipBucket{tokens: capacity, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// evictIdle 回收闲置的桶，避免大量不同来源的 IP 让内存无限增长。
+func (l *ipRateLimiter) evictIdle() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) > ipBucketIdle {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+func (s *Server) runIPLimiterEviction() {
+	t := time.NewTicker(ipBucketIdle)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.initLimiter.evictIdle()
+		}
+	}
+}
+
+// allowInit 按客户端 IP 限制创建上传的频率，超出时写出 429 并返回 false。
+// limits.init_per_minute 为 0 时不限制。
+func (s *Server) allowInit(w http.ResponseWriter, r *http.Request) bool {
+	perMinute := s.config().Limits.InitPerMinute
+	if perMinute <= 0 {
+		return true
+	}
+	ok, wait := s.initLimiter.allow(s.clientIP(r), perMinute)
+	if ok {
+		return true
+	}
+	retry := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	writeErrorBody(w, http.StatusTooManyRequests, "rate_limited", "too many uploads from this client", map[string]any{
+		"retry_after": retry,
+	})
+	return false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ===== 只读模式 =====
+//
+// 维护（如备份 root_dir）期间开启只读：查询进度、目录树、下载等照常可用，所有会写入数据的接口
+// （init、分片、complete、取消、tus、删除与移动文件）返回 503，避免备份与写入相互竞争。
+// 初始值来自 server.read_only，可以通过 SIGHUP 重新加载配置文件或管理接口切换；重新加载时以配置文件为准。
+// 管理接口本身不受限制。已在写入中的分片不会被中断。
+
+// writable 在只读模式下写出 503 并返回 false。
+func (s *Server) writable(w http.ResponseWriter) bool {
+	if !s.readOnly.Load() {
+		return true
+	}
+	writeError(w, http.StatusServiceUnavailable, "read_only", "server is in read-only mode")
+	return false
+}
+
+// GET  /api/v1/admin/read-only
+// POST /api/v1/admin/read-only?enabled=true|false
+func (s *Server) handleAdminReadOnly(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	admin, ok := s.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodPost {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(r.URL.Query().Get("enabled")))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_enabled", "invalid enabled")
+			return
+		}
+		before := s.readOnly.Swap(enabled)
+		reqLogger(r).Warn("admin read-only", "admin", admin, "before", before, "after", enabled)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"read_only": s.readOnly.Load()})
+}
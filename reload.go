@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+// ===== 配置热更新 =====
+//
+// 收到 SIGHUP 时重新读取配置文件，只替换运行期可以安全变更的部分：
+// limits（含限速、写盘并发上限与缓冲区大小）、quotas、storage.overwrite 与 server.read_only。
+// 监听地址、目录、TLS、鉴权、日志、GC、加密密钥、webhook、事件发布、URL 拉取等需要重启才能生效，变化时仅记录日志。
+
+// config 返回当前配置的快照，handler 一律通过它读取配置。
+func (s *Server) config() Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg
+}
+
+// watchReload 在收到 SIGHUP 时重新加载 path，直到服务关闭。
+func (s *Server) watchReload(path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ch:
+			if err := s.reloadConfig(path); err != nil {
+				log.Printf("config reload failed, keeping current config: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Server) reloadConfig(path string) error {
+	next, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	s.cfgMu.Lock()
+	cur := s.cfg
+	applied := cur
+	applied.Limits = next.Limits
+	applied.Quotas = next.Quotas
+	applied.Storage.Overwrite = next.Storage.Overwrite
+	applied.Server.ReadOnly = next.Server.ReadOnly
+	s.cfg = applied
+	s.cfgMu.Unlock()
+	// 以配置文件为准，覆盖此前通过管理接口做的切换
+	if was := s.readOnly.Swap(next.Server.ReadOnly); was != next.Server.ReadOnly {
+		log.Printf("config reload: read-only mode %v", next.Server.ReadOnly)
+	}
+
+	// 带宽上限变化后丢弃旧令牌桶，后续请求按新速率重建
+	if next.Limits.MaxUploadBps != cur.Limits.MaxUploadBps {
+		s.limiters.Range(func(k, _ any) bool {
+			s.limiters.Delete(k)
+			return true
+		})
+	}
+	if next.Limits.MaxConcurrentChunks != cur.Limits.MaxConcurrentChunks {
+		s.resizeChunkSlots(next.Limits.MaxConcurrentChunks)
+	}
+	log.Printf("config reloaded from %s", path)
+
+	next.Storage.Overwrite = cur.Storage.Overwrite
+	next.Server.ReadOnly = cur.Server.ReadOnly
+	for _, c := range []struct {
+		name     string
+		old, new any
+	}{
+		{"server", cur.Server, next.Server},
+		{"static", cur.Static, next.Static},
+		{"storage", cur.Storage, next.Storage},
+		{"auth", cur.Auth, next.Auth},
+		{"log", cur.Log, next.Log},
+		{"encryption", cur.Encryption, next.Encryption},
+		{"webhook", cur.Webhook, next.Webhook},
+		{"events", cur.Events, next.Events},
+		{"fetch", cur.Fetch, next.Fetch},
+	} {
+		if !reflect.DeepEqual(c.old, c.new) {
+			log.Printf("config reload: changes to %s require a restart, ignored", c.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ===== 响应压缩 =====
+//
+// server.gzip_responses 开启后，客户端的 Accept-Encoding 接受 gzip 时，/api/ 下的 JSON 响应超过
+// server.gzip_min_bytes（默认 1KB）即以 gzip 发送（Content-Encoding: gzip，Vary: Accept-Encoding）。
+// 目录树、列表等大响应通常能缩小一个数量级，小响应压缩反而更大，原样发送。
+// 文件下载不经过这里（落盘压缩的文件本身就按需以 gzip 发送，见 compress.go），SSE 等非 JSON 响应与 HEAD 请求原样输出。
+// 是否压缩要等响应体达到阈值或 handler 返回时才能确定，此前状态码与响应头暂不写出；
+// 中间件位于访问日志之内，访问日志记录实际发出的状态码与压缩后的字节数。
+
+const defaultGzipMinBytes = 1024
+
+var gzipWriterPool = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+func withGzip(enabled bool, minBytes int, next http.Handler) http.Handler {
+	if !enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || !strings.HasPrefix(r.URL.Path, "/api/") ||
+			r.URL.Path == "/api/v1/files/download" || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, minBytes: minBytes}
+		defer gw.finish()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipResponseWriter 缓冲响应开头的内容，达到 minBytes 时开始压缩输出。
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minBytes int
+	status   int
+	buf      []byte
+	eligible bool // 首次 Write 时判断：JSON 且未自带编码，才缓冲等待压缩
+	started  bool // 已写出响应头，是否压缩已确定
+	gz       *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if status < 200 {
+		// 1xx 信息性响应不影响最终响应，直接发出
+		g.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if g.started || g.status != 0 {
+		return
+	}
+	g.status = status
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !g.started {
+		if g.buf == nil {
+			g.eligible = g.compressible()
+			if g.eligible {
+				g.Header().Add("Vary", "Accept-Encoding")
+			}
+		}
+		if !g.eligible {
+			g.start(false)
+			return g.ResponseWriter.Write(p)
+		}
+		g.buf = append(g.buf, p...)
+		if len(g.buf) < g.minBytes {
+			return len(p), nil
+		}
+		g.start(true)
+		buffered := g.buf
+		g.buf = nil
+		if _, err := g.gz.Write(buffered); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// compressible 判断响应是否适合压缩：JSON、没有自带 Content-Encoding、状态码允许响应体。
+func (g *gzipResponseWriter) compressible() bool {
+	h := g.Header()
+	if h.Get("Content-Encoding") != "" || g.status == http.StatusNoContent || g.status == http.StatusNotModified {
+		return false
+	}
+	ct, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return ct == "application/json"
+}
+
+// start 确定是否压缩并写出响应头；handler 未调用 WriteHeader 时由首次写入隐含 200。
+func (g *gzipResponseWriter) start(compress bool) {
+	g.started = true
+	if compress {
+		h := g.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		g.gz = gzipWriterPool.Get().(*gzip.Writer)
+		g.gz.Reset(g.ResponseWriter)
+	}
+	if g.status != 0 {
+		g.ResponseWriter.WriteHeader(g.status)
+	}
+}
+
+// finish 在 handler 返回后输出未达到阈值的缓冲内容，或结束 gzip 流。
+func (g *gzipResponseWriter) finish() {
+	if !g.started {
+		if g.buf == nil && g.status == 0 {
+			// 没有任何输出，交给 net/http 按 200 处理
+			return
+		}
+		g.start(false)
+		if len(g.buf) > 0 {
+			_, _ = g.ResponseWriter.Write(g.buf)
+		}
+		return
+	}
+	if g.gz != nil {
+		_ = g.gz.Close()
+		g.gz.Reset(nil)
+		gzipWriterPool.Put(g.gz)
+		g.gz = nil
+	}
+}
+
+// Flush 让需要立即发出数据的 handler 照常工作：尚未确定时按不压缩处理，已压缩时先刷出 gzip 缓冲。
+func (g *gzipResponseWriter) Flush() {
+	if !g.started {
+		buffered := g.buf
+		g.buf = nil
+		g.start(false)
+		if len(buffered) > 0 {
+			_, _ = g.ResponseWriter.Write(buffered)
+		}
+	} else if g.gz != nil {
+		_ = g.gz.Flush()
+	}
+	_ = http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Unwrap 让 http.ResponseController 能找到底层连接的读写截止时间等能力（分片读取超时依赖）。
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== S3 存储后端 =====
+//
+// storage.backend: s3 时，init 创建一个 multipart upload，每个分片按 offset/chunk_size 映射为一个 part
+// （重传同一分片即覆盖同一 part），complete 时列出 part 并合并为对象。元数据仍保存在本地状态目录，
+// 多实例部署时需要共享 state_dir 或按 upload_id 做会话粘滞。
+//
+// 受 S3 multipart 的限制：分片必须按 chunk_size 对齐（等同 strict_chunks），除单片文件外 chunk_size 不小于 5MiB，
+// part 数不超过 10000；不支持流式上传、整文件 sha256 校验、tus、目录类接口与移动。
+// 请求以 AWS Signature V4 签名，兼容 MinIO、Ceph RGW 等 S3 兼容服务。
+
+const (
+	s3MinPartSize = 5 << 20
+	s3MaxParts    = 10000
+
+	// s3RequestTimeout 限制单个控制请求（创建、列出、合并、中止 multipart upload 与 HEAD 等）的总耗时；
+	// CompleteMultipartUpload 合并大量 part 时可能需要数分钟。分片上传与下载的数据量不定，不设总时长，
+	// 只受连接与响应头超时以及请求 context 的约束。
+	s3RequestTimeout = 5 * time.Minute
+
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyHash       = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`   // 服务地址，如 http://minio:9000；为空时按 region 使用 AWS 地址
+	Region    string `yaml:"region"`     // 默认 us-east-1
+	Bucket    string `yaml:"bucket"`     // 必填
+	Prefix    string `yaml:"prefix"`     // 对象键前缀，如 uploads/；不以 / 结尾时自动补上
+	AccessKey string `yaml:"access_key"` // 为空时读取 AWS_ACCESS_KEY_ID
+	SecretKey string `yaml:"secret_key"` // 为空时读取 AWS_SECRET_ACCESS_KEY
+	PathStyle bool   `yaml:"path_style"` // 使用 endpoint/bucket/key 形式的地址（MinIO 通常需要）
+}
+
+// normalize 填充默认值与环境变量中的凭据，并检查必填项。
+func (c *S3Config) normalize() error {
+	c.Bucket = strings.TrimSpace(c.Bucket)
+	if c.Bucket == "" {
+		return errors.New("storage.s3.bucket is required")
+	}
+	if c.Region = strings.TrimSpace(c.Region); c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.Endpoint = strings.TrimRight(strings.TrimSpace(c.Endpoint), "/"); c.Endpoint == "" {
+		c.Endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid storage.s3.endpoint %q", c.Endpoint)
+	}
+	// 前缀按目录处理：uploads 与 uploads/ 等价，对象键总是 uploads/<路径>
+	if c.Prefix = strings.Trim(strings.TrimSpace(c.Prefix), "/"); c.Prefix != "" {
+		c.Prefix += "/"
+	}
+	if c.AccessKey == "" {
+		c.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if c.SecretKey == "" {
+		c.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return errors.New("storage.s3 credentials missing: set access_key/secret_key or AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY")
+	}
+	return nil
+}
+
+type s3Storage struct {
+	s            *Server
+	cfg          S3Config
+	endpoint     *url.URL
+	sessionToken string
+	client       *http.Client
+	now          func() time.Time
+}
+
+func newS3Storage(s *Server, cfg S3Config) (*s3Storage, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{
+		s:            s,
+		cfg:          cfg,
+		endpoint:     u,
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		// 远端无响应时不能让持有上传锁的请求无限期挂起：连接、TLS 握手与等待响应头都有超时
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   30 * time.Second,
+				ResponseHeaderTimeout: time.Minute,
+				ExpectContinueTimeout: time.Second,
+				MaxIdleConnsPerHost:   16,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+		now: time.Now,
+	}, nil
+}
+
+// s3Error 是 S3 返回的错误响应。
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func isS3NotFound(err error) bool {
+	var se *s3Error
+	return errors.As(err, &se) && se.Status == http.StatusNotFound
+}
+
+func (c *s3Storage) key(rel string) string {
+	return c.cfg.Prefix + filepath.ToSlash(rel)
+}
+
+// objectURL 返回对象的请求地址，RawPath 为签名与请求共用的编码形式。
+func (c *s3Storage) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	p := "/" + key
+	if c.cfg.PathStyle {
+		p = "/" + c.cfg.Bucket + p
+	} else {
+		u.Host = c.cfg.Bucket + "." + u.Host
+	}
+	u.Path = path.Clean(c.endpoint.Path + "/" + p)
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do 签名并发送请求，非 2xx 响应解析为 *s3Error。body 非空时 size 为其长度。
+func (c *s3Storage) do(ctx context.Context, method, key string, query url.Values, hdr http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	c.sign(req, payloadHash, c.now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	se := &s3Error{Status: resp.StatusCode}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(b, se) != nil || se.Code == "" {
+		se.Code = http.StatusText(resp.StatusCode)
+	}
+	return nil, se
+}
+
+// doXML 发送控制请求并把响应体解析到 v（v 为 nil 时丢弃响应体），总耗时不超过 s3RequestTimeout。
+// CompleteMultipartUpload 在出错时也可能返回 200，响应体是 <Error> 时同样按错误处理。
+func (c *s3Storage) doXML(ctx context.Context, method, key string, query url.Values, hdr http.Header, body []byte, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, s3RequestTimeout)
+	defer cancel()
+	hash := s3EmptyHash
+	var r io.Reader
+	if body != nil {
+		sum := sha256.Sum256(body)
+		hash = hex.EncodeToString(sum[:])
+		r = bytes.NewReader(body)
+	}
+	resp, err := c.do(ctx, method, key, query, hdr, r, int64(len(body)), hash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		se := &s3Error{Status: http.StatusInternalServerError}
+		_ = xml.Unmarshal(b, se)
+		return se
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(b, v)
+}
+
+func (c *s3Storage) Prepare(meta *UploadMeta) error {
+	if err := c.checkUpload(*meta); err != nil {
+		return err
+	}
+	hdr := http.Header{}
+	if meta.ContentType != "" {
+		hdr.Set("Content-Type", meta.ContentType)
+	}
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := c.doXML(context.Background(), http.MethodPost, c.key(meta.RelPath), url.Values{"uploads": {""}}, hdr, nil, &res); err != nil {
+		return fmt.Errorf("create multipart upload: %w", err)
+	}
+	if res.UploadID == "" {
+		return errors.New("create multipart upload: empty upload id")
+	}
+	meta.ObjectUploadID = res.UploadID
+	return nil
+}
+
+// checkUpload 检查上传是否满足 S3 后端的约束。
+func (c *s3Storage) checkUpload(meta UploadMeta) error {
+	if meta.Streaming {
+		return errStatus(http.StatusBadRequest, "streaming_not_supported", "streaming uploads are not supported by the s3 backend")
+	}
+	if meta.ExpectedSHA256 != "" {
+		return errStatus(http.StatusBadRequest, "sha256_not_supported", "sha256 verification is not supported by the s3 backend")
+	}
+	parts := (meta.TotalSize + meta.ChunkSize - 1) / meta.ChunkSize
+	if parts > 1 && meta.ChunkSize < s3MinPartSize {
+		return errStatus(http.StatusBadRequest, "invalid_chunk_size", fmt.Sprintf("chunk_size must be at least %d with the s3 backend", s3MinPartSize))
+	}
+	if parts > s3MaxParts {
+		return errStatus(http.StatusBadRequest, "too_many_chunks", fmt.Sprintf("too many chunks: the s3 backend allows at most %d", s3MaxParts))
+	}
+	return nil
+}
+
+func (c *s3Storage) Preflight(meta UploadMeta) (string, error) {
+	if err := c.checkUpload(meta); err != nil {
+		return "", err
+	}
+	if c.s.config().Storage.Overwrite == overwriteReject {
+		_, err := c.head(context.Background(), c.key(meta.RelPath))
+		if err == nil {
+			return "", errDestExists
+		}
+		if !isS3NotFound(err) {
+			return "", err
+		}
+	}
+	return c.Location(meta.RelPath), nil
+}
+
+// partNumber 将分片偏移映射为 part 编号（从 1 开始）。
+func partNumber(meta UploadMeta, offset int64) int {
+	return int(offset/meta.ChunkSize) + 1
+}
+
+func (c *s3Storage) WriteChunk(ctx context.Context, meta UploadMeta, offset, length int64, src io.Reader) (int64, error) {
+	q := url.Values{
+		"partNumber": {strconv.Itoa(partNumber(meta, offset))},
+		"uploadId":   {meta.ObjectUploadID},
+	}
+	resp, err := c.do(ctx, http.MethodPut, c.key(meta.RelPath), q, nil, src, length, s3UnsignedPayload)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return length, nil
+}
+
+func (c *s3Storage) Resize(meta UploadMeta, size int64) error {
+	return errBackendUnsupported
+}
+
+// Sum 无法在不下载对象的情况下计算，S3 后端不提供整文件摘要。
+func (c *s3Storage) Sum(meta UploadMeta) (string, error) {
+	return "", nil
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// listParts 分页列出已上传的 part。
+func (c *s3Storage) listParts(ctx context.Context, meta UploadMeta) ([]s3Part, error) {
+	var parts []s3Part
+	marker := ""
+	for {
+		q := url.Values{"uploadId": {meta.ObjectUploadID}}
+		if marker != "" {
+			q.Set("part-number-marker", marker)
+		}
+		var res struct {
+			Parts       []s3Part `xml:"Part"`
+			IsTruncated bool     `xml:"IsTruncated"`
+			NextMarker  string   `xml:"NextPartNumberMarker"`
+		}
+		if err := c.doXML(ctx, http.MethodGet, c.key(meta.RelPath), q, nil, nil, &res); err != nil {
+			return nil, err
+		}
+		parts = append(parts, res.Parts...)
+		if !res.IsTruncated || res.NextMarker == "" {
+			return parts, nil
+		}
+		marker = res.NextMarker
+	}
+}
+
+func (c *s3Storage) Place(meta UploadMeta, sum string, check func() error) (string, error) {
+	ctx := context.Background()
+	key := c.key(meta.RelPath)
+	if check != nil {
+		if err := check(); err != nil {
+			return "", err
+		}
+	}
+	if c.s.config().Storage.Overwrite == overwriteReject {
+		_, err := c.head(ctx, key)
+		if err == nil {
+			return "", errDestExists
+		}
+		if !isS3NotFound(err) {
+			return "", err
+		}
+	}
+	parts, err := c.listParts(ctx, meta)
+	if err != nil {
+		return "", fmt.Errorf("list parts: %w", err)
+	}
+	if want := int((meta.TotalSize + meta.ChunkSize - 1) / meta.ChunkSize); len(parts) != want {
+		return "", fmt.Errorf("expected %d parts, found %d", want, len(parts))
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return "", err
+	}
+	if err := c.doXML(ctx, http.MethodPost, key, url.Values{"uploadId": {meta.ObjectUploadID}}, nil, body, nil); err != nil {
+		return "", fmt.Errorf("complete multipart upload: %w", err)
+	}
+	return meta.RelPath, nil
+}
+
+func (c *s3Storage) Location(rel string) string {
+	return "s3://" + c.cfg.Bucket + "/" + c.key(rel)
+}
+
+func (c *s3Storage) Discard(meta UploadMeta) {
+	if meta.ObjectUploadID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+	defer cancel()
+	resp, err := c.do(ctx, http.MethodDelete, c.key(meta.RelPath), url.Values{"uploadId": {meta.ObjectUploadID}}, nil, nil, 0, s3EmptyHash)
+	if err != nil {
+		if !isS3NotFound(err) {
+			log.Printf("s3: abort multipart upload of %s failed: %v", meta.UploadID, err)
+		}
+		return
+	}
+	resp.Body.Close()
+}
+
+// head 返回对象的元信息，总耗时不超过 s3RequestTimeout。
+func (c *s3Storage) head(ctx context.Context, key string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, s3RequestTimeout)
+	defer cancel()
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil, 0, s3EmptyHash)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (c *s3Storage) Open(ctx context.Context, rel string) (*storedObject, error) {
+	key := c.key(rel)
+	resp, err := c.head(ctx, key)
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, errStatus(http.StatusNotFound, "file_not_found", "not found")
+		}
+		log.Printf("s3: head object %s failed: %v", key, err)
+		return nil, errStatus(http.StatusBadGateway, "backend_error", "storage backend error")
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	r := &s3ObjectReader{c: c, ctx: ctx, key: key, size: resp.ContentLength}
+	return &storedObject{
+		ReadSeeker: r,
+		Closer:     r,
+		Name:       path.Base(key),
+		Size:       resp.ContentLength,
+		ModTime:    modTime,
+		ETag:       resp.Header.Get("ETag"),
+	}, nil
+}
+
+func (c *s3Storage) Remove(rel string) error {
+	key := c.key(rel)
+	// DeleteObject 对不存在的键也返回 204，先 HEAD 以便返回 404
+	if _, err := c.head(context.Background(), key); err != nil {
+		if isS3NotFound(err) {
+			return errStatus(http.StatusNotFound, "file_not_found", "not found")
+		}
+		log.Printf("s3: head object %s failed: %v", key, err)
+		return errStatus(http.StatusBadGateway, "backend_error", "storage backend error")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+	defer cancel()
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil, 0, s3EmptyHash)
+	if err != nil {
+		log.Printf("s3: delete object %s failed: %v", key, err)
+		return errStatus(http.StatusBadGateway, "backend_error", "storage backend error")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3ObjectReader 以 Range GET 按需读取对象，Seek 只移动位置，下次 Read 时从新位置重新请求。
+type s3ObjectReader struct {
+	c    *s3Storage
+	ctx  context.Context // 下载请求的 context，客户端断开后不再向 S3 发起读取
+	key  string
+	size int64
+	pos  int64
+	body io.ReadCloser
+}
+
+func (r *s3ObjectReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		hdr := http.Header{"Range": {fmt.Sprintf("bytes=%d-", r.pos)}}
+		resp, err := r.c.do(r.ctx, http.MethodGet, r.key, nil, hdr, nil, 0, s3EmptyHash)
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	if err == io.EOF && r.pos < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if offset != r.pos {
+		r.Close()
+		r.pos = offset
+	}
+	return offset, nil
+}
+
+func (r *s3ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// ----- Signature V4 -----
+
+// sign 按 AWS Signature V4 为请求添加 Authorization 头。payloadHash 为请求体的 SHA-256（hex）或 UNSIGNED-PAYLOAD。
+func (c *s3Storage) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" || lk == "content-type" || lk == "content-md5" {
+			headers[lk] = strings.Join(v, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.cfg.Region + "/s3/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretKey), date)
+	for _, part := range []string{c.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.cfg.AccessKey, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery 按键排序并以 RFC 3986 编码查询参数，无值的参数编码为 "key="。
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape 按 SigV4 的要求编码：只保留非保留字符，keepSlash 时保留路径分隔符。
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', keepSlash && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestS3PrefixNormalized(t *testing.T) {
+	for in, want := range map[string]string{"": "", "uploads": "uploads/", "/uploads/": "uploads/", " a/b ": "a/b/"} {
+		cfg := S3Config{Bucket: "b", Prefix: in, AccessKey: "k", SecretKey: "s"}
+		if err := cfg.normalize(); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Prefix != want {
+			t.Errorf("prefix %q normalized to %q, want %q", in, cfg.Prefix, want)
+		}
+	}
+}
+
+func TestS3WriteChunkCanceledWithRequest(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // 模拟不响应的 S3
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	cfg := S3Config{Endpoint: srv.URL, Bucket: "b", AccessKey: "k", SecretKey: "s", PathStyle: true}
+	if err := cfg.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newS3Storage(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	meta := UploadMeta{RelPath: "a.bin", ChunkSize: 4, TotalSize: 4, ObjectUploadID: "u"}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.WriteChunk(ctx, meta, 0, 4, bytes.NewReader([]byte("abcd")))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("err = %v, want deadline exceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteChunk did not return after the request context ended")
+	}
+}
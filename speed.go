@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ===== 上传速度与剩余时间 =====
+//
+// 每个未完成的上传在内存中保留最近的若干个 (时间, 已接收字节数) 样本，每提交一个分片记录一次。
+// status 按窗口内最早的样本到当前时刻计算平均速度，停顿时速度会随时间下降；样本不足时返回 null。
+// 上传完成或被取消、回收时丢弃样本；重启后从头开始统计。
+
+const (
+	speedMaxSamples = 16               // 每个上传最多保留的样本数
+	speedWindow     = 30 * time.Second // 只使用该时间内的样本
+	speedMinSpan    = time.Second      // 样本跨度不足时不估算，避免刚开始时的毛刺
+)
+
+type speedSample struct {
+	at    time.Time
+	bytes int64
+}
+
+type speedHistory struct {
+	mu      sync.Mutex
+	samples []speedSample
+}
+
+// speedTracker 按 upload_id 保存速度样本，零值可用。
+type speedTracker struct {
+	m sync.Map // uploadId -> *speedHistory
+}
+
+func (t *speedTracker) record(uploadID string, bytes int64, now time.Time) {
+	v, _ := t.m.LoadOrStore(uploadID, &speedHistory{})
+	h := v.(*speedHistory)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples = append(h.samples, speedSample{at: now, bytes: bytes})
+	drop := max(len(h.samples)-speedMaxSamples, 0)
+	for drop < len(h.samples)-1 && now.Sub(h.samples[drop].at) > speedWindow {
+		drop++
+	}
+	h.samples = append(h.samples[:0], h.samples[drop:]...)
+}
+
+// rate 返回窗口内的平均速度（字节/秒）；样本不足时返回 false。
+func (t *speedTracker) rate(uploadID string, now time.Time) (float64, bool) {
+	v, ok := t.m.Load(uploadID)
+	if !ok {
+		return 0, false
+	}
+	h := v.(*speedHistory)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var first, last *speedSample
+	for i := range h.samples {
+		if now.Sub(h.samples[i].at) > speedWindow {
+			continue
+		}
+		if first == nil {
+			first = &h.samples[i]
+		}
+		last = &h.samples[i]
+	}
+	if first == nil || first == last {
+		return 0, false
+	}
+	span := now.Sub(first.at)
+	if span < speedMinSpan {
+		return 0, false
+	}
+	return float64(last.bytes-first.bytes) / span.Seconds(), true
+}
+
+func (t *speedTracker) forget(uploadID string) {
+	t.m.Delete(uploadID)
+}
+
+// statusResp 是 status 接口的响应：元数据加上按最近进度估算的速度与剩余时间。
+type statusResp struct {
+	UploadMeta
+	BytesPerSecond *int64 `json:"bytes_per_second"` // 样本不足或已完成时为 null
+	ETASeconds     *int64 `json:"eta_seconds"`      // 速度为 0 或大小未知（流式上传）时为 null
+}
+
+func (s *Server) statusOf(meta UploadMeta) statusResp {
+	resp := statusResp{UploadMeta: meta}
+	if meta.Completed {
+		return resp
+	}
+	rate, ok := s.speeds.rate(meta.UploadID, time.Now())
+	if !ok {
+		return resp
+	}
+	bps := int64(rate)
+	resp.BytesPerSecond = &bps
+	if rate > 0 && !meta.Streaming {
+		eta := int64(math.Ceil(float64(meta.TotalSize-rangesTotal(meta.ReceivedRanges)) / rate))
+		resp.ETASeconds = &eta
+	}
+	return resp
+}
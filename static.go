@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// ===== 前端静态文件 =====
+//
+// 默认使用嵌入可执行文件的 web/dist。配置 static.dir 且目录存在时改为直接读取磁盘上的目录，
+// 调试前端时重新构建 web/dist 即可生效，无需重新编译后端。
+// 前端使用客户端路由，不存在的路径统一返回 index.html，由前端决定显示什么；/api/ 下的路径仍返回 404。
+
+// staticFiles 返回静态文件所在的文件系统及其来源描述（用于日志）。
+func staticFiles(dir string) (fs.FS, string, error) {
+	if dir != "" {
+		fi, err := os.Stat(dir)
+		if err == nil && fi.IsDir() {
+			return os.DirFS(dir), dir, nil
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, "", err
+		}
+	}
+	sub, err := fs.Sub(staticFS, "web/dist")
+	if err != nil {
+		return nil, "", err
+	}
+	return sub, "embedded filesystem", nil
+}
+
+type spaHandler struct {
+	fsys  fs.FS
+	files http.Handler
+}
+
+func newSPAHandler(fsys fs.FS) http.Handler {
+	return &spaHandler{fsys: fsys, files: http.FileServer(http.FS(fsys))}
+}
+
+func (h *spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "."
+	}
+	if _, err := fs.Stat(h.fsys, name); errors.Is(err, fs.ErrNotExist) && !strings.HasPrefix(r.URL.Path, "/api/") {
+		http.ServeFileFS(w, r, h.fsys, "index.html")
+		return
+	}
+	h.files.ServeHTTP(w, r)
+}
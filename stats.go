@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== 实例统计 =====
+//
+// GET /api/v1/stats 汇总上传会话与已完成文件的概况，供监控面板定期拉取。
+// 上传会话来自状态目录中的元数据；root_dir 下的文件统计需要遍历目录，只在 files=true 时返回，
+// 结果缓存 statsFilesTTL。
+
+const statsFilesTTL = 30 * time.Second
+
+type uploadStats struct {
+	InProgress       int   `json:"in_progress"`
+	ReceivedBytes    int64 `json:"received_bytes"`     // 未完成上传已收到的字节数
+	PendingBytes     int64 `json:"pending_bytes"`      // 未完成上传尚未收到的字节数（流式上传大小未知，不计入）
+	OldestAgeSeconds int64 `json:"oldest_age_seconds"` // 最早创建的未完成上传距今的秒数，没有时为 0
+	Completed        int   `json:"completed"`          // 状态目录中保留的已完成上传记录数
+	CompletedBytes   int64 `json:"completed_bytes"`
+}
+
+type fileStats struct {
+	Count     int64     `json:"count"`
+	Bytes     int64     `json:"bytes"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+type statsResp struct {
+	Uploads uploadStats `json:"uploads"`
+	Files   *fileStats  `json:"files,omitempty"`
+}
+
+type statsCache struct {
+	mu    sync.Mutex
+	files fileStats
+}
+
+// GET /api/v1/stats[?files=true]
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	withFiles := false
+	if v := strings.TrimSpace(r.URL.Query().Get("files")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_files", "invalid files")
+			return
+		}
+		withFiles = b
+	}
+	if withFiles && !s.localOnly(w) {
+		return
+	}
+
+	ids, err := s.listUploadIDs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "scan failed")
+		return
+	}
+	var resp statsResp
+	now := time.Now()
+	var oldest time.Time
+	for _, id := range ids {
+		meta, err := s.loadMeta(id)
+		if err != nil {
+			continue
+		}
+		if meta.Completed {
+			resp.Uploads.Completed++
+			resp.Uploads.CompletedBytes += meta.TotalSize
+			continue
+		}
+		received := rangesTotal(meta.ReceivedRanges)
+		resp.Uploads.InProgress++
+		resp.Uploads.ReceivedBytes += received
+		if !meta.Streaming {
+			resp.Uploads.PendingBytes += meta.TotalSize - received
+		}
+		if oldest.IsZero() || meta.CreatedAt.Before(oldest) {
+			oldest = meta.CreatedAt
+		}
+	}
+	if !oldest.IsZero() {
+		resp.Uploads.OldestAgeSeconds = int64(now.Sub(oldest).Seconds())
+	}
+
+	if withFiles {
+		fst, err := s.cachedFileStats()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "scan failed")
+			return
+		}
+		resp.Files = &fst
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// cachedFileStats 返回 root_dir 的文件统计，缓存过期时重新遍历；并发请求只会触发一次遍历。
+func (s *Server) cachedFileStats() (fileStats, error) {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	if !s.stats.files.ScannedAt.IsZero() && time.Since(s.stats.files.ScannedAt) < statsFilesTTL {
+		return s.stats.files, nil
+	}
+	count, bytes, err := s.scanRootFiles()
+	if err != nil {
+		return fileStats{}, err
+	}
+	s.stats.files = fileStats{Count: count, Bytes: bytes, ScannedAt: time.Now().UTC()}
+	return s.stats.files, nil
+}
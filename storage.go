@@ -0,0 +1,456 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ===== 存储后端 =====
+//
+// 上传数据的落地方式由 storage.backend 决定：local（默认）写入状态目录下的 .part，完成时 rename 到 root_dir；
+// s3 把每个分片作为一个 multipart part 上传，完成时合并为对象。元数据始终保存在本地状态目录。
+// Storage 只负责数据本身，配额、并发名额、ETag 索引、事件等簿记仍由 Server 处理。
+
+type Storage interface {
+	// Prepare 在 init 时为上传分配存储，可以回写 meta 中属于后端的字段；
+	// 返回 *httpError 表示请求不满足该后端的约束。
+	Prepare(meta *UploadMeta) error
+	// Preflight 做 Prepare 与 Place 中不产生副作用的检查（后端约束、空间、overwrite 策略），
+	// 返回按当前状态完成后的位置，供 init 的 dry_run 使用。
+	Preflight(meta UploadMeta) (string, error)
+	// WriteChunk 将 src 中 length 字节写到 offset 处，返回确实落地的字节数。
+	// ctx 一般为请求的 context：客户端断开时远端后端的写入随之取消。
+	WriteChunk(ctx context.Context, meta UploadMeta, offset, length int64, src io.Reader) (int64, error)
+	// Resize 在流式上传完成时把数据截断到最终大小。
+	Resize(meta UploadMeta, size int64) error
+	// Sum 计算已接收数据的 SHA-256（hex），后端无法回读时返回空串。
+	Sum(meta UploadMeta) (string, error)
+	// Place 按 overwrite 策略把数据放到 meta.RelPath，返回实际的相对路径（rename 策略下可能改名）。
+	// 目标已存在且策略为 reject 时返回 errDestExists。check 不为 nil 时在处理目标之前调用
+	// （本地后端在 finalizeMu 内），返回错误则放弃落盘并原样返回该错误。
+	Place(meta UploadMeta, sum string, check func() error) (string, error)
+	// Location 返回已完成文件对外展示的位置（本地绝对路径或 s3://bucket/key）。
+	Location(rel string) string
+	// Discard 丢弃未完成上传占用的存储。
+	Discard(meta UploadMeta)
+	// Open 打开已完成的文件用于下载，之后的读取受 ctx 约束。
+	Open(ctx context.Context, rel string) (*storedObject, error)
+	// Remove 删除已完成的文件。
+	Remove(rel string) error
+}
+
+// storedObject 是可供 http.ServeContent 使用的已完成文件；ETag 为空时由调用方生成。
+type storedObject struct {
+	io.ReadSeeker
+	io.Closer
+	Name    string
+	Size    int64
+	ModTime time.Time
+	ETag    string
+
+	Compressed bool // 内容为 gzip 压缩存储，Size 为解压后的大小
+}
+
+// plaintext 返回从当前位置读取明文的 Reader：压缩存储的对象边读边解压，其余原样返回。
+func (o *storedObject) plaintext() (io.Reader, error) {
+	if !o.Compressed {
+		return o, nil
+	}
+	return gzip.NewReader(o)
+}
+
+var errBackendUnsupported = errors.New("not supported by this storage backend")
+
+// newStorage 按配置创建存储后端。
+func (s *Server) newStorage(cfg Config) (Storage, error) {
+	switch cfg.Storage.Backend {
+	case "", backendLocal:
+		return &localStorage{s: s}, nil
+	case backendS3:
+		return newS3Storage(s, cfg.Storage.S3)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+}
+
+const (
+	backendLocal = "local"
+	backendS3    = "s3"
+)
+
+// localOnly 用于只对本地存储有意义的接口（目录树、列表、统计、移动等），其它后端返回 501。
+func (s *Server) localOnly(w http.ResponseWriter) bool {
+	if _, ok := s.store.(*localStorage); ok {
+		return true
+	}
+	writeError(w, http.StatusNotImplemented, "unsupported_backend", errBackendUnsupported.Error())
+	return false
+}
+
+// ----- 本地文件系统 -----
+
+type localStorage struct {
+	s *Server
+}
+
+func (l *localStorage) Prepare(meta *UploadMeta) error {
+	s := l.s
+	partSize := meta.TotalSize
+	if meta.Encrypted {
+		partSize = encryptedSize(meta.TotalSize)
+	}
+	if err := s.checkFreeSpace(partSize); err != nil {
+		return err
+	}
+	meta.HashState = initialHashState()
+	// 预创建 .part 文件并设置长度，便于 WriteAt 随机写入；流式上传从空文件开始增长
+	partPath := s.partPath(meta.UploadID)
+	if err := s.ensureParentDir(partPath); err != nil {
+		return errStatus(http.StatusInternalServerError, "internal_error", "mkdir failed")
+	}
+	f, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, s.fileMode)
+	if err != nil {
+		return errStatus(http.StatusInternalServerError, "internal_error", "create part failed")
+	}
+	defer f.Close()
+	if err := f.Chmod(s.fileMode); err != nil {
+		return errStatus(http.StatusInternalServerError, "internal_error", "chmod part failed")
+	}
+	if err := f.Truncate(partSize); err != nil {
+		return errStatus(http.StatusInternalServerError, "internal_error", "truncate failed")
+	}
+	if meta.Encrypted {
+		hdr, err := encHeader(meta.UploadID)
+		if err == nil {
+			_, err = f.WriteAt(hdr, 0)
+		}
+		if err != nil {
+			return errStatus(http.StatusInternalServerError, "internal_error", "write header failed")
+		}
+	}
+	return nil
+}
+
+// checkFreeSpace 检查状态目录所在文件系统能否容纳 partSize 字节的 .part：
+// .part 会被预先 truncate 到 total_size，空间不足时提前拒绝，避免写到一半把磁盘占满；
+// 每个上传至少占用 .part 与元数据两个 inode，inode 耗尽时 create 会报出难以理解的错误，同样提前拒绝。
+func (s *Server) checkFreeSpace(partSize int64) error {
+	if avail, ok := s.availableBytes(); ok {
+		need := partSize + s.config().Limits.DiskHeadroomBytes
+		if avail < uint64(need) {
+			return &httpError{status: http.StatusInsufficientStorage, code: "insufficient_storage", msg: "insufficient storage", body: map[string]any{
+				"required":  need,
+				"available": avail,
+			}}
+		}
+	}
+	if minInodes := s.config().Limits.MinFreeInodes; minInodes > 0 {
+		if free, ok := s.freeInodes(); ok && free < uint64(minInodes) {
+			return &httpError{status: http.StatusInsufficientStorage, code: "insufficient_inodes", msg: "insufficient inodes", body: map[string]any{
+				"required":    minInodes,
+				"inodes_free": free,
+			}}
+		}
+	}
+	return nil
+}
+
+func (l *localStorage) Preflight(meta UploadMeta) (string, error) {
+	s := l.s
+	partSize := meta.TotalSize
+	if meta.Encrypted {
+		partSize = encryptedSize(meta.TotalSize)
+	}
+	if err := s.checkFreeSpace(partSize); err != nil {
+		return "", err
+	}
+	finalAbs, err := s.finalAbsPath(meta.RelPath)
+	if err != nil {
+		return "", errStatus(http.StatusBadRequest, "invalid_path", "invalid path")
+	}
+	if err := s.checkParentInRoot(finalAbs); err != nil {
+		return "", err
+	}
+	return s.applyOverwritePolicy(finalAbs)
+}
+
+func (l *localStorage) WriteChunk(_ context.Context, meta UploadMeta, offset, length int64, src io.Reader) (int64, error) {
+	f, err := os.OpenFile(l.s.partPath(meta.UploadID), os.O_RDWR, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return l.s.copyToPart(f, meta, io.LimitReader(src, length), offset)
+}
+
+func (l *localStorage) Resize(meta UploadMeta, size int64) error {
+	if meta.Encrypted {
+		size = encryptedSize(size)
+	}
+	return os.Truncate(l.s.partPath(meta.UploadID), size)
+}
+
+func (l *localStorage) Sum(meta UploadMeta) (string, error) {
+	return l.s.partSHA256(meta)
+}
+
+// checkPlacedSize 确认 path 的大小与上传声明的大小（加密时为密文大小）一致。
+func checkPlacedSize(path string, meta UploadMeta) error {
+	want := meta.TotalSize
+	if meta.Encrypted {
+		want = encryptedSize(want)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != want {
+		log.Printf("finalize %s: %s has %d bytes, want %d", meta.UploadID, path, fi.Size(), want)
+		return errStatus(http.StatusInternalServerError, "internal_error", "final size mismatch")
+	}
+	return nil
+}
+
+func (l *localStorage) Place(meta UploadMeta, sum string, check func() error) (string, error) {
+	s := l.s
+	finalAbs, err := s.finalAbsPath(meta.RelPath)
+	if err != nil {
+		return "", err
+	}
+	partPath := s.partPath(meta.UploadID)
+	// 落盘前确认 .part 的大小与 total_size 一致：被截断或稀疏的 .part 不能当作完整文件交出去，
+	// 更不能在 overwrite 策略下先覆盖掉已有的文件
+	if err := checkPlacedSize(partPath, meta); err != nil {
+		return "", err
+	}
+	// 压缩耗时与文件大小成正比，先在 finalizeMu 之外压缩到目标目录下的临时文件，锁内只 rename
+	src := partPath
+	if meta.Compressed {
+		src, err = s.stageFile(finalAbs+compressedSuffix, ".compressing", func(f *os.File) error {
+			return s.compressTo(f, partPath, filepath.Base(finalAbs), meta.TotalSize)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	if src != partPath {
+		rel, err := s.placeFile(meta, src, os.Rename, finalAbs, sum, check)
+		if err != nil {
+			_ = os.Remove(src)
+		} else {
+			_ = os.Remove(partPath)
+		}
+		return rel, err
+	}
+	var rel string
+	err = s.moveStaged(partPath, finalAbs, func(src string, rename func(string, string) error) error {
+		var err error
+		rel, err = s.placeFile(meta, src, rename, finalAbs, sum, check)
+		return err
+	})
+	return rel, err
+}
+
+// placeFile 在 finalizeMu 内完成目标检查并以 rename 把 src（.part 或暂存好的临时文件）移到位，返回相对 root_dir 的路径。
+// rename 跨文件系统失败时原样返回该错误，由 moveStaged 复制后重试。
+func (s *Server) placeFile(meta UploadMeta, src string, rename func(string, string) error, finalAbs, sum string, check func() error) (string, error) {
+	// 目标已存在时按 overwrite 策略处理；检查与 rename 在同一把锁内完成，
+	// 避免两个指向同一路径的上传同时通过检查。创建父目录也放在锁内，
+	// 以免被 pruneEmptyDirs 在 rename 之前删掉
+	s.finalizeMu.Lock()
+	defer s.finalizeMu.Unlock()
+	if check != nil {
+		if err := check(); err != nil {
+			return "", err
+		}
+	}
+	// 目录链接可能在 init 之后才出现，rename 前按解析后的真实路径再确认一次
+	if err := s.checkParentInRoot(finalAbs); err != nil {
+		return "", err
+	}
+	if err := s.ensureParentDir(finalAbs); err != nil {
+		return "", err
+	}
+	finalAbs, err := s.applyOverwritePolicy(finalAbs)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case meta.Compressed:
+		err = rename(src, finalAbs+compressedSuffix)
+	case s.dedup != nil && !meta.Encrypted:
+		err = s.placeDeduped(src, finalAbs, sum)
+	default:
+		err = rename(src, finalAbs)
+		// 移动后再确认一次落盘的文件（跨文件系统时是复制出来的），正常情况下不会不一致
+		if err == nil {
+			if err = checkPlacedSize(finalAbs, meta); err != nil {
+				// 移回原处，客户端可补传后再次 complete
+				if rerr := os.Rename(finalAbs, src); rerr != nil {
+					log.Printf("roll back %s failed: %v", finalAbs, rerr)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	removeOtherVariant(finalAbs, meta.Compressed)
+	// rename 保留 .part 的权限，这里再按当前 file_mode 设置一次（.part 可能由旧配置创建）；暂存的临时文件创建时已按 file_mode
+	if !meta.Compressed {
+		if err := os.Chmod(finalAbs, s.fileMode); err != nil {
+			log.Printf("chmod %s failed: %v", finalAbs, err)
+		}
+	}
+	rel, err := filepath.Rel(s.rootAbs, finalAbs)
+	if err != nil {
+		return "", err
+	}
+	// 普通落盘覆盖了此前去重的文件时释放旧引用
+	if s.dedup != nil && (meta.Encrypted || meta.Compressed) {
+		s.releaseDedup(rel)
+	}
+	return rel, nil
+}
+
+// stageFile 在 dst 所在目录创建临时文件（名称以 suffix 结尾）并交给 fill 写入，写完后 fsync，返回临时文件路径。
+// 只有检查目录与创建临时文件时持有 finalizeMu，fill 中的压缩、复制等耗时操作不阻塞其它上传的落盘；
+// 临时文件所在的目录不为空，不会被 pruneEmptyDirs 删掉。调用方在 finalizeMu 内把它 rename 到位，失败时负责删除。
+func (s *Server) stageFile(dst, suffix string, fill func(*os.File) error) (string, error) {
+	s.finalizeMu.Lock()
+	err := s.checkParentInRoot(dst)
+	if err == nil {
+		err = s.ensureParentDir(dst)
+	}
+	var f *os.File
+	if err == nil {
+		// 同一路径可能有多个上传同时暂存，临时文件名随机
+		f, err = os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"-*"+suffix)
+	}
+	s.finalizeMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	err = f.Chmod(s.fileMode)
+	if err == nil {
+		err = fill(f)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func (l *localStorage) Location(rel string) string {
+	abs, _ := l.s.finalAbsPath(rel)
+	// 压缩存储的文件实际位于 <路径>.gz
+	abs, _ = storedPath(abs)
+	return abs
+}
+
+func (l *localStorage) Discard(meta UploadMeta) {
+	_ = os.Remove(l.s.partPath(meta.UploadID))
+}
+
+func (l *localStorage) Open(_ context.Context, rel string) (*storedObject, error) {
+	s := l.s
+	abs, compressed := storedPath(filepath.Join(s.rootAbs, rel))
+	// 根目录内的符号链接可能指向外部文件，按解析后的真实路径检查；
+	// 去重在无法硬链接时以符号链接指向状态目录中的数据块，状态目录可能在根目录之外
+	var also []string
+	if s.dedup != nil {
+		also = append(also, s.dedup.dir)
+	}
+	if err := s.checkInRoot(abs, also...); err != nil {
+		var he *httpError
+		if errors.As(err, &he) {
+			return nil, err
+		}
+		return nil, errStatus(http.StatusInternalServerError, "internal_error", "open failed")
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errStatus(http.StatusNotFound, "file_not_found", "not found")
+		}
+		return nil, errStatus(http.StatusInternalServerError, "internal_error", "open failed")
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errStatus(http.StatusInternalServerError, "internal_error", "stat failed")
+	}
+	if !st.Mode().IsRegular() {
+		f.Close()
+		return nil, errStatus(http.StatusNotFound, "file_not_found", "not found")
+	}
+	obj := &storedObject{ReadSeeker: f, Closer: f, Name: st.Name(), Size: st.Size(), ModTime: st.ModTime()}
+	// 压缩存储的文件：Size 为原始大小，内容保持压缩，由下载接口决定是否解压
+	if compressed {
+		size, ok := compressedSize(f)
+		if _, err := f.Seek(0, io.SeekStart); err != nil || !ok {
+			f.Close()
+			return nil, errStatus(http.StatusInternalServerError, "internal_error", "open failed")
+		}
+		obj.Name = strings.TrimSuffix(obj.Name, compressedSuffix)
+		obj.Size = size
+		obj.Compressed = true
+		return obj, nil
+	}
+	// 加密存储的文件透明解密，Range 请求按明文偏移处理
+	if s.encKey != nil {
+		ra, n, err := s.openDecrypted(f, st.Size())
+		switch {
+		case err == nil:
+			obj.ReadSeeker, obj.Size = io.NewSectionReader(ra, 0, n), n
+		case !errors.Is(err, errNotEncrypted):
+			f.Close()
+			log.Printf("open encrypted %s failed: %v", abs, err)
+			return nil, errStatus(http.StatusInternalServerError, "internal_error", "decrypt failed")
+		}
+	}
+	return obj, nil
+}
+
+func (l *localStorage) Remove(rel string) error {
+	s := l.s
+	abs, _ := storedPath(filepath.Join(s.rootAbs, rel))
+	st, err := os.Lstat(abs)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errStatus(http.StatusNotFound, "file_not_found", "not found")
+		}
+		return errStatus(http.StatusInternalServerError, "internal_error", "stat failed")
+	}
+	if st.IsDir() {
+		return errStatus(http.StatusConflict, "is_a_directory", "is a directory")
+	}
+	// 去重产生的符号链接视同普通文件
+	isDedupLink := st.Mode()&os.ModeSymlink != 0 && s.dedup != nil && s.dedup.isRef(rel)
+	if !st.Mode().IsRegular() && !isDedupLink {
+		return errStatus(http.StatusConflict, "not_a_file", "not a regular file")
+	}
+	if err := os.Remove(abs); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errStatus(http.StatusNotFound, "file_not_found", "not found")
+		}
+		return errStatus(http.StatusInternalServerError, "internal_error", "delete failed")
+	}
+	s.releaseDedup(rel)
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeDiskStat 把 diskStat 替换为返回固定容量的实现，测试结束后恢复。
+func fakeDiskStat(t *testing.T, du diskUsage) {
+	t.Helper()
+	orig := diskStat
+	diskStat = func(string) (diskUsage, error) { return du, nil }
+	t.Cleanup(func() { diskStat = orig })
+}
+
+// 可用空间不足以容纳 total_size（加上 disk_headroom_bytes）时 init 返回 507。
+func TestInitInsufficientStorage(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Limits.DiskHeadroomBytes = 100
+	})
+	fakeDiskStat(t, diskUsage{Total: 1 << 20, Available: 1000})
+
+	doInit := func(total int) *httptest.ResponseRecorder {
+		body := `{"path":"d/a.bin","total_size":` + strconv.Itoa(total) + `,"chunk_size":1024}`
+		w := httptest.NewRecorder()
+		s.handleInit(w, httptest.NewRequest(http.MethodPost, "/api/v1/uploads/init", strings.NewReader(body)))
+		return w
+	}
+	w := doInit(901)
+	if w.Code != http.StatusInsufficientStorage || errorCode(t, w) != "insufficient_storage" {
+		t.Fatalf("init over free space: status %d: %s", w.Code, w.Body)
+	}
+	if w := doInit(900); w.Code != http.StatusCreated {
+		t.Fatalf("init within free space: status %d: %s", w.Code, w.Body)
+	}
+}
+
+// inode 不足 limits.min_free_inodes 时同样返回 507；文件系统不提供 inode 信息时不检查。
+func TestInitInsufficientInodes(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Limits.MinFreeInodes = 10
+	})
+	fakeDiskStat(t, diskUsage{Total: 1 << 30, Available: 1 << 30, Inodes: 100, InodesFree: 5})
+	_, _, err := s.newUpload(initReq{Path: "d/a.bin", TotalSize: 10, ChunkSize: 10})
+	if he, ok := err.(*httpError); !ok || he.status != http.StatusInsufficientStorage || he.code != "insufficient_inodes" {
+		t.Fatalf("got %v, want 507 insufficient_inodes", err)
+	}
+
+	fakeDiskStat(t, diskUsage{Total: 1 << 30, Available: 1 << 30})
+	if _, _, err := s.newUpload(initReq{Path: "d/a.bin", TotalSize: 10, ChunkSize: 10}); err != nil {
+		t.Fatalf("no inode info: %v", err)
+	}
+}
+
+// 流式上传每个分片按追加的大小检查可用空间。
+func TestStreamingChunkInsufficientStorage(t *testing.T) {
+	s := newTestServer(t)
+	meta := newTestUpload(t, s, "d/stream.bin", 0, 1024)
+	fakeDiskStat(t, diskUsage{Total: 1 << 20, Available: 4})
+	if w := putChunk(s, meta.UploadID, 0, []byte("1234")); w.Code != http.StatusOK {
+		t.Fatalf("chunk within free space: status %d: %s", w.Code, w.Body)
+	}
+	w := putChunk(s, meta.UploadID, 4, []byte("12345"))
+	if w.Code != http.StatusInsufficientStorage || errorCode(t, w) != "insufficient_storage" {
+		t.Fatalf("chunk over free space: status %d: %s", w.Code, w.Body)
+	}
+}
+
+// .part 大小与 total_size 不符时在移动之前就拒绝，overwrite 策略下不会先覆盖掉已有的文件。
+func TestPlaceSizeMismatchKeepsExisting(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	s := newTestServerAt(t, root)
+	meta := newTestUpload(t, s, "pl/a.bin", 4, 4)
+	if w := putChunk(s, meta.UploadID, 0, []byte("abcd")); w.Code != http.StatusOK {
+		t.Fatalf("chunk: %d %s", w.Code, w.Body)
+	}
+	dest := filepath.Join(root, "pl", "a.bin")
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dest, []byte("existing"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// .part 比 total_size 长（如写入越界的残留），摘要只覆盖前 total_size 字节
+	if err := os.Truncate(s.partPath(meta.UploadID), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := completeUpload(s, meta.UploadID, ""); w.Code != http.StatusInternalServerError {
+		t.Fatalf("complete: %d %s", w.Code, w.Body)
+	}
+	if got, err := os.ReadFile(dest); err != nil || string(got) != "existing" {
+		t.Fatalf("existing file %q, err %v", got, err)
+	}
+	if fi, err := os.Stat(s.partPath(meta.UploadID)); err != nil || fi.Size() != 6 {
+		t.Fatalf(".part: %v %v", fi, err)
+	}
+}
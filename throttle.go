@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// ===== 带宽限制 =====
+
+// rateLimiter 是一个简单的令牌桶：令牌按 rate 字节/秒补充，最多累积 burst 个；
+// 允许透支，透支部分通过等待偿还，因此单次读取量不受 burst 限制。
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// reserve 扣除 n 个令牌，返回调用方需要等待的时长。
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttleReadSize 限制单次读取大小，让等待更平滑，避免一次读满大 buffer 后长时间停顿。
+const throttleReadSize = 64 << 10
+
+// ThrottledReader 按共享的令牌桶限速读取。同一上传的多个分片请求共用一个令牌桶，
+// 因此无论客户端并发多少分片，总吞吐大致不超过配置值。
+type ThrottledReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func NewThrottledReader(r io.Reader, l *rateLimiter) *ThrottledReader {
+	return &ThrottledReader{r: r, l: l}
+}
+
+func (t *ThrottledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleReadSize {
+		p = p[:throttleReadSize]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if d := t.l.reserve(n); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// drainBurst 用掉令牌桶初始的 burst，之后的读取严格按速率进行。
+func drainBurst(l *rateLimiter) {
+	l.reserve(int(l.burst))
+}
+
+func checkElapsed(t *testing.T, got, want time.Duration) {
+	t.Helper()
+	// 下限较紧（限速不能失效），上限留出调度抖动的余量
+	if got < want*85/100 || got > want*160/100 {
+		t.Errorf("took %v, want about %v", got, want)
+	}
+}
+
+// 以 rate 字节/秒读取 n 字节约需 n/rate 秒。
+func TestThrottledReaderRate(t *testing.T) {
+	const (
+		rate = 4 << 20
+		n    = 2 << 20
+	)
+	l := newRateLimiter(rate)
+	drainBurst(l)
+	start := time.Now()
+	got, err := io.Copy(io.Discard, NewThrottledReader(bytes.NewReader(make([]byte, n)), l))
+	if err != nil || got != n {
+		t.Fatalf("copy: %d %v", got, err)
+	}
+	checkElapsed(t, time.Since(start), time.Duration(float64(n)/rate*float64(time.Second)))
+}
+
+// 同一上传的多个分片共用令牌桶，总吞吐不超过 rate。
+func TestThrottledReaderShared(t *testing.T) {
+	const (
+		rate    = 4 << 20
+		n       = 1 << 20
+		readers = 3
+	)
+	l := newRateLimiter(rate)
+	drainBurst(l)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = io.Copy(io.Discard, NewThrottledReader(bytes.NewReader(make([]byte, n)), l))
+		}()
+	}
+	wg.Wait()
+	checkElapsed(t, time.Since(start), time.Duration(float64(readers*n)/rate*float64(time.Second)))
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== tus 1.0.0 协议 =====
+//
+// 在原有 init/chunk/complete 接口之外提供 tus 兼容的断点续传入口，
+// 方便直接使用 tus-js-client、Uppy 等现成客户端。上传会话与原接口共用同一套元数据与 .part，
+// 支持 core、creation、termination 三部分；最后一个 PATCH 写满后自动完成落盘。
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+	tusBasePath   = "/api/v1/tus/"
+)
+
+// handleTus 处理 /api/v1/tus/ 与 /api/v1/tus/{upload_id}。
+func (s *Server) handleTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if s.config().Limits.MaxFileBytes > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.config().Limits.MaxFileBytes, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, http.StatusPreconditionFailed, "unsupported_tus_version", "unsupported tus version")
+		return
+	}
+
+	if r.Method != http.MethodHead && !s.writable(w) {
+		return
+	}
+
+	uploadID := strings.TrimPrefix(r.URL.Path, tusBasePath)
+	if uploadID == "" {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+			return
+		}
+		s.tusCreate(w, r)
+		return
+	}
+	if !validUploadID(uploadID) {
+		writeError(w, http.StatusNotFound, "upload_not_found", "not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		s.tusHead(w, r, uploadID)
+	case http.MethodPatch:
+		s.tusPatch(w, r, uploadID)
+	case http.MethodDelete:
+		s.tusDelete(w, r, uploadID)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+// tusCreate 对应 creation 扩展：Upload-Length 为文件大小，Upload-Metadata 中可带 filename、path、sha256。
+func (s *Server) tusCreate(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	// tus 的 PATCH 长度不固定，无法映射为 S3 multipart 的 part
+	if !s.localOnly(w) {
+		return
+	}
+	if !s.allowInit(w, r) {
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeError(w, http.StatusBadRequest, "deferred_length_unsupported", "deferred length not supported")
+		return
+	}
+	total, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || total < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_upload_length", "invalid Upload-Length")
+		return
+	}
+	md, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_upload_metadata", "invalid Upload-Metadata")
+		return
+	}
+	name := md["filename"]
+	if name == "" {
+		name = md["name"]
+	}
+	// tus 没有固定分片大小，按单次 PATCH 上限记录；加密时向下对齐到块大小
+	chunkSize := s.config().Limits.MaxChunkBytes
+	if s.encKey != nil {
+		chunkSize -= chunkSize % encBlockSize
+	}
+	meta, _, err := s.newUpload(initReq{
+		Filename:  name,
+		Path:      md["path"],
+		TotalSize: total,
+		ChunkSize: chunkSize,
+		SHA256:    md["sha256"],
+	})
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	// 空文件（Upload-Length: 0）不会再有 PATCH，创建时直接完成落盘；
+	// newUpload 把大小 0 视为流式上传，这里大小是确定的
+	if total == 0 {
+		if meta, err = s.tusCompleteEmpty(meta); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		reqLogger(r).Info("upload completed", "upload_id", meta.UploadID, "rel_path", meta.RelPath, "bytes", 0,
+			"protocol", "tus", "duration_ms", time.Since(start).Milliseconds())
+		w.Header().Set("Location", tusBasePath+meta.UploadID)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	reqLogger(r).Info("upload initialized", "upload_id", meta.UploadID, "rel_path", meta.RelPath, "total_size", meta.TotalSize,
+		"protocol", "tus", "duration_ms", time.Since(start).Milliseconds())
+	w.Header().Set("Location", tusBasePath+meta.UploadID)
+	if meta.ExpiresAt != nil {
+		w.Header().Set("Upload-Expires", meta.ExpiresAt.Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusCompleteEmpty 完成刚创建的空上传，失败时移除该会话（客户端无法再续传一个空文件）。
+func (s *Server) tusCompleteEmpty(meta UploadMeta) (UploadMeta, error) {
+	mu := s.lock(meta.UploadID)
+	mu.part.Lock()
+	defer mu.part.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	meta.Streaming = false
+	meta, _, err := s.finalizeUpload(meta)
+	if err != nil {
+		s.removeUpload(meta.UploadID)
+		return meta, err
+	}
+	return meta, nil
+}
+
+func (s *Server) tusHead(w http.ResponseWriter, r *http.Request, uploadID string) {
+	mu := s.lock(uploadID)
+	mu.Lock()
+	meta, err := s.loadMeta(uploadID)
+	mu.Unlock()
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(meta.UploadedSize, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(meta.TotalSize, 10))
+	if meta.ExpiresAt != nil {
+		w.Header().Set("Upload-Expires", meta.ExpiresAt.Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatch 从 Upload-Offset 处顺序追加数据。tus 要求偏移等于当前进度，
+// 因此只接受 uploaded_size（连续前缀）处的写入。
+func (s *Server) tusPatch(w http.ResponseWriter, r *http.Request, uploadID string) {
+	start := time.Now()
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_content_type", "unsupported content type")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_upload_offset", "invalid Upload-Offset")
+		return
+	}
+	if r.ContentLength < 0 {
+		writeError(w, http.StatusLengthRequired, "length_required", "missing Content-Length")
+		return
+	}
+	if r.ContentLength > s.config().Limits.MaxChunkBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "chunk_too_large", "chunk too large")
+		return
+	}
+
+	// 先排队取写盘名额再加锁，排队期间同一上传的 HEAD 不受影响
+	release, err := s.acquireChunkSlot(r.Context())
+	if err != nil {
+		if clientGone(r, err) {
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		writeHTTPError(w, err)
+		return
+	}
+	defer release()
+
+	mu := s.lock(uploadID)
+	mu.part.Lock()
+	defer mu.part.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	meta, err := s.loadMeta(uploadID)
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+	if meta.Completed {
+		writeError(w, http.StatusForbidden, "upload_completed", "already completed")
+		return
+	}
+	if meta.Streaming {
+		writeError(w, http.StatusBadRequest, "streaming_not_supported", "streaming upload not supported over tus")
+		return
+	}
+	if offset != meta.UploadedSize {
+		writeError(w, http.StatusConflict, "offset_mismatch", "offset mismatch")
+		return
+	}
+	n := minInt64(r.ContentLength, meta.TotalSize-offset)
+	// 加密上传只能整块写入：未到文件末尾时丢弃不足一块的尾部，客户端按返回的 Upload-Offset 续传
+	if meta.Encrypted && offset+n < meta.TotalSize {
+		n -= n % encBlockSize
+	}
+
+	// tus 允许请求中途断开，已写入的部分照常记入进度，客户端 HEAD 后从断点继续
+	src := s.throttle(uploadID, s.chunkBody(w, r))
+	ph := newPrefixHasher(meta, offset)
+	if ph != nil {
+		src = io.TeeReader(src, ph)
+	}
+	var head *headBuffer
+	if offset == 0 {
+		head = &headBuffer{}
+		src = io.TeeReader(src, head)
+	}
+	wrote, copyErr := s.store.WriteChunk(r.Context(), meta, offset, n, src)
+	release()
+	if wrote > 0 {
+		if head != nil && meta.SniffedType == "" {
+			meta.SniffedType = head.contentType()
+			if s.rejectSniffed(r, meta) {
+				writeError(w, http.StatusUnsupportedMediaType, "file_type_not_allowed", "file type not allowed: "+meta.SniffedType)
+				return
+			}
+		}
+		if meta, err = s.commitChunk(meta, offset, wrote, ph); err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "save failed")
+			return
+		}
+	}
+	if copyErr != nil {
+		if isReadTimeout(copyErr) {
+			reqLogger(r).Info("chunk read timed out", "upload_id", uploadID, "offset", offset, "bytes", wrote, "protocol", "tus")
+			writeError(w, http.StatusRequestTimeout, "request_timeout", "request timeout")
+			return
+		}
+		if clientGone(r, copyErr) {
+			reqLogger(r).Info("chunk aborted by client", "upload_id", uploadID, "offset", offset, "bytes", wrote, "protocol", "tus")
+			w.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "internal_error", "write failed")
+		return
+	}
+
+	completed := false
+	if rangesCover(meta.ReceivedRanges, meta.TotalSize) {
+		if meta, _, err = s.finalizeUpload(meta); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		completed = true
+	}
+
+	reqLogger(r).Info("chunk written", "upload_id", uploadID, "offset", offset, "bytes", wrote,
+		"uploaded_size", meta.UploadedSize, "protocol", "tus", "duration_ms", time.Since(start).Milliseconds())
+	if completed {
+		reqLogger(r).Info("upload completed", "upload_id", uploadID, "rel_path", meta.RelPath, "bytes", meta.TotalSize,
+			"protocol", "tus")
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(meta.UploadedSize, 10))
+	if meta.ExpiresAt != nil && !completed {
+		w.Header().Set("Upload-Expires", meta.ExpiresAt.Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusDelete 对应 termination 扩展。
+func (s *Server) tusDelete(w http.ResponseWriter, r *http.Request, uploadID string) {
+	mu := s.lock(uploadID)
+	mu.part.Lock()
+	defer mu.part.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+
+	// 元数据损坏的上传同样允许终止，以便清理
+	meta, err := s.loadMeta(uploadID)
+	if err != nil && !errors.Is(err, errCorruptMeta) {
+		writeLoadError(w, err)
+		return
+	}
+	if meta.Completed {
+		writeError(w, http.StatusConflict, "upload_completed", "already completed")
+		return
+	}
+	s.removeUpload(uploadID)
+	reqLogger(r).Info("upload cancelled", "upload_id", uploadID, "uploaded_size", meta.UploadedSize, "protocol", "tus")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseTusMetadata 解析 Upload-Metadata："key base64value,key2 base64value2"，值可省略。
+func parseTusMetadata(v string) (map[string]string, error) {
+	md := map[string]string{}
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, enc, _ := strings.Cut(pair, " ")
+		val, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+		if err != nil {
+			return nil, err
+		}
+		md[key] = string(val)
+	}
+	return md, nil
+}
+
+// validUploadID 判断是否为 generateUploadID 生成的 32 位小写十六进制串或 26 位小写 base32 串；
+// 两种格式始终都接受，切换 upload_id_format 不影响已有会话。
+// upload_id 会直接拼进状态目录下的文件名，必须先校验。
+func validUploadID(id string) bool {
+	switch len(id) {
+	case 32:
+		for i := 0; i < len(id); i++ {
+			c := id[i]
+			if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+				return false
+			}
+		}
+		return true
+	case 26:
+		for i := 0; i < len(id); i++ {
+			c := id[i]
+			if (c < 'a' || c > 'z') && (c < '2' || c > '7') {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tusRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	return r
+}
+
+// tus 1.0.0 允许 Upload-Length: 0，创建时直接落盘一个空文件；负数仍然拒绝。
+func TestTusCreateEmpty(t *testing.T) {
+	s := newTestServer(t)
+	r := tusRequest(http.MethodPost, tusBasePath)
+	r.Header.Set("Upload-Length", "0")
+	r.Header.Set("Upload-Metadata", "path ZW1wdHkvZS50eHQ=") // empty/e.txt
+	w := httptest.NewRecorder()
+	s.handleTus(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	fi, err := os.Stat(filepath.Join(s.rootAbs, "empty", "e.txt"))
+	if err != nil || fi.Size() != 0 {
+		t.Fatalf("empty file not placed: %v %v", fi, err)
+	}
+
+	id := strings.TrimPrefix(w.Header().Get("Location"), tusBasePath)
+	w = httptest.NewRecorder()
+	s.handleTus(w, tusRequest(http.MethodHead, tusBasePath+id))
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "0" || w.Header().Get("Upload-Length") != "0" {
+		t.Fatalf("head: status %d offset %q length %q", w.Code, w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+
+	r = tusRequest(http.MethodPost, tusBasePath)
+	r.Header.Set("Upload-Length", "-1")
+	w = httptest.NewRecorder()
+	s.handleTus(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("negative length: status %d", w.Code)
+	}
+}
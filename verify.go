@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ===== complete 前的完整性检查 =====
+//
+// verify 报告上传是否已可以 complete：接收区间是否覆盖整个文件、还缺哪些区间、是否有内容冲突的重叠写入；
+// 带 checksum=true 时再计算已连续接收部分的 SHA-256，全部接收且 init 时声明了 sha256 时直接给出比对结果。
+// 与 complete 不同，verify 不移动、不修改任何文件，客户端可据此补发缺失的分片后再提交。
+
+// verifyMaxRanges 为响应中 missing_ranges 的最多条数，与 complete 的 409 响应一致。
+const verifyMaxRanges = 100
+
+// GET /api/v1/uploads/verify?upload_id=...[&checksum=true]
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	uploadID := strings.TrimSpace(q.Get("upload_id"))
+	if !checkUploadID(w, uploadID) {
+		return
+	}
+	checksum := false
+	if v := strings.TrimSpace(q.Get("checksum")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_checksum", "invalid checksum")
+			return
+		}
+		checksum = b
+	}
+
+	// 持有 part 读锁读取 .part，complete/cancel 会等它结束后再移走文件
+	ul := s.lock(uploadID)
+	ul.part.RLock()
+	defer ul.part.RUnlock()
+	ul.Lock()
+	meta, err := s.loadMeta(uploadID)
+	ul.Unlock()
+	if err != nil {
+		writeLoadError(w, err)
+		return
+	}
+	if meta.Completed {
+		writeError(w, http.StatusConflict, "upload_completed", "already completed")
+		return
+	}
+
+	// 流式上传的最终大小在 complete 时才确定，已连续接收的部分即为当前的全部
+	total := meta.TotalSize
+	if meta.Streaming {
+		total = meta.UploadedSize
+	}
+	received := rangesTotal(meta.ReceivedRanges)
+	missing := missingRanges(meta.ReceivedRanges, total)
+	covered := len(missing) == 0
+	if covered {
+		missing = [][2]int64{}
+	}
+	resp := map[string]any{
+		"upload_id":      meta.UploadID,
+		"total_size":     meta.TotalSize,
+		"uploaded_size":  meta.UploadedSize,
+		"received_bytes": received,
+		"missing_bytes":  rangesTotal(missing),
+		"covered":        covered,
+		"missing_ranges": missing[:min(len(missing), verifyMaxRanges)],
+	}
+	if len(meta.ConflictRanges) > 0 {
+		resp["conflict_ranges"] = meta.ConflictRanges
+	}
+	ready := covered && len(meta.ConflictRanges) == 0
+
+	// 只有本地后端能读回已接收的数据；摘要覆盖 [0, uploaded_size)
+	if _, local := s.store.(*localStorage); checksum && local {
+		sum, err := s.prefixSHA256(meta, meta.UploadedSize)
+		if err != nil {
+			reqLogger(r).Error("verify checksum failed", "upload_id", uploadID, "error", err)
+			writeError(w, http.StatusInternalServerError, "internal_error", "checksum failed")
+			return
+		}
+		resp["sha256"] = sum
+		resp["sha256_size"] = meta.UploadedSize
+		if covered && meta.ExpectedSHA256 != "" {
+			match := sum == meta.ExpectedSHA256
+			resp["expected_sha256"] = meta.ExpectedSHA256
+			resp["checksum_match"] = match
+			ready = ready && match
+		}
+	}
+	resp["ready"] = ready
+	writeJSON(w, http.StatusOK, resp)
+}
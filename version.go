@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+// 构建信息，发布时通过 -ldflags 注入：
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)" .
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("go-upload %s (commit %s, built %s)", version, commit, buildTime)
+}
@@ -0,0 +1,14 @@
+// 后端的错误响应统一为 {"error":{"code":"...","message":"...","request_id":"..."}}，
+// 这里取出 message 与 code 供界面展示；无法解析时退回原始文本。
+export async function readErrorMessage(resp: Response, fallback: string): Promise<string> {
+  const text = await resp.text();
+  try {
+    const err = JSON.parse(text)?.error;
+    if (err && typeof err.message === 'string') {
+      return err.code ? `${err.message} (${err.code})` : err.message;
+    }
+  } catch {
+    // 非 JSON 响应（如反向代理返回的错误页）
+  }
+  return text || fallback;
+}
@@ -1,4 +1,5 @@
 import { DirNode } from '../types';
+import { readErrorMessage } from './apiError';
 
 // 注意：如果 VITE_API_BASE_URL 配成 "/"，直接拼接会产生 "//api/..."，浏览器会把 "api" 当成域名。
 // 这里统一去掉末尾的 "/"，让 "/" 变成空串，从而请求走当前域名的 "/api/..."
@@ -24,8 +25,7 @@ export async function fetchStorageTree(params?: {
   const url = `${API_BASE}/api/v1/storage/tree${q.toString() ? `?${q}` : ''}`;
   const resp = await fetch(url);
   if (!resp.ok) {
-    const text = await resp.text();
-    throw new Error(text || 'fetch storage tree failed');
+    throw new Error(await readErrorMessage(resp, 'fetch storage tree failed'));
   }
   return (await resp.json()) as StorageTreeResp;
 }
@@ -1,4 +1,5 @@
 import { UploadStatus } from '../types';
+import { readErrorMessage } from './apiError';
 
 type ProgressCallback = (progress: number, speed: string) => void;
 type StatusCallback = (status: UploadStatus, error?: string) => void;
@@ -131,8 +132,7 @@ export const uploadFileWithResume = (
           signal: controller.signal,
       });
       if (!initResp.ok) {
-        const text = await initResp.text();
-        throw new Error(text || 'init upload failed');
+        throw new Error(await readErrorMessage(initResp, 'init upload failed'));
       }
       const initJson = (await initResp.json()) as InitResp;
       uploadId = initJson.upload_id;
@@ -176,8 +176,7 @@ export const uploadFileWithResume = (
       );
 
       if (!resp.ok) {
-        const text = await resp.text();
-        throw new Error(text || 'chunk upload failed');
+        throw new Error(await readErrorMessage(resp, 'chunk upload failed'));
       }
 
       sentBytes = chunkEnd;
@@ -211,8 +210,7 @@ export const uploadFileWithResume = (
     );
 
     if (!completeResp.ok) {
-      const text = await completeResp.text();
-      throw new Error(text || 'complete upload failed');
+      throw new Error(await readErrorMessage(completeResp, 'complete upload failed'));
     }
 
       if (resumeStorageKey) localStorage.removeItem(resumeStorageKey);
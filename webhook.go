@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ===== 完成通知 webhook =====
+//
+// 配置 webhook.url 后，每个上传完成时在后台 POST 一次 JSON 通知，失败按退避重试，不影响 complete 的响应。
+// webhook.delete_on_ack 开启时，接收方返回 2xx 且响应体为 {"ack":true} 才删除刚完成的文件及其元数据，
+// 适合“上传 -> 下游取走”的流水线；通知失败或未确认时文件保留。
+
+type WebhookConfig struct {
+	URL         string        `yaml:"url"`           // 为空时不发送通知
+	Timeout     time.Duration `yaml:"timeout"`       // 单次请求超时（默认 10s）
+	DeleteOnAck bool          `yaml:"delete_on_ack"` // 接收方确认后删除已完成的文件
+}
+
+func (c *WebhookConfig) normalize() error {
+	if c.URL = strings.TrimSpace(c.URL); c.URL == "" {
+		if c.DeleteOnAck {
+			return errors.New("webhook.delete_on_ack requires webhook.url")
+		}
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook.url %q", c.URL)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// webhookAttempts 为单个通知的最多尝试次数，两次之间按 1s、2s…退避。
+const webhookAttempts = 3
+
+// completionPayload 是上传完成时发给 webhook 的内容。
+type completionPayload struct {
+	Event            string    `json:"event"` // 固定为 upload.completed
+	UploadID         string    `json:"upload_id"`
+	Path             string    `json:"path"`     // 相对 root_dir 的最终路径
+	Location         string    `json:"location"` // 本地绝对路径或 s3://bucket/key
+	Filename         string    `json:"filename"`
+	OriginalFilename string    `json:"original_filename,omitempty"`
+	Size             int64     `json:"size"`
+	SHA256           string    `json:"sha256,omitempty"`
+	ContentType      string    `json:"content_type,omitempty"`
+	CompletedAt      time.Time `json:"completed_at"`
+
+	Metadata map[string]string `json:"metadata,omitempty"` // init 时附带的自定义键值对
+}
+
+func newCompletionPayload(meta UploadMeta, location string) completionPayload {
+	p := completionPayload{
+		Event:            "upload.completed",
+		UploadID:         meta.UploadID,
+		Path:             meta.RelPath,
+		Location:         location,
+		Filename:         meta.Filename,
+		OriginalFilename: meta.OriginalName,
+		Size:             meta.TotalSize,
+		SHA256:           meta.SHA256,
+		ContentType:      meta.ContentType,
+		Metadata:         meta.Metadata,
+	}
+	if meta.SniffedType != "" {
+		p.ContentType = meta.SniffedType
+	}
+	if meta.CompletedAt != nil {
+		p.CompletedAt = *meta.CompletedAt
+	}
+	return p
+}
+
+// webhookNotifier 以 HTTP POST 发送完成通知。
+type webhookNotifier struct {
+	s   *Server
+	cfg WebhookConfig
+}
+
+func (n *webhookNotifier) name() string { return "webhook" }
+
+func (n *webhookNotifier) notify(p completionPayload) (bool, error) {
+	acked, err := n.s.sendWebhook(n.cfg, p)
+	return acked && n.cfg.DeleteOnAck, err
+}
+
+// sendWebhook 发送通知直到收到 2xx 或用尽重试，返回接收方是否在响应体中给出 {"ack":true}。
+func (s *Server) sendWebhook(cfg WebhookConfig, p completionPayload) (bool, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return false, err
+	}
+	client := &http.Client{Timeout: cfg.Timeout}
+	for attempt := 1; ; attempt++ {
+		acked, err := postWebhook(client, cfg.URL, body)
+		if err == nil {
+			return acked, nil
+		}
+		if attempt == webhookAttempts {
+			return false, err
+		}
+		log.Printf("webhook for %s attempt %d failed, retrying: %v", p.UploadID, attempt, err)
+		select {
+		case <-s.done:
+			return false, err
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+func postWebhook(client *http.Client, target string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-upload/"+version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	// 响应体不是 JSON 或没有 ack 字段都视为未确认
+	var ack struct {
+		Ack bool `json:"ack"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	_ = json.Unmarshal(b, &ack)
+	return ack.Ack, nil
+}
+
+// deleteAcked 删除接收方已确认的文件及其元数据。通知期间文件可能已被移动、删除或被新的上传覆盖，
+// 这些情况下路径上已不是本次上传的内容，只记录日志、不做删除。
+func (s *Server) deleteAcked(meta UploadMeta) {
+	rel := meta.RelPath
+	s.finalizeMu.Lock()
+	obj, err := s.store.Open(context.Background(), rel)
+	if err != nil {
+		s.finalizeMu.Unlock()
+		log.Printf("webhook ack for %s: %s no longer available, skip delete", meta.UploadID, rel)
+		return
+	}
+	size, modTime := obj.Size, obj.ModTime
+	obj.Close()
+	if size != meta.TotalSize || meta.CompletedAt == nil || modTime.After(*meta.CompletedAt) {
+		s.finalizeMu.Unlock()
+		log.Printf("webhook ack for %s: %s was replaced after completion, skip delete", meta.UploadID, rel)
+		return
+	}
+	err = s.store.Remove(rel)
+	s.finalizeMu.Unlock()
+	if err != nil {
+		log.Printf("webhook ack for %s: delete %s failed: %v", meta.UploadID, rel, err)
+		return
+	}
+	s.invalidateQuota(rel)
+	s.fileIndex.Delete(rel)
+	s.pruneEmptyDirs(rel)
+
+	mu := s.lock(meta.UploadID)
+	mu.Lock()
+	s.forgetMeta(meta.UploadID)
+	mu.Unlock()
+	s.muByUpload.Delete(meta.UploadID)
+	log.Printf("webhook acked %s, deleted %s", meta.UploadID, rel)
+}
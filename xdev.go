@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isCrossDevice 判断 rename 是否因源与目标位于不同文件系统而失败。
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
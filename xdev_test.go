@@ -0,0 +1,77 @@
+//go:build !windows
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// simulateEXDEV 让 moveStaged 首先尝试的 rename 像跨文件系统时一样以 EXDEV 失败，测试结束后恢复。
+func simulateEXDEV(t *testing.T) *int {
+	t.Helper()
+	calls := 0
+	orig := moveRename
+	moveRename = func(oldpath, newpath string) error {
+		calls++
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	t.Cleanup(func() { moveRename = orig })
+	return &calls
+}
+
+// rename 返回 EXDEV 时改为在锁外复制到临时文件 + fsync，再 rename 到位，目标内容与权限正确，源文件与临时文件都不残留。
+func TestMoveStagedCrossDevice(t *testing.T) {
+	s := newTestServer(t)
+	calls := simulateEXDEV(t)
+	src := filepath.Join(s.stateAbs, "x.part")
+	data := make([]byte, 3<<20+17) // 跨越多个复制缓冲区
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(src, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(s.rootAbs, "x.bin")
+	if _, err := s.moveCompletedFile(src, dst, false); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if *calls != 1 {
+		t.Fatalf("rename attempted %d times, want 1", *calls)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil || string(got) != string(data) {
+		t.Fatalf("destination content differs (len %d, err %v)", len(got), err)
+	}
+	if fi, _ := os.Stat(dst); fi.Mode().Perm() != s.fileMode {
+		t.Errorf("mode %v, want %v", fi.Mode().Perm(), s.fileMode)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source still exists: %v", err)
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(s.rootAbs, ".x.bin*")); len(tmps) != 0 {
+		t.Errorf("temporary file left behind: %v", tmps)
+	}
+}
+
+// 整个上传在跨文件系统的情况下照常完成。
+func TestCompleteCrossDevice(t *testing.T) {
+	s := newTestServer(t)
+	simulateEXDEV(t)
+	meta := newTestUpload(t, s, "x/done.bin", 6, 6)
+	if w := putChunk(s, meta.UploadID, 0, []byte("abcdef")); w.Code != http.StatusOK {
+		t.Fatalf("chunk: status %d: %s", w.Code, w.Body)
+	}
+	if w := completeUpload(s, meta.UploadID, ""); w.Code != http.StatusOK {
+		t.Fatalf("complete: status %d: %s", w.Code, w.Body)
+	}
+	if b, err := os.ReadFile(filepath.Join(s.rootAbs, "x", "done.bin")); err != nil || string(b) != "abcdef" {
+		t.Fatalf("placed file: %q %v", b, err)
+	}
+	if _, err := os.Stat(s.partPath(meta.UploadID)); !os.IsNotExist(err) {
+		t.Errorf(".part still exists: %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errorNotSameDevice 即 ERROR_NOT_SAME_DEVICE：MoveFileEx 不允许跨卷移动。
+const errorNotSameDevice = syscall.Errno(17)
+
+// isCrossDevice 判断 rename 是否因源与目标位于不同卷而失败。
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice)
+}